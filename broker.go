@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Clases de sobre que intercambian los nodos a través del broker
+const (
+	sobreMensaje   = "message"  // mensaje difundido en la sala
+	sobreDirecto   = "direct"   // mensaje privado para un usuario conectado a otro nodo
+	sobrePresencia = "presence" // usuarios conectados a un nodo (también sirve de latido)
+	sobreHola      = "hello"    // un nodo arranca y pide la presencia de los demás
+	// Reserva de nombres en todo el cluster (ver reservas.go)
+	sobreReserva          = "claim"
+	sobreRespuestaReserva = "claim_reply"
+	sobreLiberar          = "release"
+	// Indicador de escritura o recibo de lectura de un usuario del nodo que lo publica
+	sobreEfimero = "ephemeral"
+)
+
+// Valores por defecto del reparto entre nodos
+const (
+	intervaloLatidoPorDefecto = 5 * time.Second
+	// Latidos perdidos tras los que se dan por desconectados los usuarios de un nodo
+	latidosPerdidos = 3
+	// IDs recordados para descartar mensajes repetidos
+	capacidadVistos = 4096
+	// Sobres pendientes de publicar o de procesar antes de empezar a descartar
+	capacidadSobres = 1024
+)
+
+var errBrokerCerrado = errors.New("broker cerrado")
+
+// Sobre es lo que viaja entre nodos: un mensaje o la presencia de un nodo
+type Sobre struct {
+	Nodo      string            `json:"node"`
+	Tipo      string            `json:"kind"`
+	Mensaje   *Message          `json:"message,omitempty"`
+	Presencia []EstadoPresencia `json:"presence,omitempty"`
+	// Reservas de nombres: consulta, nombre pedido, nodo al que se responde y respuesta
+	ID     string `json:"id,omitempty"`
+	Nombre string `json:"name,omitempty"`
+	Para   string `json:"to,omitempty"`
+	EnUso  bool   `json:"in_use,omitempty"`
+}
+
+// Broker reparte sobres entre todas las instancias del servidor que comparten sala.
+// Un nodo puede recibir sus propios sobres o recibir uno más de una vez: el hub
+// descarta lo que ya ha visto
+type Broker interface {
+	// Publicar envía un sobre a todos los nodos suscritos
+	Publicar(sobre *Sobre) error
+	// Suscribir empieza a entregar a recibir los sobres publicados. recibir se llama
+	// siempre desde la misma goroutine, así que los sobres llegan en orden
+	Suscribir(recibir func(*Sobre)) error
+	// Cerrar deja de publicar y de entregar sobres
+	Cerrar() error
+}
+
+// ContadorNodos lo cumplen los brokers que saben cuántos nodos más reciben lo que se
+// publica. Las reservas de nombres esperan la respuesta de todos ellos; con un broker
+// que no lo sabe, se espera a los nodos de los que ya llegó presencia
+type ContadorNodos interface {
+	// NodosConectados devuelve cuántos otros nodos están enlazados ahora
+	NodosConectados() (int, error)
+}
+
+// BrokerMemoria reparte sobres entre hubs del mismo proceso. Sirve para pruebas y para
+// repartir una sala entre varios hubs sin infraestructura externa
+type BrokerMemoria struct {
+	mu           sync.Mutex
+	suscriptores []chan []byte
+	cerrado      bool
+}
+
+// NewBrokerMemoria crea un broker en memoria sin suscriptores
+func NewBrokerMemoria() *BrokerMemoria {
+	return &BrokerMemoria{}
+}
+
+// Publicar serializa el sobre y lo entrega a cada suscriptor. Cada hub recibe su propia
+// copia, igual que con un broker de red, así que no comparten punteros
+func (b *BrokerMemoria) Publicar(sobre *Sobre) error {
+	datos, err := json.Marshal(sobre)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, cola := range b.suscriptores {
+		select {
+		case cola <- datos:
+		default:
+			log.Printf("Broker en memoria: suscriptor saturado, sobre descartado")
+		}
+	}
+	return nil
+}
+
+// Suscribir registra un suscriptor con su propia cola y goroutine de entrega
+func (b *BrokerMemoria) Suscribir(recibir func(*Sobre)) error {
+	cola := make(chan []byte, capacidadSobres)
+	b.mu.Lock()
+	if b.cerrado {
+		b.mu.Unlock()
+		return errBrokerCerrado
+	}
+	b.suscriptores = append(b.suscriptores, cola)
+	b.mu.Unlock()
+
+	go func() {
+		for datos := range cola {
+			var sobre Sobre
+			if err := json.Unmarshal(datos, &sobre); err != nil {
+				log.Printf("Broker en memoria: sobre no válido: %v", err)
+				continue
+			}
+			recibir(&sobre)
+		}
+	}()
+	return nil
+}
+
+// NodosConectados devuelve cuántos suscriptores hay además del hub que pregunta
+func (b *BrokerMemoria) NodosConectados() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.suscriptores) == 0 {
+		return 0, nil
+	}
+	return len(b.suscriptores) - 1, nil
+}
+
+// Cerrar termina las entregas a todos los suscriptores
+func (b *BrokerMemoria) Cerrar() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.cerrado {
+		b.cerrado = true
+		for _, cola := range b.suscriptores {
+			close(cola)
+		}
+		b.suscriptores = nil
+	}
+	return nil
+}
+
+// registroVistos recuerda los últimos IDs recibidos de otros nodos. Solo se usa desde Run
+type registroVistos struct {
+	ids   map[string]bool
+	orden []string
+	pos   int
+}
+
+func newRegistroVistos(capacidad int) *registroVistos {
+	return &registroVistos{ids: make(map[string]bool, capacidad), orden: make([]string, capacidad)}
+}
+
+// marcar anota un ID y devuelve false si ya estaba. Al llenarse olvida el más antiguo
+func (v *registroVistos) marcar(id string) bool {
+	if v.ids[id] {
+		return false
+	}
+	if antiguo := v.orden[v.pos]; antiguo != "" {
+		delete(v.ids, antiguo)
+	}
+	v.orden[v.pos] = id
+	v.pos = (v.pos + 1) % len(v.orden)
+	v.ids[id] = true
+	return true
+}
+
+// nodoRemoto es la última presencia publicada por otro nodo
+type nodoRemoto struct {
+	usuarios []EstadoPresencia
+	visto    time.Time
+}
+
+// SetBroker conecta el hub con las demás instancias de la sala. nodo identifica a esta
+// instancia y tiene que ser distinto en cada una. Debe llamarse antes de Run
+func (h *Hub) SetBroker(broker Broker, nodo string) {
+	h.broker = broker
+	if nodo != "" {
+		h.nodo = nodo
+	}
+}
+
+// iniciarBroker se suscribe a los sobres de los demás nodos, arranca la publicación y se
+// presenta para recibir su presencia. Se llama al comienzo de Run
+func (h *Hub) iniciarBroker() {
+	go func() {
+		for sobre := range h.salientes {
+			if err := h.broker.Publicar(sobre); err != nil {
+				log.Printf("Error publicando en el broker: %v", err)
+			}
+		}
+	}()
+	if err := h.broker.Suscribir(func(sobre *Sobre) { h.remotos <- sobre }); err != nil {
+		log.Printf("Error suscribiéndose al broker: %v", err)
+		return
+	}
+	log.Printf("Nodo %s conectado al broker", h.nodo)
+	h.publicarSobre(&Sobre{Tipo: sobreHola})
+	h.publicarPresencia()
+}
+
+// publicarSobre encola un sobre para los demás nodos sin bloquear a quien lo llama.
+// Se puede llamar desde cualquier goroutine
+func (h *Hub) publicarSobre(sobre *Sobre) {
+	if h.broker == nil {
+		return
+	}
+	sobre.Nodo = h.nodo
+	select {
+	case h.salientes <- sobre:
+	default:
+		log.Printf("Cola del broker llena, sobre %s descartado", sobre.Tipo)
+	}
+}
+
+// publicarMensaje reenvía a los demás nodos un mensaje difundido en este. Se llama
+// desde broadcastMessage antes de repartirlo, porque le asigna un ID si no lo tiene
+func (h *Hub) publicarMensaje(message *Message) {
+	if h.broker == nil || message.remoto || message.Type == tipoPresencia {
+		// La presencia viaja como foto completa de cada nodo, no evento a evento
+		return
+	}
+	if message.ID == "" {
+		message.ID = nuevoIDMensaje()
+	}
+	h.publicarSobre(&Sobre{Tipo: sobreMensaje, Mensaje: message})
+}
+
+// publicarEfimero envía a los demás nodos un indicador de escritura o un recibo de
+// lectura de un usuario de este nodo
+func (h *Hub) publicarEfimero(message *Message) {
+	if h.broker == nil || message.remoto {
+		return
+	}
+	h.publicarSobre(&Sobre{Tipo: sobreEfimero, Mensaje: message})
+}
+
+// publicarPresencia envía a los demás nodos quién está conectado a este
+func (h *Hub) publicarPresencia() {
+	if h.broker == nil {
+		return
+	}
+	h.clientsMutex.RLock()
+	usuarios := make([]EstadoPresencia, 0, len(h.presencia))
+	for _, estado := range h.presencia {
+		usuarios = append(usuarios, *estado)
+	}
+	h.clientsMutex.RUnlock()
+	h.publicarSobre(&Sobre{Tipo: sobrePresencia, Presencia: usuarios})
+}
+
+// recibirSobre procesa lo que llega de otro nodo. Se ejecuta desde Run
+func (h *Hub) recibirSobre(sobre *Sobre) {
+	if sobre.Nodo == h.nodo {
+		return
+	}
+	switch sobre.Tipo {
+	case sobreHola:
+		h.publicarPresencia()
+	case sobrePresencia:
+		h.actualizarNodo(sobre.Nodo, sobre.Presencia)
+	case sobreReserva:
+		h.responderReserva(sobre)
+	case sobreRespuestaReserva:
+		h.recibirRespuestaReserva(sobre)
+	case sobreLiberar:
+		h.liberarReserva(sobre)
+	case sobreEfimero:
+		h.recibirEfimero(sobre.Mensaje)
+	case sobreMensaje, sobreDirecto:
+		message := sobre.Mensaje
+		if message == nil || message.ID == "" || !h.vistos.marcar(message.ID) {
+			return
+		}
+		message.remoto = true
+		if sobre.Tipo == sobreDirecto {
+			h.entregarDirectoRemoto(message)
+			return
+		}
+		h.broadcastMessage(message)
+	}
+}
+
+// entregarDirectoRemoto entrega un mensaje privado de otro nodo a las sesiones locales
+// del destinatario y del remitente. El buzón lo gestiona el nodo de origen
+func (h *Hub) entregarDirectoRemoto(message *Message) {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	h.conocidos[message.Username] = true
+	h.entregarASesionesLocked(message.To, message)
+	h.entregarASesionesLocked(message.Username, message)
+}
+
+// recibirEfimero reparte a los clientes locales un indicador de escritura o un recibo de
+// lectura de otro nodo. Quién escribe y cuándo caduca lo lleva el nodo del usuario, que
+// publica también el final; aquí solo se reenvía
+func (h *Hub) recibirEfimero(message *Message) {
+	if message == nil || !esEfimero(message) {
+		return
+	}
+	message.remoto = true
+	if message.Type == tipoRecibo {
+		// Quien se conecte a este nodo recibe la marca con el historial
+		h.historial.MarcarLeido(message.Username, message.MessageID)
+	}
+	h.difundirEfimero(message, false)
+}
+
+// actualizarNodo guarda la presencia publicada por otro nodo y avisa a los clientes
+// locales de quién entró, salió o cambió de estado en la sala
+func (h *Hub) actualizarNodo(nodo string, usuarios []EstadoPresencia) {
+	h.clientsMutex.Lock()
+	antes := h.estadosLocked()
+	h.presenciaRemota[nodo] = &nodoRemoto{usuarios: usuarios, visto: time.Now()}
+	for _, estado := range usuarios {
+		h.conocidos[estado.Username] = true
+	}
+	eventos := cambiosPresencia(antes, h.estadosLocked())
+	h.clientsMutex.Unlock()
+
+	for _, evento := range eventos {
+		h.difundirEfimero(evento, false)
+	}
+}
+
+// caducarNodos olvida la presencia de los nodos que dejaron de dar señales y vuelve a
+// publicar la propia, que hace de latido. Se ejecuta periódicamente desde Run
+func (h *Hub) caducarNodos() {
+	limite := time.Now().Add(-latidosPerdidos * h.intervaloLatido)
+	h.clientsMutex.Lock()
+	antes := h.estadosLocked()
+	for nodo, remoto := range h.presenciaRemota {
+		if remoto.visto.Before(limite) {
+			log.Printf("El nodo %s dejó de responder", nodo)
+			delete(h.presenciaRemota, nodo)
+		}
+	}
+	h.caducarReservasLocked(time.Now())
+	eventos := cambiosPresencia(antes, h.estadosLocked())
+	h.clientsMutex.Unlock()
+
+	for _, evento := range eventos {
+		h.difundirEfimero(evento, false)
+	}
+	h.publicarPresencia()
+}
+
+// presenciaCubierta indica si un evento de presencia local no cambia lo que ve la sala
+// porque el usuario sigue conectado desde otro nodo
+func (h *Hub) presenciaCubierta(message *Message) bool {
+	if h.broker == nil || message.Type != tipoPresencia || message.remoto || message.Presence == presenciaRenombrado {
+		return false
+	}
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	return h.presenteEnOtroNodoLocked(message.Username)
+}
+
+// presenteEnOtroNodoLocked indica si el usuario tiene sesiones en otro nodo. Requiere clientsMutex tomado
+func (h *Hub) presenteEnOtroNodoLocked(nombre string) bool {
+	for _, remoto := range h.presenciaRemota {
+		for _, estado := range remoto.usuarios {
+			if estado.Username == nombre {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prioridadEstado ordena los estados para combinar los de un usuario con sesiones en
+// varios nodos: basta una sesión activa para que se le vea activo
+func prioridadEstado(estado string) int {
+	switch estado {
+	case presenciaActivo:
+		return 2
+	case presenciaInactivo:
+		return 1
+	}
+	return 0
+}
+
+// estadosLocked combina la presencia local con la de los demás nodos. Requiere clientsMutex tomado
+func (h *Hub) estadosLocked() map[string]EstadoPresencia {
+	estados := make(map[string]EstadoPresencia, len(h.presencia))
+	for nombre, estado := range h.presencia {
+		estados[nombre] = *estado
+	}
+	for _, remoto := range h.presenciaRemota {
+		for _, estado := range remoto.usuarios {
+			if actual, ok := estados[estado.Username]; !ok || prioridadEstado(estado.Status) > prioridadEstado(actual.Status) {
+				estados[estado.Username] = estado
+			}
+		}
+	}
+	return estados
+}
+
+// cambiosPresencia compara dos fotos de la sala y devuelve los eventos que las separan
+func cambiosPresencia(antes, despues map[string]EstadoPresencia) []*Message {
+	var eventos []*Message
+	for nombre, estado := range despues {
+		anterior, estaba := antes[nombre]
+		switch {
+		case !estaba:
+			eventos = append(eventos, NewPresenceMessage(nombre, presenciaEntra))
+		case anterior.Status != estado.Status:
+			eventos = append(eventos, NewPresenceMessage(nombre, estado.Status))
+		}
+	}
+	for nombre := range antes {
+		if _, sigue := despues[nombre]; !sigue {
+			eventos = append(eventos, NewPresenceMessage(nombre, presenciaSale))
+		}
+	}
+	return eventos
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Canal de Redis que usan los nodos si no se indica otro
+const canalRedisPorDefecto = "chat-app"
+
+// Tiempos de la conexión con Redis
+const (
+	timeoutRedis         = 5 * time.Second
+	reintentoRedisMinimo = 100 * time.Millisecond
+	reintentoRedisMaximo = 10 * time.Second
+)
+
+// BrokerRedis reparte sobres con el pub/sub de Redis (PUBLISH y SUBSCRIBE sobre un
+// canal). Habla el protocolo RESP directamente, así que sirve cualquier servidor
+// compatible. Usa una conexión para publicar y otra para la suscripción, que se
+// restablecen solas si se caen
+type BrokerRedis struct {
+	direccion string
+	canal     string
+	// Contraseña para AUTH; vacía si el servidor no la pide
+	password string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	lector  *bufio.Reader
+	cerrado bool
+	// Conexión de la suscripción, para poder cortarla al cerrar
+	suscripcion net.Conn
+}
+
+// NewBrokerRedis crea un broker sobre el servidor Redis en direccion (host:puerto)
+func NewBrokerRedis(direccion, canal, password string) *BrokerRedis {
+	if canal == "" {
+		canal = canalRedisPorDefecto
+	}
+	return &BrokerRedis{direccion: direccion, canal: canal, password: password}
+}
+
+// escribirComandoRESP envía un comando como array de cadenas RESP
+func escribirComandoRESP(w io.Writer, args ...string) error {
+	b := make([]byte, 0, 64)
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, '\r', '\n')
+	for _, arg := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, '\r', '\n')
+		b = append(b, arg...)
+		b = append(b, '\r', '\n')
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// errorRedis es una respuesta de error del servidor ("-ERR ...")
+type errorRedis string
+
+func (e errorRedis) Error() string { return "redis: " + string(e) }
+
+// leerRESP lee un valor RESP: string, errorRedis, int64, nil (bulk nulo) o []interface{}
+func leerRESP(r *bufio.Reader) (interface{}, error) {
+	linea, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(linea) < 3 || linea[len(linea)-2] != '\r' {
+		return nil, fmt.Errorf("redis: respuesta mal formada %q", linea)
+	}
+	tipo, resto := linea[0], linea[1:len(linea)-2]
+	switch tipo {
+	case '+':
+		return resto, nil
+	case '-':
+		return errorRedis(resto), nil
+	case ':':
+		return strconv.ParseInt(resto, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(resto)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: longitud no válida %q", resto)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		datos := make([]byte, n+2)
+		if _, err := io.ReadFull(r, datos); err != nil {
+			return nil, err
+		}
+		return string(datos[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(resto)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: longitud no válida %q", resto)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		elementos := make([]interface{}, n)
+		for i := range elementos {
+			if elementos[i], err = leerRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return elementos, nil
+	}
+	return nil, fmt.Errorf("redis: tipo de respuesta desconocido %q", tipo)
+}
+
+// conectar abre una conexión y se autentica si hace falta
+func (b *BrokerRedis) conectar() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.direccion, timeoutRedis)
+	if err != nil {
+		return nil, nil, err
+	}
+	lector := bufio.NewReader(conn)
+	if b.password != "" {
+		conn.SetDeadline(time.Now().Add(timeoutRedis))
+		if err := escribirComandoRESP(conn, "AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		respuesta, err := leerRESP(lector)
+		if err == nil {
+			if e, ok := respuesta.(errorRedis); ok {
+				err = e
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, lector, nil
+}
+
+// Publicar envía el sobre con PUBLISH
+func (b *BrokerRedis) Publicar(sobre *Sobre) error {
+	datos, err := json.Marshal(sobre)
+	if err != nil {
+		return err
+	}
+	_, err = b.comando("PUBLISH", b.canal, string(datos))
+	return err
+}
+
+// NodosConectados pregunta a Redis cuántas conexiones están suscritas al canal
+// (PUBSUB NUMSUB), sin contar la de este nodo
+func (b *BrokerRedis) NodosConectados() (int, error) {
+	respuesta, err := b.comando("PUBSUB", "NUMSUB", b.canal)
+	if err != nil {
+		return 0, err
+	}
+	if campos, ok := respuesta.([]interface{}); ok && len(campos) == 2 {
+		if suscritos, ok := campos[1].(int64); ok {
+			if suscritos == 0 {
+				return 0, nil
+			}
+			return int(suscritos) - 1, nil
+		}
+	}
+	return 0, fmt.Errorf("redis: respuesta inesperada a PUBSUB NUMSUB: %v", respuesta)
+}
+
+// comando envía un comando por la conexión de publicación y devuelve la respuesta. Si
+// la conexión falla se descarta y el siguiente comando abre otra
+func (b *BrokerRedis) comando(args ...string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cerrado {
+		return nil, errBrokerCerrado
+	}
+	var err error
+	if b.conn == nil {
+		if b.conn, b.lector, err = b.conectar(); err != nil {
+			return nil, err
+		}
+	}
+	b.conn.SetDeadline(time.Now().Add(timeoutRedis))
+	err = escribirComandoRESP(b.conn, args...)
+	var respuesta interface{}
+	if err == nil {
+		respuesta, err = leerRESP(b.lector)
+	}
+	if err != nil {
+		b.conn.Close()
+		b.conn, b.lector = nil, nil
+		return nil, err
+	}
+	if e, ok := respuesta.(errorRedis); ok {
+		return nil, e
+	}
+	return respuesta, nil
+}
+
+// Suscribir mantiene una suscripción al canal en segundo plano, reconectando con
+// esperas crecientes cuando se pierde, y entrega cada sobre a recibir
+func (b *BrokerRedis) Suscribir(recibir func(*Sobre)) error {
+	b.mu.Lock()
+	cerrado := b.cerrado
+	b.mu.Unlock()
+	if cerrado {
+		return errBrokerCerrado
+	}
+	go func() {
+		espera := reintentoRedisMinimo
+		for {
+			err := b.escuchar(recibir, func() { espera = reintentoRedisMinimo })
+			b.mu.Lock()
+			cerrado := b.cerrado
+			b.mu.Unlock()
+			if cerrado {
+				return
+			}
+			log.Printf("Suscripción a Redis perdida (%v), reintentando en %s", err, espera)
+			time.Sleep(espera)
+			if espera *= 2; espera > reintentoRedisMaximo {
+				espera = reintentoRedisMaximo
+			}
+		}
+	}()
+	return nil
+}
+
+// escuchar abre una conexión, se suscribe y entrega mensajes hasta que falla.
+// suscrito se llama cuando el servidor confirma la suscripción
+func (b *BrokerRedis) escuchar(recibir func(*Sobre), suscrito func()) error {
+	conn, lector, err := b.conectar()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	if b.cerrado {
+		b.mu.Unlock()
+		conn.Close()
+		return errBrokerCerrado
+	}
+	b.suscripcion = conn
+	b.mu.Unlock()
+	defer conn.Close()
+
+	if err := escribirComandoRESP(conn, "SUBSCRIBE", b.canal); err != nil {
+		return err
+	}
+	for {
+		respuesta, err := leerRESP(lector)
+		if err != nil {
+			return err
+		}
+		if e, ok := respuesta.(errorRedis); ok {
+			return e
+		}
+		partes, ok := respuesta.([]interface{})
+		if !ok || len(partes) != 3 {
+			continue
+		}
+		switch partes[0] {
+		case "subscribe":
+			suscrito()
+		case "message":
+			datos, _ := partes[2].(string)
+			var sobre Sobre
+			if err := json.Unmarshal([]byte(datos), &sobre); err != nil {
+				log.Printf("Sobre no válido en Redis: %v", err)
+				continue
+			}
+			recibir(&sobre)
+		}
+	}
+}
+
+// Cerrar corta las dos conexiones y detiene los reintentos
+func (b *BrokerRedis) Cerrar() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cerrado {
+		return nil
+	}
+	b.cerrado = true
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+	if b.suscripcion != nil {
+		b.suscripcion.Close()
+	}
+	return nil
+}
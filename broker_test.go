@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// iniciarNodosPrueba arranca dos hubs que comparten sala a través del broker
+func iniciarNodosPrueba(t *testing.T, broker Broker) (*Hub, *Hub) {
+	t.Helper()
+	hubA, hubB := NewHub(), NewHub()
+	hubA.SetBroker(broker, "a")
+	hubB.SetBroker(broker, "b")
+	go hubA.Run()
+	go hubB.Run()
+	return hubA, hubB
+}
+
+// TestBrokerMemoriaUneDosNodos prueba mensajes y presencia entre usuarios de nodos distintos
+func TestBrokerMemoriaUneDosNodos(t *testing.T) {
+	broker := NewBrokerMemoria()
+	t.Cleanup(func() { broker.Cerrar() })
+	hubA, hubB := iniciarNodosPrueba(t, broker)
+
+	luis := conectarEnMemoria(t, hubB, "luis")
+	ana := conectarEnMemoria(t, hubA, "ana")
+	esperarMensaje(t, luis, esPresencia("ana", presenciaEntra))
+
+	enviarTexto(t, ana, "hola desde el nodo a")
+	recibido := esperarMensaje(t, luis, contiene("hola desde el nodo a"))
+	if recibido.Username != "ana" || recibido.ID == "" || recibido.Room != salaPorDefecto {
+		t.Errorf("Mensaje remoto inesperado: %+v", recibido)
+	}
+	if _, ok := hubB.historial.Buscar(recibido.ID); !ok {
+		t.Error("El mensaje remoto debería guardarse en el historial del otro nodo")
+	}
+
+	enviarTexto(t, luis, "/who")
+	if quien := esperarMensaje(t, luis, contiene("Conectados")); quien.MessageContent != "Conectados (2): ana, luis" {
+		t.Errorf("/who debería listar a los usuarios de los dos nodos: %q", quien.MessageContent)
+	}
+
+	ana.Close()
+	esperarMensaje(t, luis, esPresencia("ana", presenciaSale))
+}
+
+// TestBrokerDescartaRepetidos prueba que un mismo mensaje recibido dos veces se difunde una
+func TestBrokerDescartaRepetidos(t *testing.T) {
+	broker := NewBrokerMemoria()
+	t.Cleanup(func() { broker.Cerrar() })
+	hub := NewHub()
+	hub.SetBroker(broker, "a")
+	go hub.Run()
+	luis := conectarEnMemoria(t, hub, "luis")
+	esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoHistorial })
+
+	repetido := NewUserMessage("eva", "solo una vez")
+	broker.Publicar(&Sobre{Nodo: "x", Tipo: sobreMensaje, Mensaje: repetido})
+	broker.Publicar(&Sobre{Nodo: "y", Tipo: sobreMensaje, Mensaje: repetido})
+	broker.Publicar(&Sobre{Nodo: "x", Tipo: sobreMensaje, Mensaje: NewUserMessage("eva", "fin")})
+
+	veces := 0
+	for _, m := range mensajesHasta(t, luis, "fin") {
+		if m.ID == repetido.ID {
+			veces++
+		}
+	}
+	if veces != 1 {
+		t.Errorf("El mensaje repetido llegó %d veces", veces)
+	}
+}
+
+// TestBrokerDirectoEntreNodos prueba un mensaje privado a alguien conectado a otro nodo
+func TestBrokerDirectoEntreNodos(t *testing.T) {
+	broker := NewBrokerMemoria()
+	t.Cleanup(func() { broker.Cerrar() })
+	hubA, hubB := iniciarNodosPrueba(t, broker)
+
+	ana := conectarEnMemoria(t, hubA, "ana")
+	luis := conectarEnMemoria(t, hubB, "luis")
+	esperarMensaje(t, ana, esPresencia("luis", presenciaEntra))
+
+	enviarTexto(t, ana, "/msg luis ¿me oyes desde el otro nodo?")
+	directo := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoDirecto })
+	if directo.Username != "ana" || directo.MessageContent != "¿me oyes desde el otro nodo?" {
+		t.Errorf("Mensaje privado inesperado: %+v", directo)
+	}
+	if n := hubA.Pendientes("luis"); n != 0 {
+		t.Errorf("No debería quedar en el buzón de un usuario conectado a otro nodo, hay %d", n)
+	}
+}
+
+// TestBrokerEfimerosEntreNodos prueba que los indicadores de escritura y los recibos de
+// lectura llegan a los usuarios de otro nodo
+func TestBrokerEfimerosEntreNodos(t *testing.T) {
+	broker := NewBrokerMemoria()
+	t.Cleanup(func() { broker.Cerrar() })
+	hubA, hubB := iniciarNodosPrueba(t, broker)
+
+	ana := conectarEnMemoria(t, hubA, "ana")
+	luis := conectarEnMemoria(t, hubB, "luis")
+	esperarMensaje(t, ana, esPresencia("luis", presenciaEntra))
+
+	enviarEvento(t, ana, tipoEscribiendo)
+	esperarMensaje(t, luis, esEscritura("ana", tipoEscribiendo))
+	enviarEvento(t, ana, tipoDejaEscribir)
+	esperarMensaje(t, luis, esEscritura("ana", tipoDejaEscribir))
+
+	enviarTexto(t, luis, "¿lo has leído?")
+	leido := esperarMensaje(t, ana, contiene("¿lo has leído?"))
+	enviarJSON(t, ana, map[string]interface{}{"type": "read", "message_id": leido.ID})
+	recibo := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoRecibo })
+	if recibo.Username != "ana" || recibo.MessageID != leido.ID {
+		t.Errorf("Recibo inesperado: %+v", recibo)
+	}
+	if marca := hubB.historial.Marcador("ana"); marca != leido.ID {
+		t.Errorf("El otro nodo debería guardar la marca de ana, tiene %q", marca)
+	}
+}
+
+// servidorRedisPrueba es un sustituto mínimo de Redis que solo entiende AUTH, SUBSCRIBE,
+// PUBLISH y PUBSUB NUMSUB
+type servidorRedisPrueba struct {
+	listener net.Listener
+	mu       sync.Mutex
+	// Conexiones suscritas a cada canal y lock de escritura de cada una
+	canales   map[string][]net.Conn
+	escritura map[net.Conn]*sync.Mutex
+	// Avisa de cada SUBSCRIBE con el canal suscrito
+	suscripciones chan string
+}
+
+func iniciarRedisPrueba(t *testing.T) *servidorRedisPrueba {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &servidorRedisPrueba{listener: listener, canales: make(map[string][]net.Conn), escritura: make(map[net.Conn]*sync.Mutex), suscripciones: make(chan string, 16)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.atender(conn)
+		}
+	}()
+	return s
+}
+
+// escribir envía una respuesta cruda a una conexión
+func (s *servidorRedisPrueba) escribir(conn net.Conn, respuesta func(net.Conn)) {
+	s.mu.Lock()
+	mu := s.escritura[conn]
+	s.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	respuesta(conn)
+}
+
+func (s *servidorRedisPrueba) atender(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	s.escritura[conn] = &sync.Mutex{}
+	s.mu.Unlock()
+	lector := bufio.NewReader(conn)
+	for {
+		valor, err := leerRESP(lector)
+		if err != nil {
+			return
+		}
+		args, _ := valor.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		switch args[0] {
+		case "AUTH":
+			s.escribir(conn, func(c net.Conn) { fmt.Fprint(c, "+OK\r\n") })
+		case "SUBSCRIBE":
+			canal := args[1].(string)
+			s.mu.Lock()
+			s.canales[canal] = append(s.canales[canal], conn)
+			s.mu.Unlock()
+			s.escribir(conn, func(c net.Conn) { escribirComandoRESP(c, "subscribe", canal, "1") })
+			s.suscripciones <- canal
+		case "PUBLISH":
+			canal, datos := args[1].(string), args[2].(string)
+			s.mu.Lock()
+			suscritos := append([]net.Conn(nil), s.canales[canal]...)
+			s.mu.Unlock()
+			for _, suscrito := range suscritos {
+				s.escribir(suscrito, func(c net.Conn) { escribirComandoRESP(c, "message", canal, datos) })
+			}
+			s.escribir(conn, func(c net.Conn) { fmt.Fprintf(c, ":%d\r\n", len(suscritos)) })
+		case "PUBSUB":
+			canal := args[2].(string)
+			s.mu.Lock()
+			suscritos := len(s.canales[canal])
+			s.mu.Unlock()
+			s.escribir(conn, func(c net.Conn) { fmt.Fprintf(c, "*2\r\n$%d\r\n%s\r\n:%d\r\n", len(canal), canal, suscritos) })
+		default:
+			s.escribir(conn, func(c net.Conn) { fmt.Fprintf(c, "-ERR unknown command '%s'\r\n", args[0]) })
+		}
+	}
+}
+
+// esperarSuscritos espera a que n conexiones se suscriban al canal
+func (s *servidorRedisPrueba) esperarSuscritos(t *testing.T, canal string, n int) {
+	t.Helper()
+	for n > 0 {
+		select {
+		case suscrito := <-s.suscripciones:
+			if suscrito == canal {
+				n--
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Los nodos no llegaron a suscribirse")
+		}
+	}
+}
+
+// TestBrokerRedis prueba el adaptador RESP contra el sustituto de Redis, con dos hubs
+func TestBrokerRedis(t *testing.T) {
+	redis := iniciarRedisPrueba(t)
+	direccion := redis.listener.Addr().String()
+	brokerA := NewBrokerRedis(direccion, "sala-prueba", "secreto")
+	brokerB := NewBrokerRedis(direccion, "sala-prueba", "secreto")
+	t.Cleanup(func() { brokerA.Cerrar(); brokerB.Cerrar() })
+
+	hubA, hubB := NewHub(), NewHub()
+	hubA.SetBroker(brokerA, "a")
+	hubB.SetBroker(brokerB, "b")
+	go hubA.Run()
+	go hubB.Run()
+	// La suscripción se establece en segundo plano
+	redis.esperarSuscritos(t, "sala-prueba", 2)
+
+	luis := conectarEnMemoria(t, hubB, "luis")
+	esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoHistorial })
+	ana := conectarEnMemoria(t, hubA, "ana")
+	esperarMensaje(t, luis, esPresencia("ana", presenciaEntra))
+
+	enviarTexto(t, ana, "hola por redis")
+	if m := esperarMensaje(t, luis, contiene("hola por redis")); m.Username != "ana" {
+		t.Errorf("Mensaje remoto inesperado: %+v", m)
+	}
+}
+
+// TestLeerRESP prueba la lectura de los tipos de respuesta del protocolo
+func TestLeerRESP(t *testing.T) {
+	entrada := "+OK\r\n-ERR mal\r\n:42\r\n$5\r\nho\r\nl\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n"
+	lector := bufio.NewReader(strings.NewReader(entrada))
+	esperados := []interface{}{"OK", errorRedis("ERR mal"), int64(42), "ho\r\nl", nil}
+	for _, esperado := range esperados {
+		valor, err := leerRESP(lector)
+		if err != nil || valor != esperado {
+			t.Errorf("Se esperaba %#v, obtuvimos %#v (%v)", esperado, valor, err)
+		}
+	}
+	valor, err := leerRESP(lector)
+	if array, ok := valor.([]interface{}); err != nil || !ok || len(array) != 2 || array[0] != "a" || array[1] != int64(1) {
+		t.Errorf("Array inesperado: %#v (%v)", valor, err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Codificación CBOR (RFC 8949) del árbol de encoding/json. Se escribe siempre con
+// longitudes definidas y la cabecera más corta; al leer no se admiten longitudes
+// indefinidas ni etiquetas
+
+// Tipos mayores de CBOR
+const (
+	cborEntero byte = iota << 5
+	cborNegativo
+	cborBytes
+	cborTexto
+	cborArray
+	cborMapa
+	cborEtiqueta
+	cborSimple
+)
+
+// anexarCabeceraCBOR escribe el tipo mayor y el argumento n en la forma más corta
+func anexarCabeceraCBOR(b []byte, mayor byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, mayor|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, mayor|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, mayor|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, mayor|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, mayor|27), n)
+}
+
+// anexarCBOR añade v codificado en CBOR
+func anexarCBOR(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xf6)
+	case bool:
+		if v {
+			return append(b, 0xf5)
+		}
+		return append(b, 0xf4)
+	case json.Number:
+		entero, decimal, ok := numeroJSON(v)
+		switch {
+		case !ok:
+			return binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(decimal))
+		case entero >= 0:
+			return anexarCabeceraCBOR(b, cborEntero, uint64(entero))
+		}
+		return anexarCabeceraCBOR(b, cborNegativo, uint64(-1-entero))
+	case string:
+		return append(anexarCabeceraCBOR(b, cborTexto, uint64(len(v))), v...)
+	case []interface{}:
+		b = anexarCabeceraCBOR(b, cborArray, uint64(len(v)))
+		for _, elemento := range v {
+			b = anexarCBOR(b, elemento)
+		}
+		return b
+	case map[string]interface{}:
+		b = anexarCabeceraCBOR(b, cborMapa, uint64(len(v)))
+		for _, clave := range clavesOrdenadas(v) {
+			b = anexarCBOR(b, clave)
+			b = anexarCBOR(b, v[clave])
+		}
+		return b
+	}
+	// El árbol de encoding/json no tiene otros tipos
+	panic(fmt.Sprintf("cbor: tipo no admitido %T", v))
+}
+
+// cabeceraArrayCBOR empieza un array de n elementos
+func cabeceraArrayCBOR(n int) []byte {
+	return anexarCabeceraCBOR(nil, cborArray, uint64(n))
+}
+
+// leerCBOR decodifica un valor. Los números salen como float64 y las cadenas de bytes
+// como texto, igual que los daría json.Unmarshal
+func leerCBOR(l *lectorBinario) (interface{}, error) {
+	inicial, err := l.byte()
+	if err != nil {
+		return nil, err
+	}
+	mayor, info := inicial&0xe0, inicial&0x1f
+	if mayor == cborSimple {
+		return leerSimpleCBOR(l, info)
+	}
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		if n, err = l.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("cbor: longitudes indefinidas no admitidas")
+	}
+	switch mayor {
+	case cborEntero:
+		return float64(n), nil
+	case cborNegativo:
+		return -1 - float64(n), nil
+	case cborBytes, cborTexto:
+		b, err := l.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case cborArray:
+		return l.lista(n, leerCBOR)
+	case cborMapa:
+		return l.mapa(n, leerCBOR)
+	}
+	return nil, errors.New("cbor: etiquetas no admitidas")
+}
+
+// leerSimpleCBOR lee los valores simples y los decimales
+func leerSimpleCBOR(l *lectorBinario, info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		// null y undefined
+		return nil, nil
+	case 25:
+		v, err := l.uint(2)
+		return mediaPrecision(uint16(v)), err
+	case 26:
+		v, err := l.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 27:
+		v, err := l.uint(8)
+		return math.Float64frombits(v), err
+	}
+	return nil, fmt.Errorf("cbor: valor simple %d no admitido", info)
+}
+
+// mediaPrecision convierte un decimal IEEE 754 de 16 bits
+func mediaPrecision(h uint16) float64 {
+	exponente, mantisa := int(h>>10)&0x1f, float64(h&0x3ff)
+	var v float64
+	switch exponente {
+	case 0:
+		v = math.Ldexp(mantisa, -24)
+	case 0x1f:
+		if mantisa == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mantisa+1024, exponente-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -77,24 +75,8 @@ func TestClientRegistration(t *testing.T) {
 	// Iniciar el hub en una goroutine
 	go hub.Run()
 
-	// Crear un servidor de test
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ServeWS(hub, w, r)
-	}))
-	defer server.Close()
-
-	// Convertir la URL HTTP a WebSocket
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?username=testuser"
-
-	// Conectar al WebSocket
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-	if err != nil {
-		t.Fatalf("Error de conexión al WebSocket: %v", err)
-	}
-	defer conn.Close()
-
-	// Esperar un poco para que el cliente se registre
-	time.Sleep(100 * time.Millisecond)
+	// Conectar un cliente en memoria: vuelve cuando el hub ya lo registró
+	conectarEnMemoria(t, hub, "testuser")
 
 	// Verificar que el cliente se registró
 	if hub.GetClientCount() != 1 {
@@ -107,35 +89,14 @@ func TestMessageBroadcast(t *testing.T) {
 	hub := NewHub()
 	go hub.Run()
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ServeWS(hub, w, r)
-	}))
-	defer server.Close()
-
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
-
 	// Conectar múltiples clientes
-	var conns []*websocket.Conn
+	var conns []*sesionMemoria
 	numClients := 3
 
 	for i := 0; i < numClients; i++ {
-		conn, _, err := websocket.DefaultDialer.Dial(wsURL+fmt.Sprintf("?username=user%d", i), nil)
-		if err != nil {
-			t.Fatalf("Error de conexión del cliente %d: %v", i, err)
-		}
-		conns = append(conns, conn)
+		conns = append(conns, conectarEnMemoria(t, hub, fmt.Sprintf("user%d", i)))
 	}
 
-	// Cerrar todas las conexiones al final
-	defer func() {
-		for _, conn := range conns {
-			conn.Close()
-		}
-	}()
-
-	// Esperar a que todos los clientes se conecten
-	time.Sleep(200 * time.Millisecond)
-
 	// Verificar que todos los clientes están conectados
 	if hub.GetClientCount() != numClients {
 		t.Errorf("Se esperaban %d clientes, obtuvimos %d", numClients, hub.GetClientCount())
@@ -155,15 +116,20 @@ func TestMessageBroadcast(t *testing.T) {
 	// Verificar que todos los clientes reciben el mensaje
 	for i, conn := range conns {
 		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-		_, receivedBytes, err := conn.ReadMessage()
-		if err != nil {
-			t.Fatalf("Error al leer el mensaje del cliente %d: %v", i, err)
-		}
-
 		var receivedMessage Message
-		err = json.Unmarshal(receivedBytes, &receivedMessage)
-		if err != nil {
-			t.Fatalf("Error al deserializar el mensaje: %v", err)
+		// Los eventos de presencia (lista inicial, entradas) y el historial no son mensajes del chat
+		for receivedMessage.Type == "" || receivedMessage.Type == tipoRoster || receivedMessage.Type == tipoCredencial ||
+			receivedMessage.Type == tipoPresencia || receivedMessage.Type == tipoHistorial {
+			_, receivedBytes, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("Error al leer el mensaje del cliente %d: %v", i, err)
+			}
+
+			receivedMessage = Message{}
+			err = json.Unmarshal(receivedBytes, &receivedMessage)
+			if err != nil {
+				t.Fatalf("Error al deserializar el mensaje: %v", err)
+			}
 		}
 
 		if receivedMessage.Type == "user" && receivedMessage.MessageContent == "Hola desde el cliente 0" {
@@ -182,85 +148,66 @@ func TestConcurrentClients(t *testing.T) {
 	hub := NewHub()
 	go hub.Run()
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ServeWS(hub, w, r)
-	}))
-	defer server.Close()
-
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
-
 	// Número de clientes concurrentes
 	numClients := 10
 	numMessages := 5
 
+	conns := make([]*sesionMemoria, numClients)
+	for i := range conns {
+		conns[i] = conectarEnMemoria(t, hub, fmt.Sprintf("user%d", i))
+	}
+
 	var wg sync.WaitGroup
-	var mu sync.Mutex
-	receivedMessages := make(map[string]int)
 
-	// Función para simular un cliente
-	clientFunc := func(clientID int) {
+	// Función para simular un cliente: envía sus mensajes y lee hasta recibir el último
+	clientFunc := func(clientID int, conn *sesionMemoria) {
 		defer wg.Done()
 
-		conn, _, err := websocket.DefaultDialer.Dial(wsURL+fmt.Sprintf("?username=user%d", clientID), nil)
-		if err != nil {
-			t.Errorf("Error de conexión del cliente %d: %v", clientID, err)
-			return
-		}
-		defer conn.Close()
-
-		// Goroutine para leer mensajes
-		go func() {
-			for {
-				_, messageBytes, err := conn.ReadMessage()
-				if err != nil {
-					break
-				}
-
-				var message Message
-				if err := json.Unmarshal(messageBytes, &message); err != nil {
-					continue
-				}
-
-				mu.Lock()
-				receivedMessages[message.MessageContent]++
-				mu.Unlock()
-			}
-		}()
-
-		// Enviar múltiples mensajes
 		for i := 0; i < numMessages; i++ {
 			testMessage := map[string]interface{}{
 				"message_content": fmt.Sprintf("Mensaje %d del cliente %d", i, clientID),
 			}
 
 			messageBytes, _ := json.Marshal(testMessage)
-			err := conn.WriteMessage(websocket.TextMessage, messageBytes)
-			if err != nil {
+			if err := conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
 				t.Errorf("Error al enviar el mensaje desde el cliente %d: %v", clientID, err)
 				return
 			}
-
-			// Pequeña pausa entre mensajes
-			time.Sleep(10 * time.Millisecond)
 		}
 
-		// Mantener la conexión abierta un poco más
-		time.Sleep(500 * time.Millisecond)
+		ultimo := fmt.Sprintf("Mensaje %d del cliente %d", numMessages-1, clientID)
+		propios := 0
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			_, messageBytes, err := conn.ReadMessage()
+			if err != nil {
+				t.Errorf("El cliente %d no recibió sus mensajes: %v", clientID, err)
+				return
+			}
+			var message Message
+			if err := json.Unmarshal(messageBytes, &message); err != nil {
+				continue
+			}
+			if strings.HasSuffix(message.MessageContent, fmt.Sprintf("del cliente %d", clientID)) {
+				propios++
+			}
+			if message.MessageContent == ultimo {
+				break
+			}
+		}
+		// Los mensajes de un mismo cliente llegan todos y en orden
+		if propios != numMessages {
+			t.Errorf("El cliente %d recibió %d de sus %d mensajes", clientID, propios, numMessages)
+		}
 	}
 
 	// Lanzar todos los clientes concurrentemente
+	// (el test -race detectará automáticamente las condiciones de carrera)
 	wg.Add(numClients)
-	for i := 0; i < numClients; i++ {
-		go clientFunc(i)
+	for i, conn := range conns {
+		go clientFunc(i, conn)
 	}
-
 	wg.Wait()
-
-	// Esperar un poco más para que todos los mensajes se procesen
-	time.Sleep(1 * time.Second)
-
-	// Verificar que no hay condiciones de carrera
-	// (el test -race detectará automáticamente las condiciones de carrera)
 }
 
 // TestClientDisconnection prueba el manejo de desconexiones
@@ -268,32 +215,17 @@ func TestClientDisconnection(t *testing.T) {
 	hub := NewHub()
 	go hub.Run()
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ServeWS(hub, w, r)
-	}))
-	defer server.Close()
-
-	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?username=testuser"
-
 	// Conectar un cliente
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
-	if err != nil {
-		t.Fatalf("Error de conexión: %v", err)
-	}
-
-	// Esperar a que se registre
-	time.Sleep(100 * time.Millisecond)
+	conn := conectarEnMemoria(t, hub, "testuser")
 
 	// Verificar que el cliente está conectado
 	if hub.GetClientCount() != 1 {
 		t.Errorf("Se esperaban 1 cliente, obtuvimos %d", hub.GetClientCount())
 	}
 
-	// Cerrar la conexión
+	// Cerrar la conexión y esperar a que el hub cierre la sesión
 	conn.Close()
-
-	// Esperar a que se desregistre
-	time.Sleep(100 * time.Millisecond)
+	conn.esperarFin(t)
 
 	// Verificar que el cliente se desconectó
 	if hub.GetClientCount() != 0 {
@@ -323,30 +255,25 @@ func TestRaceConditions(t *testing.T) {
 				username: fmt.Sprintf("Usuario%d", id),
 			}
 
-			// Registrar el cliente
+			// Registrar el cliente y esperar a que el hub lo procese: register y unregister
+			// tienen buffer, así que sin esperar la baja podría llegar antes que el alta
 			hub.register <- client
-
-			// Esperar un poco
-			time.Sleep(10 * time.Millisecond)
+			<-client.send
 
 			// Enviar algunos mensajes
 			for j := 0; j < 5; j++ {
 				message := NewUserMessage(client.username, fmt.Sprintf("Mensaje %d", j))
 				hub.broadcast <- message
-				time.Sleep(1 * time.Millisecond)
 			}
 
-			// Desregistrar el cliente
+			// Desregistrar el cliente y esperar a que el hub cierre su canal
 			hub.unregister <- client
+			for range client.send {
+			}
 		}(i)
 	}
 
 	wg.Wait()
-
-	// Esperar a que se procesen todos los eventos
-	wg.Wait()
-	// Esperar más tiempo para que el hub procese los desregistros
-	time.Sleep(500 * time.Millisecond)
 	if hub.GetClientCount() != 0 {
 		t.Errorf("Se esperaban 0 clientes, obtuvimos %d", hub.GetClientCount())
 	}
@@ -369,11 +296,10 @@ func BenchmarkMessageBroadcast(b *testing.B) {
 		}
 		clients[i] = client
 		hub.register <- client
+		// La foto de conectados indica que ya está registrado
+		<-client.send
 	}
 
-	// Esperar a que se registren todos los clientes
-	time.Sleep(100 * time.Millisecond)
-
 	// Consumir mensajes de los canales send para evitar bloqueos
 	for _, client := range clients {
 		go func(c *Client) {
@@ -396,3 +322,288 @@ func BenchmarkMessageBroadcast(b *testing.B) {
 		hub.unregister <- client
 	}
 }
+
+// TestValidarNombreUsuario prueba las reglas de nombres al renombrar
+func TestValidarNombreUsuario(t *testing.T) {
+	validos := []string{"ana", "José María", "user_1", "Ñandú-2"}
+	invalidos := []string{"", "<script>", "nombre-demasiado-largo-para-el-chat", "ana@casa",
+		"ana\nluis", "ana\tluis", "Sistema", "SISTEMA"}
+
+	for _, nombre := range validos {
+		if err := validarNombreUsuario(nombre); err != nil {
+			t.Errorf("Se esperaba que %q fuera válido: %v", nombre, err)
+		}
+	}
+	for _, nombre := range invalidos {
+		if validarNombreUsuario(nombre) == nil {
+			t.Errorf("Se esperaba que %q fuera inválido", nombre)
+		}
+	}
+}
+
+// TestNormalizarNombre prueba que los espacios sobrantes no crean usuarios distintos
+func TestNormalizarNombre(t *testing.T) {
+	casos := map[string]string{
+		"ana":           "ana",
+		"  ana maría  ": "ana maría",
+		"ana    maría":  "ana maría",
+		"ana\tmaría":    "ana\tmaría",
+		"   ":           "",
+	}
+	for entrada, esperado := range casos {
+		if obtenido := normalizarNombre(entrada); obtenido != esperado {
+			t.Errorf("normalizarNombre(%q) = %q, se esperaba %q", entrada, obtenido, esperado)
+		}
+	}
+}
+
+// TestRegistroRechazaNombresNoValidos prueba que al conectarse se aplican las mismas
+// reglas que al renombrar, aunque el cliente no pase por el formulario
+func TestRegistroRechazaNombresNoValidos(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	for opciones, motivo := range map[string]string{
+		"Sistema":    "reservado",
+		"sistema":    "reservado",
+		"ana%0Aluis": "no es válido",
+		"ana%3Cb%3E": "no es válido",
+	} {
+		sesion := abrirEnMemoria(t, hub, opciones)
+		esperarMensaje(t, sesion, contiene(motivo))
+		esperarCierre(t, sesion)
+		sesion.esperarFin(t)
+	}
+
+	// Los espacios sobrantes se quitan antes de registrar
+	maria := conectarEnMemoria(t, hub, "%20ana%20%20maría%20")
+	if nombre := maria.client.nombre(); nombre != "ana maría" {
+		t.Errorf("Se esperaba \"ana maría\", obtuvimos %q", nombre)
+	}
+	enviarTexto(t, luis, "/nick  Sistema ")
+	esperarMensaje(t, luis, contiene("reservado"))
+}
+
+// TestCambioNombreSinReconectar prueba la solicitud estructurada de cambio de nombre
+func TestCambioNombreSinReconectar(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	solicitud, _ := json.Marshal(map[string]interface{}{"type": "nick", "username": "anabel"})
+	if err := ana.WriteMessage(websocket.TextMessage, solicitud); err != nil {
+		t.Fatalf("Error al enviar la solicitud: %v", err)
+	}
+
+	confirmacion := esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoNick })
+	if confirmacion.Username != "anabel" {
+		t.Errorf("Se esperaba la confirmación con anabel, obtuvimos %s", confirmacion.Username)
+	}
+	renombrado := esperarMensaje(t, luis, esPresencia("anabel", presenciaRenombrado))
+	if renombrado.PreviousUsername != "ana" {
+		t.Errorf("Se esperaba el nombre anterior ana, obtuvimos %s", renombrado.PreviousUsername)
+	}
+
+	// Los mensajes posteriores ya salen con el nuevo nombre
+	enviarTexto(t, ana, "hola de nuevo")
+	recibido := esperarMensaje(t, luis, contiene("hola de nuevo"))
+	if recibido.Username != "anabel" {
+		t.Errorf("Se esperaba el autor anabel, obtuvimos %s", recibido.Username)
+	}
+}
+
+// TestCambioNombreConcurrente prueba que dos clientes no pueden quedarse con el mismo nombre
+func TestCambioNombreConcurrente(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	numClientes := 10
+	clientes := make([]*Client, numClientes)
+	for i := range clientes {
+		clientes[i] = &Client{
+			hub:      hub,
+			send:     make(chan *Message, 256),
+			username: fmt.Sprintf("Usuario%d", i),
+		}
+		hub.register <- clientes[i]
+		// La foto de conectados indica que ya está registrado
+		<-clientes[i].send
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	exitos := 0
+	for _, client := range clientes {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			if hub.cambiarNombre(c, "elegido") == nil {
+				mu.Lock()
+				exitos++
+				mu.Unlock()
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	if exitos != 1 {
+		t.Errorf("Se esperaba exactamente 1 cambio de nombre, obtuvimos %d", exitos)
+	}
+}
+
+// TestSesionesMultiples prueba que un usuario puede conectarse desde varios dispositivos
+func TestSesionesMultiples(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	movil := conectarEnMemoria(t, hub, "ana")
+	// El segundo dispositivo demuestra con la clave del nombre que es de ana
+	clave := esperarClave(t, movil)
+	// La entrada se difunde aparte: luis llega cuando ya se ha anunciado
+	esperarMensaje(t, movil, esPresencia("ana", presenciaEntra))
+	luis := conectarEnMemoria(t, hub, "luis")
+	portatil := conectarEnMemoria(t, hub, "ana&token="+clave)
+
+	if hub.GetClientCount() != 3 {
+		t.Errorf("Se esperaban 3 sesiones, obtuvimos %d", hub.GetClientCount())
+	}
+	if usuarios := hub.GetConnectedClients(); len(usuarios) != 2 {
+		t.Errorf("Se esperaban 2 usuarios, obtuvimos %v", usuarios)
+	}
+	// Los mensajes llegan a todas las sesiones
+	enviarTexto(t, luis, "hola ana")
+	esperarMensaje(t, movil, contiene("hola ana"))
+	esperarMensaje(t, portatil, contiene("hola ana"))
+
+	// La entrada de ana se anunció una sola vez a luis (que llegó después de la primera sesión)
+	for _, m := range mensajesHasta(t, luis, "hola ana") {
+		if esPresencia("ana", presenciaEntra)(m) {
+			t.Errorf("La segunda sesión de ana no debería anunciarse: %+v", m)
+		}
+	}
+
+	// Cerrar una sesión no anuncia la salida; cerrar la última sí
+	movil.Close()
+	movil.esperarFin(t)
+	enviarTexto(t, luis, "marca")
+	for _, m := range mensajesHasta(t, luis, "marca") {
+		if esPresencia("ana", presenciaSale)(m) {
+			t.Errorf("No se esperaba anunciar la salida con una sesión abierta: %+v", m)
+		}
+	}
+	portatil.Close()
+	esperarMensaje(t, luis, esPresencia("ana", presenciaSale))
+}
+
+// TestSegundoDispositivoSinClave prueba el caso habitual: el mismo nombre desde un
+// dispositivo nuevo que no guarda ninguna clave
+func TestSegundoDispositivoSinClave(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	luis := conectarEnMemoria(t, hub, "luis")
+	portatil := conectarEnMemoria(t, hub, "ana")
+	clave := esperarClave(t, portatil)
+
+	// Con el portátil abierto, el móvil sin clave podría ser cualquiera: entra con el
+	// enlace de otro dispositivo, que lleva la clave
+	movil := abrirEnMemoria(t, hub, "ana")
+	esperarMensaje(t, movil, contiene("pertenece a otra persona"))
+	movil = conectarEnMemoria(t, hub, "ana&token="+clave)
+	enviarTexto(t, luis, "hola ana")
+	esperarMensaje(t, portatil, contiene("hola ana"))
+	esperarMensaje(t, movil, contiene("hola ana"))
+
+	// Cerradas las dos sesiones, un dispositivo nuevo sin clave vuelve a poder usar el nombre
+	portatil.Close()
+	movil.Close()
+	esperarMensaje(t, luis, esPresencia("ana", presenciaSale))
+	nuevo := conectarEnMemoria(t, hub, "ana")
+	if esperarClave(t, nuevo) == clave {
+		t.Error("El dispositivo nuevo debería recibir una clave nueva")
+	}
+	enviarTexto(t, luis, "hola otra vez")
+	esperarMensaje(t, nuevo, contiene("hola otra vez"))
+}
+
+// mensajesHasta lee mensajes hasta uno con el texto indicado y devuelve los anteriores
+func mensajesHasta(t *testing.T, conn Conexion, texto string) []*Message {
+	t.Helper()
+	var anteriores []*Message
+	esperarMensaje(t, conn, func(m *Message) bool {
+		if strings.Contains(m.MessageContent, texto) {
+			return true
+		}
+		anteriores = append(anteriores, m)
+		return false
+	})
+	return anteriores
+}
+
+// TestSesionUnicaRechazaDuplicados prueba la política heredada de una conexión por usuario
+func TestSesionUnicaRechazaDuplicados(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	if err := hub.SetPoliticaSesiones(SesionUnica); err != nil {
+		t.Fatalf("Error al fijar la política: %v", err)
+	}
+	conectarEnMemoria(t, hub, "ana")
+	duplicado := abrirEnMemoria(t, hub, "ana")
+
+	esperarMensaje(t, duplicado, contiene("ya está conectado"))
+	esperarCierre(t, duplicado)
+	duplicado.esperarFin(t)
+	if hub.GetClientCount() != 1 {
+		t.Errorf("Se esperaba 1 cliente, obtuvimos %d", hub.GetClientCount())
+	}
+}
+
+// TestTomarControlCierraSesionesAnteriores prueba el modo ?takeover=1, que solo vale
+// con la credencial del nombre
+func TestTomarControlCierraSesionesAnteriores(t *testing.T) {
+	hub := NewHub()
+	hub.SetAdmins([]string{"admin"})
+	hub.SetClaveAdmin("secreta")
+	go hub.Run()
+	anterior := conectarEnMemoria(t, hub, "admin&token=secreta")
+	conectarEnMemoria(t, hub, "admin&token=secreta&takeover=1")
+
+	esperarMensaje(t, anterior, contiene("otro dispositivo"))
+	if err := esperarCierre(t, anterior); !websocket.IsCloseError(err, cierreSesionReemplazada) {
+		t.Errorf("Se esperaba el cierre %d, obtuvimos %v", cierreSesionReemplazada, err)
+	}
+	if hub.GetClientCount() != 1 {
+		t.Errorf("Se esperaba 1 sesión, obtuvimos %d", hub.GetClientCount())
+	}
+}
+
+// TestTomarControlSinCredencial prueba que sin credencial ?takeover=1 no sirve: nadie
+// puede cerrar las sesiones de otro usuario eligiendo su nombre
+func TestTomarControlSinCredencial(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	clave := esperarClave(t, ana)
+	intruso := abrirEnMemoria(t, hub, "ana&takeover=1")
+	esperarMensaje(t, intruso, contiene("pertenece a otra persona"))
+	esperarCierre(t, intruso)
+	intruso.esperarFin(t)
+	if hub.GetClientCount() != 1 {
+		t.Errorf("Se esperaba 1 sesión, obtuvimos %d", hub.GetClientCount())
+	}
+	noRecibe(t, ana, contiene("otro dispositivo"))
+
+	// Con la clave del nombre, ?takeover=1 cierra la sesión anterior
+	conectarEnMemoria(t, hub, "ana&takeover=1&token="+clave)
+	esperarMensaje(t, ana, contiene("otro dispositivo"))
+
+	// Con una sola sesión por usuario, la segunda conexión se rechaza como siempre
+	unica := NewHub()
+	if err := unica.SetPoliticaSesiones(SesionUnica); err != nil {
+		t.Fatal(err)
+	}
+	go unica.Run()
+	conectarEnMemoria(t, unica, "ana")
+	intruso = abrirEnMemoria(t, unica, "ana&takeover=1")
+	esperarMensaje(t, intruso, contiene("ya está conectado"))
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,28 +23,123 @@ var upgrader = websocket.Upgrader{
 type Client struct {
 	// Hub de chat al que pertenece este cliente
 	hub *Hub
-	// Conexión WebSocket
-	conn *websocket.Conn
+	// Conexión con el navegador: WebSocket o uno de los transportes HTTP
+	conn Conexion
 	// Canal para enviar mensajes al cliente
 	send chan *Message
-	// Nombre de usuario del cliente
+	// Nombre de usuario del cliente. Puede cambiar con /nick, por eso se lee con nombre()
 	username string
+	// tomarControl cierra las demás sesiones del usuario al registrarse (?takeover=1 con
+	// una credencial válida)
+	tomarControl bool
+	// Codificación de los mensajes negociada en el handshake (JSON si no se pidió otra)
+	codec *codec
+	// Compresión copiada del hub al conectarse; solo la usa goroutineEscritura
+	compresion compresion
+	// agrupar envía en un solo frame, como array JSON, los mensajes que esperan en send (?batch=1)
+	agrupar bool
+	// Código y motivo del frame de cierre cuando el servidor cierra la sesión
+	codigoCierre int
+	motivoCierre string
+	// verificado indica que la sesión demostró que el nombre es suyo: presentó su clave al
+	// conectarse (?token=) o el hub se la acaba de dar. Con la clave de administración es
+	// lo que da permisos de administración
+	verificado bool
+	// mu protege username, verificado y los datos de cierre
+	mu sync.RWMutex
+	// Última actividad del usuario en esta sesión (UnixNano) y aviso de ausencia del cliente
+	ultimaActividad atomic.Int64
+	ausente         atomic.Bool
+	// Fragmento que le entrega las difusiones y última difusión anterior a su registro
+	// (protegidos por clientsMutex del hub)
+	fragmento    *fragmento
+	registradoEn uint64
+	// Política con los clientes lentos de la clase del cliente ("" para la general)
+	politicaLenta string
+	// colaMu ordena a quienes encolan en send y protege lo que LentoDisco tiene pendiente:
+	// mensajes que esperan a la goroutine de derrame, total sin entregar (en memoria y en
+	// disco), cierre y aviso a la goroutine. Se toma bajo clientsMutex, así que nunca se
+	// hace entrada/salida con él
+	colaMu         sync.Mutex
+	porDerramar    []*Message
+	derramados     int
+	derrameCerrado bool
+	avisoDerrame   chan struct{}
+	// derrameMu protege la cola en disco, que se borra al terminar la sesión. La usan la
+	// goroutine de derrame y la de escritura, nunca con clientsMutex tomado. Se toma antes
+	// que colaMu
+	derrameMu sync.Mutex
+	derrame   *colaDisco
 }
 
 // NewClient crea un nuevo cliente
-func NewClient(hub *Hub, conn *websocket.Conn, username string) *Client {
+func NewClient(hub *Hub, conn Conexion, username string) *Client {
 	return &Client{
 		hub:      hub,
 		conn:     conn,
 		send:     make(chan *Message, 256),
 		username: username,
+		codec:    codecJSON,
 	}
 }
 
+// nombre devuelve el nombre de usuario actual del cliente
+func (c *Client) nombre() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username
+}
+
+// identidad devuelve el nombre actual y si la sesión demostró que es suyo
+func (c *Client) identidad() (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username, c.verificado
+}
+
+// asignarNombre cambia el nombre de usuario. Solo lo usa el hub al renombrar; la
+// credencial era del nombre anterior, así que deja de valer
+func (c *Client) asignarNombre(nombre string) {
+	c.mu.Lock()
+	c.username = nombre
+	c.verificado = false
+	c.mu.Unlock()
+}
+
+// verificar marca la sesión como dueña de su nombre actual. Solo lo usa el hub al
+// entregarle la clave del nombre
+func (c *Client) verificar() {
+	c.mu.Lock()
+	c.verificado = true
+	c.mu.Unlock()
+}
+
+// fijarCierre indica qué código enviará goroutineEscritura al cerrar la conexión
+func (c *Client) fijarCierre(codigo int, motivo string) {
+	c.mu.Lock()
+	c.codigoCierre, c.motivoCierre = codigo, motivo
+	c.mu.Unlock()
+}
+
+// mensajeCierre devuelve el payload del frame de cierre
+func (c *Client) mensajeCierre() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.codigoCierre == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(c.codigoCierre, c.motivoCierre)
+}
+
+// responder envía un mensaje de sistema únicamente a este cliente
+func (c *Client) responder(texto string) {
+	c.hub.enviarACliente(c, NewSystemMessage(texto))
+}
+
 // goroutineLectura maneja la lectura de mensajes del cliente
 func (c *Client) goroutineLectura() {
 	defer func() {
-		log.Printf("[goroutineLectura] Cliente %s desconectado, cerrando conexión", c.username)
+		log.Printf("[goroutineLectura] Cliente %s desconectado, cerrando conexión", c.nombre())
 		// Notificar al hub que el cliente se desconectó
 		c.hub.unregister <- c
 		c.conn.Close()
@@ -49,10 +147,12 @@ func (c *Client) goroutineLectura() {
 
 	// Configurar timeouts para la conexión
 	c.conn.SetReadDeadline(time.Now().Add(90 * time.Second))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(90 * time.Second))
-		return nil
-	})
+	if conn, ok := c.conn.(conexionConPong); ok {
+		conn.SetPongHandler(func(string) error {
+			c.conn.SetReadDeadline(time.Now().Add(90 * time.Second))
+			return nil
+		})
+	}
 
 	for {
 		// Leer mensaje del cliente
@@ -63,41 +163,155 @@ func (c *Client) goroutineLectura() {
 			}
 			break
 		}
-		log.Printf("[goroutineLectura] Mensaje recibido de %s: %s", c.username, string(messageBytes))
-		// Parsear el mensaje JSON
-		var rawMessage map[string]interface{}
-		if err := json.Unmarshal(messageBytes, &rawMessage); err != nil {
+		// Parsear el mensaje en el codec negociado (JSON por defecto)
+		rawMessage, err := c.codec.decodificar(messageBytes)
+		if err != nil {
 			log.Printf("[goroutineLectura] Error al Parsear Mensaje: %v", err)
 			continue
 		}
-		// Crear el mensaje con el username del cliente
-		var message *Message
-		
-		// Verificar si es un mensaje con imagen
-		if imagenData, hasImage := rawMessage["imagen_data"].(string); hasImage && imagenData != "" {
-			imagenType := rawMessage["imagen_type"].(string)
-			content := ""
-			if contentVal, ok := rawMessage["message_content"].(string); ok {
-				content = contentVal
-			}
-			
-			// Validar tipo de imagen
-			if !validarTipoImagen(imagenType) {
-				log.Printf("[goroutineLectura] Tipo de imagen no soportado: %s", imagenType)
-				continue
+		// Los indicadores de escritura y las marcas de lectura son frecuentes: no se registran
+		if tipo, _ := rawMessage["type"].(string); tipo != tipoEscribiendo && tipo != tipoDejaEscribir && tipo != tipoLeido {
+			log.Printf("[goroutineLectura] Mensaje recibido de %s: %s", c.nombre(), string(messageBytes))
+		}
+		c.procesarEntrada(rawMessage)
+	}
+}
+
+// procesarEntrada convierte un mensaje recibido del cliente en un mensaje del chat
+// o en un comando, según su contenido
+func (c *Client) procesarEntrada(rawMessage map[string]interface{}) {
+	// Las solicitudes con "type" son operaciones sobre la sala, no mensajes
+	tipo, _ := rawMessage["type"].(string)
+	if tipo == tipoPresencia {
+		// El cliente informa de si está presente ("active") o no ("away")
+		estado, _ := rawMessage["presence"].(string)
+		c.ausente.Store(estado == presenciaAusente)
+		if estado != presenciaAusente {
+			c.registrarActividad()
+		}
+		c.hub.notificarActividad(c)
+		return
+	}
+	c.registrarActividad()
+	c.hub.notificarActividad(c)
+
+	content, _ := rawMessage["message_content"].(string)
+	switch tipo {
+	case tipoEscribiendo, tipoDejaEscribir:
+		c.hub.notificarEscritura(c, tipo)
+		return
+	case tipoLeido:
+		messageID, _ := rawMessage["message_id"].(string)
+		c.hub.marcarLeido(c, messageID)
+		return
+	case tipoEditar:
+		messageID, _ := rawMessage["message_id"].(string)
+		if err := c.hub.editarMensaje(c, messageID, content); err != nil {
+			c.responder(err.Error())
+		}
+		return
+	case tipoBorrar:
+		messageID, _ := rawMessage["message_id"].(string)
+		if err := c.hub.borrarMensaje(c, messageID); err != nil {
+			c.responder(err.Error())
+		}
+		return
+	case tipoReaccionAgregar, tipoReaccionQuitar:
+		messageID, _ := rawMessage["message_id"].(string)
+		emoji, _ := rawMessage["emoji"].(string)
+		if err := c.hub.reaccionar(c, tipo, messageID, emoji); err != nil {
+			c.responder(err.Error())
+		}
+		return
+	case tipoDirecto:
+		para, _ := rawMessage["to"].(string)
+		if err := c.hub.enviarDirecto(c, para, content); err != nil {
+			c.responder(err.Error())
+		}
+		return
+	case tipoConfirmar:
+		var ids []string
+		lista, _ := rawMessage["message_ids"].([]interface{})
+		for _, id := range lista {
+			if s, ok := id.(string); ok {
+				ids = append(ids, s)
 			}
-			
-			message = envioImagen(c.username, content, imagenData, imagenType)
-			log.Printf("[goroutineLectura] Enviando mensaje con imagen al hub: %+v", message)
-		} else {
-			// Mensaje de texto normal
-			message = NewUserMessage(c.username, rawMessage["message_content"].(string))
-			log.Printf("[goroutineLectura] Enviando mensaje al hub: %+v", message)
-		}
-		
-		// Enviar al hub para broadcast
-		c.hub.broadcast <- message
+		}
+		c.hub.confirmarRecibidos(c, ids)
+		return
+	case tipoFijar, tipoDesfijar:
+		messageID, _ := rawMessage["message_id"].(string)
+		if err := c.hub.fijarMensaje(c, tipo, messageID); err != nil {
+			c.responder(err.Error())
+		}
+		return
+	case tipoFijados:
+		c.hub.enviarFijados(c)
+		return
+	case tipoBusqueda:
+		texto, _ := rawMessage["query"].(string)
+		autor, _ := rawMessage["author"].(string)
+		sala, _ := rawMessage["room"].(string)
+		desde, _ := rawMessage["from"].(string)
+		hasta, _ := rawMessage["to"].(string)
+		limite, _ := rawMessage["limit"].(float64)
+		consulta, err := nuevaConsulta(texto, autor, sala, desde, hasta, int(limite))
+		if err != nil {
+			c.responder(err.Error())
+			return
+		}
+		c.hub.buscar(c, consulta)
+		return
+	case tipoHilo:
+		messageID, _ := rawMessage["message_id"].(string)
+		if err := c.hub.enviarHilo(c, messageID); err != nil {
+			c.responder(err.Error())
+		}
+		return
+	case tipoNick:
+		nuevo, _ := rawMessage["username"].(string)
+		if err := c.hub.cambiarNombre(c, nuevo); err != nil {
+			c.responder(err.Error())
+		}
+		return
+	}
+
+	// Crear el mensaje con el username del cliente
+	var message *Message
+
+	// Verificar si es un mensaje con imagen
+	if imagenData, hasImage := rawMessage["imagen_data"].(string); hasImage && imagenData != "" {
+		imagenType, _ := rawMessage["imagen_type"].(string)
+
+		// Validar tipo de imagen
+		if !validarTipoImagen(imagenType) {
+			log.Printf("[goroutineLectura] Tipo de imagen no soportado: %s", imagenType)
+			return
+		}
+
+		message = envioImagen(c.nombre(), content, imagenData, imagenType)
+		log.Printf("[goroutineLectura] Enviando mensaje con imagen al hub: %+v", message)
+	} else if esComando(content) {
+		// Los comandos no se difunden: responden solo a quien los invoca
+		c.hub.comandos.Despachar(c, content)
+		return
+	} else {
+		// Mensaje de texto normal ("//texto" se envía como "/texto")
+		content = strings.TrimPrefix(content, "/")
+		message = NewUserMessage(c.nombre(), content)
+		log.Printf("[goroutineLectura] Enviando mensaje al hub: %+v", message)
 	}
+
+	// Respuesta dentro de un hilo
+	if replyTo, _ := rawMessage["reply_to"].(string); replyTo != "" {
+		if err := c.hub.prepararRespuesta(message, replyTo); err != nil {
+			c.responder(err.Error())
+			return
+		}
+	}
+
+	// Enviar al hub para broadcast
+	c.hub.broadcast <- message
 }
 
 // goroutineEscritura maneja el envío de mensajes al cliente
@@ -107,6 +321,7 @@ func (c *Client) goroutineEscritura() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.cerrarDerrame()
 	}()
 
 	for {
@@ -116,16 +331,38 @@ func (c *Client) goroutineEscritura() {
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
 				// El canal send fue cerrado
-				log.Printf("[goroutineEscritura] Canal send cerrado para %s", c.username)
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				log.Printf("[goroutineEscritura] Canal send cerrado para %s", c.nombre())
+				c.conn.WriteMessage(websocket.CloseMessage, c.mensajeCierre())
 				return
 			}
-			log.Printf("[goroutineEscritura] Enviando mensaje a %s: %+v", c.username, message)
-			// Enviar el mensaje como JSON
-			if err := c.conn.WriteJSON(message); err != nil {
+			// Quien lo pidió en el handshake recibe de una vez todo lo que ya esperaba en send
+			lote, cerrado := []*Message{message}, false
+			if c.agrupar {
+				lote, cerrado = c.juntarLote(lote)
+			}
+			for _, m := range lote {
+				if !esEfimero(m) {
+					// Sin volcar el mensaje entero: con imágenes serían megas de base64 por destinatario
+					log.Printf("[goroutineEscritura] Enviando mensaje %s a %s: [%s] %s", m.Type, c.nombre(), m.Username, m.MessageContent)
+				}
+			}
+			// Enviar como JSON, ya serializado si es una difusión
+			if err := c.escribirLote(lote); err != nil {
 				log.Printf("[goroutineEscritura] Error al enviar mensaje: %v", err)
 				return
 			}
+			if cerrado {
+				log.Printf("[goroutineEscritura] Canal send cerrado para %s", c.nombre())
+				c.conn.WriteMessage(websocket.CloseMessage, c.mensajeCierre())
+				return
+			}
+			// Con el canal vacío, siguen los mensajes que no cupieron y se guardaron en disco
+			for derramado := c.siguienteDerramado(); derramado != nil; derramado = c.siguienteDerramado() {
+				if err := c.escribirMensaje(derramado); err != nil {
+					log.Printf("[goroutineEscritura] Error al enviar mensaje: %v", err)
+					return
+				}
+			}
 		case <-ticker.C:
 			// Enviar ping para mantener la conexión viva
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
@@ -137,23 +374,70 @@ func (c *Client) goroutineEscritura() {
 	}
 }
 
+// nombreSolicitado devuelve el nombre de usuario de las opciones de conexión
+func nombreSolicitado(opciones url.Values) string {
+	if username := normalizarNombre(opciones.Get("username")); username != "" {
+		return username
+	}
+	return "Anónimo"
+}
+
+// clienteDesdeSolicitud crea el cliente de una conexión nueva con las opciones que
+// valen para cualquier transporte (?token=, ?takeover=1, ?clase=). En WebSocket y HTTP
+// vienen en la URL; en TCP, en el primer frame. Todos los transportes pasan por aquí, así
+// que aquí se comprueba también que el nombre esté libre en el cluster: si no lo está,
+// devuelve el error para que el transporte se lo comunique al cliente a su manera
+func clienteDesdeSolicitud(hub *Hub, conn Conexion, username string, opciones url.Values) (*Client, error) {
+	// Con varios nodos, el nombre tiene que estar libre en todo el cluster
+	if err := hub.comprobarNombreEnCluster(username); err != nil {
+		return nil, err
+	}
+	client := NewClient(hub, conn, username)
+	client.verificado = hub.credencialValida(username, opciones.Get("token"))
+	// Cerrar las sesiones de otro es echarlo: solo se permite a quien demuestra que el
+	// nombre es suyo. Sin credencial la opción se ignora
+	client.tomarControl = client.verificado && opciones.Get("takeover") == "1"
+	client.politicaLenta = hub.politicaDeClase(opciones.Get("clase"))
+	return client, nil
+}
+
 // ServeWS maneja las conexiones WebSocket
 func ServeWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	// Obtener el username desde los parámetros de la URL
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		username = "Anónimo"
-	}
+	username := nombreSolicitado(r.URL.Query())
 
-	// Upgrade de HTTP a WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Upgrade de HTTP a WebSocket, ofreciendo permessage-deflate si el hub lo tiene activo
+	compresion := hub.configuracionCompresion()
+	actualizador := upgrader
+	actualizador.EnableCompression = compresion.activa
+	// Sin Subprotocols en el upgrader, gorilla responde con el de la cabecera
+	var cabecera http.Header
+	if subprotocolo := elegirSubprotocolo(websocket.Subprotocols(r)); subprotocolo != "" {
+		cabecera = http.Header{"Sec-Websocket-Protocol": {subprotocolo}}
+	}
+	conn, err := actualizador.Upgrade(w, r, cabecera)
 	if err != nil {
 		log.Printf("Error al actualizar la conexión: %v", err)
 		return
 	}
+	if compresion.activa {
+		conn.SetCompressionLevel(compresion.nivel)
+	}
+
+	codec := codecPorSubprotocolo(conn.Subprotocol())
 
 	// Crear el cliente
-	client := NewClient(hub, conn, username)
+	client, err := clienteDesdeSolicitud(hub, conn, username, r.URL.Query())
+	if err != nil {
+		if datos, err := codec.codificar(NewSystemMessage(err.Error())); err == nil {
+			conn.WriteMessage(codec.tipoFrame, datos)
+		}
+		conn.Close()
+		return
+	}
+	client.codec = codec
+	client.agrupar = r.URL.Query().Get("batch") == "1"
+	client.compresion = compresion
 
 	// Registrar el cliente en el hub ANTES de iniciar las goroutines
 	client.hub.register <- client
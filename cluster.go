@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Cabecera con el secreto compartido que autentica los enlaces entre nodos
+const cabeceraSecretoCluster = "X-Cluster-Secret"
+
+// Tiempos de los enlaces entre nodos
+const (
+	intervaloPingCluster    = 20 * time.Second
+	timeoutEscrituraCluster = 5 * time.Second
+	reintentoClusterMinimo  = 100 * time.Millisecond
+	reintentoClusterMaximo  = 10 * time.Second
+)
+
+// BrokerCluster une varios servidores sin infraestructura externa. Cada nodo abre un
+// enlace WebSocket hacia cada par de una lista fija (ruta /cluster) y publica por ellos;
+// lo que recibe lo hace por los enlaces que abren los demás hacia él. Todos los nodos
+// deben listar a todos los demás
+type BrokerCluster struct {
+	pares   []string
+	secreto string
+	// Abre los enlaces salientes; con SetTLS verifica los certificados de los pares wss://
+	dialer *websocket.Dialer
+	// Sobres recibidos de los pares, que una sola goroutine entrega al hub
+	entrantes chan *Sobre
+	fin       chan struct{}
+
+	mu sync.Mutex
+	// Cola de salida de cada enlace conectado y conexiones entrantes abiertas
+	enlaces  map[string]chan []byte
+	entradas map[*websocket.Conn]bool
+	cerrado  bool
+	// Si no es nil, recibe la dirección de cada par con el que se establece un enlace;
+	// sirve para esperar a que el cluster esté formado. Nunca bloquea al enlace
+	avisoEnlace chan<- string
+}
+
+// urlCluster convierte la dirección de un par (host:puerto o URL) en la URL de su /cluster
+func urlCluster(par string) (string, error) {
+	par = strings.TrimSpace(par)
+	if !strings.Contains(par, "://") {
+		par = "ws://" + par
+	}
+	u, err := url.Parse(par)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("dirección de par no válida: %q", par)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("dirección de par no válida: %q", par)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/cluster"
+	}
+	return u.String(), nil
+}
+
+// parLocal indica si la URL de un par apunta a esta misma máquina
+func parLocal(direccion string) bool {
+	u, err := url.Parse(direccion)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// NewBrokerCluster crea un broker entre pares. secreto tiene que ser el mismo en todos
+// los nodos: un enlace entrante que no lo presenta se rechaza. El secreto viaja en cada
+// enlace, así que los pares fuera de esta máquina tienen que ir por wss:// salvo que
+// enClaro lo permita expresamente
+func NewBrokerCluster(pares []string, secreto string, enClaro bool) (*BrokerCluster, error) {
+	dialer := *websocket.DefaultDialer
+	b := &BrokerCluster{
+		secreto:   secreto,
+		dialer:    &dialer,
+		entrantes: make(chan *Sobre, capacidadSobres),
+		fin:       make(chan struct{}),
+		enlaces:   make(map[string]chan []byte),
+		entradas:  make(map[*websocket.Conn]bool),
+	}
+	for _, par := range pares {
+		if strings.TrimSpace(par) == "" {
+			continue
+		}
+		direccion, err := urlCluster(par)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(direccion, "ws://") && !parLocal(direccion) {
+			if !enClaro {
+				return nil, fmt.Errorf("el par %s no usa TLS y el secreto del cluster viajaría sin cifrar: usa wss:// o https://", direccion)
+			}
+			log.Printf("Aviso: el enlace con %s no va cifrado y el secreto del cluster viaja en claro", direccion)
+		}
+		b.pares = append(b.pares, direccion)
+	}
+	return b, nil
+}
+
+// SetTLS fija la configuración con la que se verifican los pares wss://, por ejemplo
+// para confiar en una CA propia. Sin llamarla se usan las raíces del sistema
+func (b *BrokerCluster) SetTLS(config *tls.Config) {
+	b.dialer.TLSClientConfig = config
+}
+
+// Publicar envía el sobre por todos los enlaces conectados. Un par desconectado se
+// pierde lo publicado mientras tanto; al volver se pone al día con la presencia
+func (b *BrokerCluster) Publicar(sobre *Sobre) error {
+	datos, err := json.Marshal(sobre)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cerrado {
+		return errBrokerCerrado
+	}
+	for par, cola := range b.enlaces {
+		select {
+		case cola <- datos:
+		default:
+			log.Printf("Enlace con %s saturado, sobre descartado", par)
+		}
+	}
+	return nil
+}
+
+// Suscribir abre los enlaces hacia los pares y entrega a recibir lo que llega de ellos
+func (b *BrokerCluster) Suscribir(recibir func(*Sobre)) error {
+	b.mu.Lock()
+	cerrado := b.cerrado
+	b.mu.Unlock()
+	if cerrado {
+		return errBrokerCerrado
+	}
+	go func() {
+		for {
+			select {
+			case sobre := <-b.entrantes:
+				recibir(sobre)
+			case <-b.fin:
+				return
+			}
+		}
+	}()
+	for _, par := range b.pares {
+		go b.mantenerEnlace(par)
+	}
+	return nil
+}
+
+// mantenerEnlace conecta con un par y vuelve a conectar, con esperas crecientes, cada
+// vez que el enlace se cae
+func (b *BrokerCluster) mantenerEnlace(par string) {
+	cabeceras := http.Header{cabeceraSecretoCluster: {b.secreto}}
+	espera := reintentoClusterMinimo
+	for {
+		conn, _, err := b.dialer.Dial(par, cabeceras)
+		if err == nil {
+			espera = reintentoClusterMinimo
+			log.Printf("Enlace con %s establecido", par)
+			b.usarEnlace(par, conn)
+			log.Printf("Enlace con %s perdido", par)
+		}
+		select {
+		case <-b.fin:
+			return
+		case <-time.After(espera):
+		}
+		if espera *= 2; espera > reintentoClusterMaximo {
+			espera = reintentoClusterMaximo
+		}
+	}
+}
+
+// usarEnlace escribe en un enlace saliente lo que se publica hasta que falla o se cierra
+// el broker. El par no envía nada por él; solo se lee para detectar el cierre
+func (b *BrokerCluster) usarEnlace(par string, conn *websocket.Conn) {
+	defer conn.Close()
+	cola := make(chan []byte, capacidadSobres)
+	b.mu.Lock()
+	if b.cerrado {
+		b.mu.Unlock()
+		return
+	}
+	b.enlaces[par] = cola
+	aviso := b.avisoEnlace
+	b.mu.Unlock()
+	if aviso != nil {
+		select {
+		case aviso <- par:
+		default:
+		}
+	}
+	defer func() {
+		b.mu.Lock()
+		delete(b.enlaces, par)
+		b.mu.Unlock()
+	}()
+
+	caido := make(chan struct{})
+	go func() {
+		defer close(caido)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	ping := time.NewTicker(intervaloPingCluster)
+	defer ping.Stop()
+	for {
+		select {
+		case datos := <-cola:
+			conn.SetWriteDeadline(time.Now().Add(timeoutEscrituraCluster))
+			if err := conn.WriteMessage(websocket.TextMessage, datos); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeoutEscrituraCluster)); err != nil {
+				return
+			}
+		case <-caido:
+			return
+		case <-b.fin:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			return
+		}
+	}
+}
+
+// ServeCluster atiende los enlaces que abren los demás nodos en /cluster
+func (b *BrokerCluster) ServeCluster(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(cabeceraSecretoCluster)), []byte(b.secreto)) != 1 {
+		http.Error(w, "Secreto de cluster no válido", http.StatusForbidden)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error al aceptar el enlace de %s: %v", r.RemoteAddr, err)
+		return
+	}
+	b.mu.Lock()
+	if b.cerrado {
+		b.mu.Unlock()
+		conn.Close()
+		return
+	}
+	b.entradas[conn] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.entradas, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+
+	// El par hace ping periódicamente: si deja de hacerlo, el enlace está muerto
+	conn.SetReadDeadline(time.Now().Add(3 * intervaloPingCluster))
+	conn.SetPingHandler(func(datos string) error {
+		conn.SetReadDeadline(time.Now().Add(3 * intervaloPingCluster))
+		return conn.WriteControl(websocket.PongMessage, []byte(datos), time.Now().Add(timeoutEscrituraCluster))
+	})
+	for {
+		_, datos, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(3 * intervaloPingCluster))
+		var sobre Sobre
+		if err := json.Unmarshal(datos, &sobre); err != nil {
+			log.Printf("Sobre no válido de %s: %v", r.RemoteAddr, err)
+			continue
+		}
+		select {
+		case b.entrantes <- &sobre:
+		case <-b.fin:
+			return
+		}
+	}
+}
+
+// enlacesActivos devuelve cuántos pares tienen el enlace saliente conectado
+func (b *BrokerCluster) enlacesActivos() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.enlaces)
+}
+
+// NodosConectados devuelve cuántos pares reciben ahora lo que se publica
+func (b *BrokerCluster) NodosConectados() (int, error) {
+	return b.enlacesActivos(), nil
+}
+
+// Cerrar corta todos los enlaces y deja de reconectar
+func (b *BrokerCluster) Cerrar() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cerrado {
+		return nil
+	}
+	b.cerrado = true
+	close(b.fin)
+	for conn := range b.entradas {
+		conn.Close()
+	}
+	return nil
+}
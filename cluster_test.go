@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// iniciarClusterPrueba arranca n nodos enlazados entre sí y devuelve sus hubs. Los
+// enlaces van por HTTP, como en producción; los usuarios se conectan en memoria
+func iniciarClusterPrueba(t *testing.T, n int, politica string) []*Hub {
+	t.Helper()
+	hubs := make([]*Hub, n)
+	brokers := make([]*BrokerCluster, n)
+	servidores := make([]*httptest.Server, n)
+	for i := range servidores {
+		i := i
+		servidores[i] = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			brokers[i].ServeCluster(w, r)
+		}))
+	}
+	enlazados := make(chan string, n*n)
+	for i := range hubs {
+		var pares []string
+		for j, servidor := range servidores {
+			if j != i {
+				pares = append(pares, servidor.Listener.Addr().String())
+			}
+		}
+		broker, err := NewBrokerCluster(pares, "secreto", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		broker.avisoEnlace = enlazados
+		brokers[i] = broker
+		hubs[i] = NewHub()
+		hubs[i].SetPoliticaSesiones(politica)
+		hubs[i].SetBroker(broker, string(rune('a'+i)))
+	}
+	for i, servidor := range servidores {
+		servidor.Start()
+		t.Cleanup(servidor.Close)
+		t.Cleanup(func() { brokers[i].Cerrar() })
+		go hubs[i].Run()
+	}
+	// Esperar a que todos los enlaces estén conectados
+	for enlaces := 0; enlaces < n*(n-1); enlaces++ {
+		select {
+		case <-enlazados:
+		case <-time.After(3 * time.Second):
+			t.Fatal("Los enlaces del cluster no llegaron a conectarse")
+		}
+	}
+	for i, broker := range brokers {
+		if activos := broker.enlacesActivos(); activos != n-1 {
+			t.Fatalf("El nodo %d tiene %d enlaces, se esperaban %d", i, activos, n-1)
+		}
+	}
+	return hubs
+}
+
+// TestClusterReparteMensajesYPresencia prueba un cluster de tres nodos sin broker externo
+func TestClusterReparteMensajesYPresencia(t *testing.T) {
+	hubs := iniciarClusterPrueba(t, 3, SesionesMultiples)
+	ana := conectarEnMemoria(t, hubs[0], "ana")
+	luis := conectarEnMemoria(t, hubs[1], "luis")
+	eva := conectarEnMemoria(t, hubs[2], "eva")
+	// La presencia de cada nodo llega por su enlace: luis y eva pueden verse en cualquier orden
+	vistos := map[string]bool{}
+	esperarMensaje(t, ana, func(m *Message) bool {
+		if m.Type == tipoPresencia && m.Presence == presenciaEntra {
+			vistos[m.Username] = true
+		}
+		return vistos["luis"] && vistos["eva"]
+	})
+	esperarMensaje(t, luis, esPresencia("eva", presenciaEntra))
+
+	enviarTexto(t, ana, "hola a todo el cluster")
+	for _, sesion := range []*sesionMemoria{luis, eva} {
+		if m := esperarMensaje(t, sesion, contiene("hola a todo el cluster")); m.Username != "ana" {
+			t.Errorf("Mensaje inesperado: %+v", m)
+		}
+	}
+
+	enviarTexto(t, eva, "/who")
+	if quien := esperarMensaje(t, eva, contiene("Conectados")); quien.MessageContent != "Conectados (3): ana, eva, luis" {
+		t.Errorf("/who debería listar a todo el cluster: %q", quien.MessageContent)
+	}
+}
+
+// TestClusterNombreUnico prueba que un nombre en uso en un nodo se rechaza en los demás,
+// con las dos políticas de sesiones
+func TestClusterNombreUnico(t *testing.T) {
+	for _, politica := range []string{SesionUnica, SesionesMultiples} {
+		t.Run(politica, func(t *testing.T) {
+			hubs := iniciarClusterPrueba(t, 2, politica)
+			luis := conectarEnMemoria(t, hubs[1], "luis")
+			conectarEnMemoria(t, hubs[0], "ana")
+			esperarMensaje(t, luis, esPresencia("ana", presenciaEntra))
+
+			otraAna := abrirEnMemoria(t, hubs[1], "ana")
+			esperarMensaje(t, otraAna, contiene("ya está conectado"))
+
+			enviarTexto(t, luis, "/nick ana")
+			esperarMensaje(t, luis, contiene("otra persona"))
+			if n := len(hubs[1].GetConnectedClients()); n != 1 {
+				t.Errorf("El segundo nodo solo debería tener a luis, tiene %d usuarios", n)
+			}
+		})
+	}
+}
+
+// TestReservaNombreSimultanea prueba que si dos nodos piden el mismo nombre a la vez solo uno lo consigue
+func TestReservaNombreSimultanea(t *testing.T) {
+	broker := NewBrokerMemoria()
+	t.Cleanup(func() { broker.Cerrar() })
+	hubA, hubB := iniciarNodosPrueba(t, broker)
+	// Cada nodo espera respuesta de los que conoce por su presencia. luis ve entrar a
+	// ana cuando B conoce a A; ana recibe el mensaje de luis después de la presencia de
+	// B, que se publica antes
+	luis := conectarEnMemoria(t, hubB, "luis")
+	ana := conectarEnMemoria(t, hubA, "ana")
+	esperarMensaje(t, luis, esPresencia("ana", presenciaEntra))
+	enviarTexto(t, luis, "hola")
+	esperarMensaje(t, ana, contiene("hola"))
+
+	for _, nombre := range []string{"eva", "marta", "pablo"} {
+		var wg sync.WaitGroup
+		errores := make([]error, 2)
+		for i, hub := range []*Hub{hubA, hubB} {
+			wg.Add(1)
+			go func(i int, hub *Hub) {
+				defer wg.Done()
+				errores[i] = hub.reservarNombre(nombre)
+			}(i, hub)
+		}
+		wg.Wait()
+		if (errores[0] == nil) == (errores[1] == nil) {
+			t.Errorf("Solo un nodo debería conseguir %s: %v", nombre, errores)
+		}
+	}
+}
+
+// TestRenombreRechazadoSueltaReserva prueba que un /nick que el nodo rechaza después de
+// reservar el nombre no lo deja apartado en los demás hasta que caduque
+func TestRenombreRechazadoSueltaReserva(t *testing.T) {
+	broker := NewBrokerMemoria()
+	t.Cleanup(func() { broker.Cerrar() })
+	hubA, hubB := iniciarNodosPrueba(t, broker)
+	hubA.SetAdmins([]string{"jefe"})
+	luis := conectarEnMemoria(t, hubA, "luis")
+	eva := conectarEnMemoria(t, hubB, "eva")
+	esperarMensaje(t, luis, esPresencia("eva", presenciaEntra))
+
+	enviarTexto(t, luis, "/nick jefe")
+	esperarMensaje(t, luis, contiene("reservado"))
+	// La liberación se publica antes que el mensaje: cuando eva lo recibe, B ya la procesó
+	enviarTexto(t, luis, "sigo siendo luis")
+	esperarMensaje(t, eva, contiene("sigo siendo luis"))
+	hubB.clientsMutex.RLock()
+	_, apartado := hubB.reservasRemotas["jefe"]
+	hubB.clientsMutex.RUnlock()
+	if apartado {
+		t.Error("El otro nodo sigue con el nombre reservado")
+	}
+}
+
+// TestURLCluster prueba cómo se interpretan las direcciones de los pares
+func TestURLCluster(t *testing.T) {
+	casos := map[string]string{
+		"nodo2:8080":               "ws://nodo2:8080/cluster",
+		"https://chat.example.com": "wss://chat.example.com/cluster",
+		"ws://10.0.0.3:8080/otro":  "ws://10.0.0.3:8080/otro",
+	}
+	for entrada, esperada := range casos {
+		if obtenida, err := urlCluster(entrada); err != nil || obtenida != esperada {
+			t.Errorf("urlCluster(%q) = %q, %v; se esperaba %q", entrada, obtenida, err, esperada)
+		}
+	}
+	if _, err := urlCluster("ftp://nodo"); err == nil {
+		t.Error("Se esperaba un error con un esquema no soportado")
+	}
+}
+
+// TestClusterExigeTLSFueraDeLocal prueba que el secreto no sale de la máquina sin cifrar
+func TestClusterExigeTLSFueraDeLocal(t *testing.T) {
+	casos := map[string]bool{
+		"nodo2:8080":               false,
+		"ws://10.0.0.3:8080":       false,
+		"localhost:8080":           true,
+		"127.0.0.1:8080":           true,
+		"[::1]:8080":               true,
+		"https://chat.example.com": true,
+		"wss://10.0.0.3:8443":      true,
+	}
+	for par, aceptado := range casos {
+		if _, err := NewBrokerCluster([]string{par}, "secreto", false); (err == nil) != aceptado {
+			t.Errorf("%s: aceptado %v, error %v", par, aceptado, err)
+		}
+		if _, err := NewBrokerCluster([]string{par}, "secreto", true); err != nil {
+			t.Errorf("%s con -pares-en-claro: %v", par, err)
+		}
+	}
+}
+
+// TestClusterEnlaceTLS prueba un enlace wss:// con un certificado de una CA propia
+func TestClusterEnlaceTLS(t *testing.T) {
+	destino, err := NewBrokerCluster(nil, "secreto", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servidor := httptest.NewTLSServer(http.HandlerFunc(destino.ServeCluster))
+	t.Cleanup(servidor.Close)
+	t.Cleanup(func() { destino.Cerrar() })
+
+	origen, err := NewBrokerCluster([]string{servidor.URL}, "secreto", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { origen.Cerrar() })
+	enlazados := make(chan string, 1)
+	origen.avisoEnlace = enlazados
+	raices := x509.NewCertPool()
+	raices.AddCert(servidor.Certificate())
+	origen.SetTLS(&tls.Config{RootCAs: raices})
+	if err := origen.Suscribir(func(*Sobre) {}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case par := <-enlazados:
+		if !strings.HasPrefix(par, "wss://") {
+			t.Errorf("El enlace debería ir por wss://: %s", par)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("El enlace TLS no llegó a conectarse")
+	}
+}
+
+// TestConexionRechazadaSueltaReserva prueba que una conexión que el nodo rechaza después
+// de reservar el nombre en el cluster no lo deja apartado en los demás hasta que caduque
+func TestConexionRechazadaSueltaReserva(t *testing.T) {
+	broker := NewBrokerMemoria()
+	t.Cleanup(func() { broker.Cerrar() })
+	hubA, hubB := iniciarNodosPrueba(t, broker)
+	hubA.SetAdmins([]string{"jefe"})
+	luis := conectarEnMemoria(t, hubA, "luis")
+	eva := conectarEnMemoria(t, hubB, "eva")
+	esperarMensaje(t, luis, esPresencia("eva", presenciaEntra))
+
+	jefe := abrirEnMemoria(t, hubA, "jefe")
+	esperarMensaje(t, jefe, contiene("reservado"))
+	// La liberación se publica antes que el mensaje: cuando eva lo recibe, B ya la procesó
+	enviarTexto(t, luis, "marca")
+	esperarMensaje(t, eva, contiene("marca"))
+	hubB.clientsMutex.RLock()
+	_, apartado := hubB.reservasRemotas["jefe"]
+	hubB.clientsMutex.RUnlock()
+	if apartado {
+		t.Error("El otro nodo sigue con el nombre reservado")
+	}
+}
+
+// brokerSinPresencia es un broker en memoria que no entrega la presencia de los demás
+// nodos y avisa al suscribirse: simula un nodo recién arrancado que aún no ha oído a nadie
+type brokerSinPresencia struct {
+	*BrokerMemoria
+	suscrito chan struct{}
+}
+
+func (b *brokerSinPresencia) Suscribir(recibir func(*Sobre)) error {
+	err := b.BrokerMemoria.Suscribir(func(sobre *Sobre) {
+		if sobre.Tipo != sobrePresencia {
+			recibir(sobre)
+		}
+	})
+	close(b.suscrito)
+	return err
+}
+
+// TestReservaEsperaANodosSinPresencia prueba que un nodo que aún no conoce la presencia
+// de los demás les pregunta igualmente por el nombre
+func TestReservaEsperaANodosSinPresencia(t *testing.T) {
+	memoria := NewBrokerMemoria()
+	t.Cleanup(func() { memoria.Cerrar() })
+	hubB := NewHub()
+	hubB.SetBroker(memoria, "b")
+	go hubB.Run()
+	conectarEnMemoria(t, hubB, "ana")
+
+	nuevo := &brokerSinPresencia{BrokerMemoria: memoria, suscrito: make(chan struct{})}
+	hubA := NewHub()
+	hubA.SetBroker(nuevo, "a")
+	go hubA.Run()
+	<-nuevo.suscrito
+	otraAna := abrirEnMemoria(t, hubA, "ana")
+	esperarMensaje(t, otraAna, contiene("ya está conectado"))
+}
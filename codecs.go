@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocolos WebSocket con los que el cliente elige la codificación de los mensajes.
+// Sin subprotocolo se usa JSON, como siempre
+const (
+	subprotocoloJSON    = "json"
+	subprotocoloMsgpack = "msgpack"
+	subprotocoloCBOR    = "cbor"
+)
+
+// Anidamiento máximo que se acepta al decodificar un mensaje binario de un cliente
+const profundidadMaximaCodec = 32
+
+var errDatosCortados = errors.New("mensaje binario incompleto")
+
+// codec es una forma de codificar los mensajes en el cable. Los binarios trabajan sobre el
+// mismo árbol que encoding/json (mapas con los nombres de los campos JSON, listas,
+// textos, números y booleanos), así que admiten exactamente lo mismo que JSON
+type codec struct {
+	subprotocolo string
+	// Tipo de frame WebSocket (texto o binario)
+	tipoFrame int
+	// anexar añade un valor del árbol codificado; leer decodifica uno
+	anexar func(b []byte, v interface{}) []byte
+	leer   func(l *lectorBinario) (interface{}, error)
+	// cabeceraArray empieza un array de n elementos, para enviar lotes
+	cabeceraArray func(n int) []byte
+}
+
+var (
+	codecJSON    = &codec{subprotocolo: subprotocoloJSON, tipoFrame: websocket.TextMessage}
+	codecMsgpack = &codec{subprotocolo: subprotocoloMsgpack, tipoFrame: websocket.BinaryMessage, anexar: anexarMsgpack, leer: leerMsgpack, cabeceraArray: cabeceraArrayMsgpack}
+	codecCBOR    = &codec{subprotocolo: subprotocoloCBOR, tipoFrame: websocket.BinaryMessage, anexar: anexarCBOR, leer: leerCBOR, cabeceraArray: cabeceraArrayCBOR}
+)
+
+// subprotocolos son los que acepta el servidor, en orden de preferencia
+var subprotocolos = []string{subprotocoloMsgpack, subprotocoloCBOR, subprotocoloJSON}
+
+// elegirSubprotocolo devuelve el preferido por el servidor de entre los que ofrece el
+// cliente, o "" si no ofrece ninguno conocido. Lo elige ServeWS y no el upgrader para que
+// la preferencia no dependa del orden en que los lista el cliente
+func elegirSubprotocolo(ofrecidos []string) string {
+	for _, preferido := range subprotocolos {
+		for _, ofrecido := range ofrecidos {
+			if ofrecido == preferido {
+				return preferido
+			}
+		}
+	}
+	return ""
+}
+
+// codecPorSubprotocolo devuelve el codec negociado en el handshake ("" es JSON)
+func codecPorSubprotocolo(subprotocolo string) *codec {
+	switch subprotocolo {
+	case subprotocoloMsgpack:
+		return codecMsgpack
+	case subprotocoloCBOR:
+		return codecCBOR
+	}
+	return codecJSON
+}
+
+// codificar serializa un mensaje
+func (c *codec) codificar(message *Message) ([]byte, error) {
+	datos, err := json.Marshal(message)
+	if err != nil || c == codecJSON {
+		return datos, err
+	}
+	arbol, err := arbolJSON(datos)
+	if err != nil {
+		return nil, err
+	}
+	return c.anexar(nil, arbol), nil
+}
+
+// decodificar convierte lo que envía un cliente en el mismo mapa que daría json.Unmarshal
+func (c *codec) decodificar(datos []byte) (map[string]interface{}, error) {
+	var valor interface{}
+	if c == codecJSON {
+		if err := json.Unmarshal(datos, &valor); err != nil {
+			return nil, err
+		}
+	} else {
+		l := &lectorBinario{datos: datos}
+		var err error
+		if valor, err = c.leer(l); err != nil {
+			return nil, err
+		}
+		if l.pos != len(datos) {
+			return nil, fmt.Errorf("sobran %d bytes tras el mensaje", len(datos)-l.pos)
+		}
+	}
+	mapa, ok := valor.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("el mensaje no es un objeto")
+	}
+	return mapa, nil
+}
+
+// arbolJSON pasa el JSON de un mensaje al árbol genérico de encoding/json, con los
+// mismos campos y omisiones. Los números enteros se conservan como enteros
+func arbolJSON(datos []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(datos))
+	decoder.UseNumber()
+	var arbol interface{}
+	err := decoder.Decode(&arbol)
+	return arbol, err
+}
+
+// numeroJSON devuelve un json.Number como entero si lo es y si no como decimal
+func numeroJSON(n json.Number) (int64, float64, bool) {
+	if entero, err := n.Int64(); err == nil {
+		return entero, 0, true
+	}
+	decimal, _ := n.Float64()
+	return 0, decimal, false
+}
+
+// clavesOrdenadas devuelve las claves de un mapa en orden, para que la misma entrada
+// produzca siempre los mismos bytes
+func clavesOrdenadas(mapa map[string]interface{}) []string {
+	claves := make([]string, 0, len(mapa))
+	for clave := range mapa {
+		claves = append(claves, clave)
+	}
+	sort.Strings(claves)
+	return claves
+}
+
+// lectorBinario recorre un mensaje binario de un cliente
+type lectorBinario struct {
+	datos       []byte
+	pos         int
+	profundidad int
+}
+
+// byte lee un byte
+func (l *lectorBinario) byte() (byte, error) {
+	if l.pos >= len(l.datos) {
+		return 0, errDatosCortados
+	}
+	b := l.datos[l.pos]
+	l.pos++
+	return b, nil
+}
+
+// bytes lee n bytes
+func (l *lectorBinario) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(l.datos)-l.pos) {
+		return nil, errDatosCortados
+	}
+	b := l.datos[l.pos : l.pos+int(n)]
+	l.pos += int(n)
+	return b, nil
+}
+
+// uint lee un entero sin signo big-endian de n bytes
+func (l *lectorBinario) uint(n int) (uint64, error) {
+	b, err := l.bytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return v, nil
+}
+
+// entrar controla el anidamiento y que una lista de n elementos quepa en lo que queda
+// (cada elemento ocupa al menos un byte), para no reservar memoria por una longitud falsa
+func (l *lectorBinario) entrar(n uint64) error {
+	if l.profundidad++; l.profundidad > profundidadMaximaCodec {
+		return errors.New("mensaje binario demasiado anidado")
+	}
+	if n > uint64(len(l.datos)-l.pos) {
+		return errDatosCortados
+	}
+	return nil
+}
+
+// lista lee n valores con leer
+func (l *lectorBinario) lista(n uint64, leer func(*lectorBinario) (interface{}, error)) (interface{}, error) {
+	if err := l.entrar(n); err != nil {
+		return nil, err
+	}
+	lista := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		v, err := leer(l)
+		if err != nil {
+			return nil, err
+		}
+		lista = append(lista, v)
+	}
+	l.profundidad--
+	return lista, nil
+}
+
+// mapa lee n pares clave-valor con leer. Las claves tienen que ser textos, como en JSON
+func (l *lectorBinario) mapa(n uint64, leer func(*lectorBinario) (interface{}, error)) (interface{}, error) {
+	if err := l.entrar(n); err != nil {
+		return nil, err
+	}
+	mapa := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := leer(l)
+		if err != nil {
+			return nil, err
+		}
+		clave, ok := k.(string)
+		if !ok {
+			return nil, errors.New("clave de mapa que no es texto")
+		}
+		if mapa[clave], err = leer(l); err != nil {
+			return nil, err
+		}
+	}
+	l.profundidad--
+	return mapa, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestCodecsVectoresConocidos compara con codificaciones de referencia de cada formato
+func TestCodecsVectoresConocidos(t *testing.T) {
+	arbol := map[string]interface{}{"a": json.Number("1"), "b": []interface{}{true, nil, "x"}, "c": json.Number("-300"), "d": json.Number("1.5")}
+	casos := []struct {
+		codec    *codec
+		esperado []byte
+	}{
+		{codecMsgpack, []byte{0x84, 0xa1, 'a', 0x01, 0xa1, 'b', 0x93, 0xc3, 0xc0, 0xa1, 'x', 0xa1, 'c', 0xd1, 0xfe, 0xd4, 0xa1, 'd', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{codecCBOR, []byte{0xa4, 0x61, 'a', 0x01, 0x61, 'b', 0x83, 0xf5, 0xf6, 0x61, 'x', 0x61, 'c', 0x39, 0x01, 0x2b, 0x61, 'd', 0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, caso := range casos {
+		if datos := caso.codec.anexar(nil, arbol); !bytes.Equal(datos, caso.esperado) {
+			t.Errorf("%s: % x, se esperaba % x", caso.codec.subprotocolo, datos, caso.esperado)
+		}
+		decodificado, err := caso.codec.decodificar(caso.esperado)
+		if err != nil {
+			t.Fatalf("%s: %v", caso.codec.subprotocolo, err)
+		}
+		esperado := map[string]interface{}{"a": 1.0, "b": []interface{}{true, nil, "x"}, "c": -300.0, "d": 1.5}
+		if !reflect.DeepEqual(decodificado, esperado) {
+			t.Errorf("%s: decodificado %v", caso.codec.subprotocolo, decodificado)
+		}
+	}
+}
+
+// TestCodecsEquivalenAJSON prueba que un mensaje completo decodificado de cada formato
+// queda igual que decodificado de JSON, que es lo que espera procesarEntrada
+func TestCodecsEquivalenAJSON(t *testing.T) {
+	editado := time.Now()
+	message := NewUserMessage("ana", "hola @luis, ¿qué tal? "+string(bytes.Repeat([]byte("x"), 300)))
+	message.Mentions = []string{"luis"}
+	message.Reactions = map[string][]string{"👍": {"luis", "eva"}}
+	message.EditedAt = &editado
+	message.Unread = 70000
+	message.Messages = []*Message{NewSystemMessage("dentro"), envioImagen("eva", "foto", "aW1n", "image/png")}
+
+	datosJSON, _ := json.Marshal(message)
+	esperado, err := codecJSON.decodificar(datosJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*codec{codecMsgpack, codecCBOR} {
+		datos, err := c.codificar(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(datos) >= len(datosJSON) {
+			t.Errorf("%s ocupa %d bytes y JSON %d", c.subprotocolo, len(datos), len(datosJSON))
+		}
+		decodificado, err := c.decodificar(datos)
+		if err != nil {
+			t.Fatalf("%s: %v", c.subprotocolo, err)
+		}
+		if !reflect.DeepEqual(decodificado, esperado) {
+			t.Errorf("%s:\n%v\nse esperaba\n%v", c.subprotocolo, decodificado, esperado)
+		}
+	}
+}
+
+// TestCodecsRechazanDatosMalformados prueba que lo que envía un cliente malicioso o
+// defectuoso da error sin reservar memoria de más ni entrar en pánico
+func TestCodecsRechazanDatosMalformados(t *testing.T) {
+	profundo := bytes.Repeat([]byte{0x91}, 100)
+	casos := []struct {
+		codec *codec
+		datos []byte
+	}{
+		{codecMsgpack, []byte{0x82, 0xa1, 'a'}},                                   // cortado
+		{codecMsgpack, []byte{0xdf, 0xff, 0xff, 0xff, 0xff}},                      // mapa con longitud falsa
+		{codecMsgpack, append(profundo, 0xc0)},                                    // demasiado anidado
+		{codecMsgpack, []byte{0x81, 0x01, 0x01}},                                  // clave que no es texto
+		{codecMsgpack, []byte{0x93, 0x01, 0x02, 0x03}},                            // no es un objeto
+		{codecMsgpack, []byte{0x80, 0x80}},                                        // sobran bytes
+		{codecCBOR, []byte{0xbf, 0x61, 'a', 0x01, 0xff}},                          // longitud indefinida
+		{codecCBOR, []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}}, // longitud falsa
+		{codecCBOR, []byte{0xc1, 0x01}},                                           // etiqueta
+	}
+	for i, caso := range casos {
+		if _, err := caso.codec.decodificar(caso.datos); err == nil {
+			t.Errorf("Caso %d (%s): debería dar error", i, caso.codec.subprotocolo)
+		}
+	}
+	// CBOR de media precisión: {"limit": 1.0}
+	if v, err := codecCBOR.decodificar([]byte{0xa1, 0x65, 'l', 'i', 'm', 'i', 't', 0xf9, 0x3c, 0x00}); err != nil || v["limit"] != 1.0 {
+		t.Errorf("Media precisión: %v (%v)", v, err)
+	}
+}
+
+// conectarConCodec abre una sesión pidiendo un subprotocolo
+func conectarConCodec(t *testing.T, wsURL, usuario, subprotocolo string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocolo}}
+	conn, _, err := dialer.Dial(wsURL+"?username="+usuario, nil)
+	if err != nil {
+		t.Fatalf("Error de conexión de %s: %v", usuario, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if conn.Subprotocol() != subprotocolo {
+		t.Fatalf("Se negoció %q en lugar de %q", conn.Subprotocol(), subprotocolo)
+	}
+	return conn
+}
+
+// esperarEnCodec lee frames binarios hasta encontrar un mensaje con el texto indicado
+func esperarEnCodec(t *testing.T, conn *websocket.Conn, c *codec, texto string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		tipo, datos, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("No llegó %q: %v", texto, err)
+		}
+		if tipo != websocket.BinaryMessage {
+			t.Fatalf("Se esperaban frames binarios en %s", c.subprotocolo)
+		}
+		message, err := c.decodificar(datos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message["message_content"] == texto {
+			return
+		}
+	}
+}
+
+// TestSubprotocolosBinarios prueba que clientes con distinto codec conversan en la
+// misma sala: cada uno envía y recibe en el suyo
+func TestSubprotocolosBinarios(t *testing.T) {
+	// Los bots negocian el subprotocolo con ServeWS; luis se conecta en memoria con JSON
+	hub := NewHub()
+	wsURL := servirHubPrueba(t, hub)
+	luis := conectarEnMemoria(t, hub, "luis")
+	for _, c := range []*codec{codecMsgpack, codecCBOR} {
+		usuario := "bot_" + c.subprotocolo
+		bot := conectarConCodec(t, wsURL, usuario, c.subprotocolo)
+		datos := c.anexar(nil, map[string]interface{}{"message_content": "hola desde " + c.subprotocolo})
+		if err := bot.WriteMessage(websocket.BinaryMessage, datos); err != nil {
+			t.Fatal(err)
+		}
+		esperarEnCodec(t, bot, c, "hola desde "+c.subprotocolo)
+		esperarMensaje(t, luis, contiene("hola desde "+c.subprotocolo))
+
+		enviarTexto(t, luis, "respuesta a "+usuario)
+		esperarEnCodec(t, bot, c, "respuesta a "+usuario)
+	}
+}
+
+// TestPreferenciaSubprotocolo prueba que manda la preferencia del servidor, no el orden
+// en que el cliente ofrece los subprotocolos
+func TestPreferenciaSubprotocolo(t *testing.T) {
+	wsURL := servirHubPrueba(t, NewHub())
+	dialer := websocket.Dialer{Subprotocols: []string{"desconocido", subprotocoloJSON, subprotocoloCBOR, subprotocoloMsgpack}}
+	conn, _, err := dialer.Dial(wsURL+"?username=ana", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != subprotocoloMsgpack {
+		t.Errorf("Se negoció %q en lugar de %q", conn.Subprotocol(), subprotocoloMsgpack)
+	}
+	if elegirSubprotocolo([]string{"desconocido"}) != "" {
+		t.Error("Sin subprotocolos conocidos no se debería elegir ninguno")
+	}
+}
+
+// TestLoteBinario prueba que un lote en un codec binario es un array de ese codec
+func TestLoteBinario(t *testing.T) {
+	servidor, navegador := parConexionesPrueba(t)
+	client := NewClient(NewHub(), servidor, "ana")
+	client.codec = codecCBOR
+	difundido := NewUserMessage("luis", "dos")
+	difundido.preparar()
+	escrito := make(chan error, 1)
+	go func() { escrito <- client.escribirLote([]*Message{NewSystemMessage("uno"), difundido}) }()
+	tipo, datos, err := navegador.ReadMessage()
+	if err != nil || tipo != websocket.BinaryMessage {
+		t.Fatalf("Se esperaba un frame binario: %v", err)
+	}
+	if err := <-escrito; err != nil {
+		t.Fatal(err)
+	}
+	lote, err := leerCBOR(&lectorBinario{datos: datos})
+	lista, _ := lote.([]interface{})
+	if err != nil || len(lista) != 2 || lista[1].(map[string]interface{})["message_content"] != "dos" {
+		t.Errorf("Lote inesperado: %v (%v)", lote, err)
+	}
+}
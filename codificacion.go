@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// mensajeCodificado guarda un mensaje ya serializado para enviarlo a muchos clientes sin
+// volver a codificarlo. El PreparedMessage además reutiliza el frame (y su versión
+// comprimida) entre todas las conexiones con la misma configuración
+type mensajeCodificado struct {
+	datos     []byte
+	preparado *websocket.PreparedMessage
+	// Versiones en los codecs binarios, que se crean la primera vez que un destinatario
+	// las necesita a partir del árbol de datos, que se lee una sola vez para todos
+	// (protegidos por mu: los piden varias goroutines de escritura a la vez)
+	mu    sync.Mutex
+	arbol interface{}
+	otros map[*codec]*mensajeCodificado
+}
+
+// preparar serializa el mensaje una sola vez antes de difundirlo. Debe llamarse antes de
+// que el mensaje llegue a ningún canal send: a partir de ahí no se puede modificar
+func (m *Message) preparar() {
+	if m == nil || m.codificado != nil {
+		return
+	}
+	datos, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("Error serializando mensaje de %s: %v", m.Username, err)
+		return
+	}
+	preparado, err := websocket.NewPreparedMessage(websocket.TextMessage, datos)
+	if err != nil {
+		log.Printf("Error preparando mensaje de %s: %v", m.Username, err)
+		return
+	}
+	m.codificado = &mensajeCodificado{datos: datos, preparado: preparado}
+}
+
+// codificadoPara devuelve la serialización del mensaje preparado en el codec indicado,
+// creándola una sola vez para todos los clientes que lo usan. Sale del JSON ya
+// serializado, sin volver a pasar por el mensaje
+func (m *Message) codificadoPara(c *codec) (*mensajeCodificado, error) {
+	if c == codecJSON {
+		return m.codificado, nil
+	}
+	m.codificado.mu.Lock()
+	defer m.codificado.mu.Unlock()
+	if otro, ok := m.codificado.otros[c]; ok {
+		return otro, nil
+	}
+	if m.codificado.arbol == nil {
+		arbol, err := arbolJSON(m.codificado.datos)
+		if err != nil {
+			return nil, err
+		}
+		m.codificado.arbol = arbol
+	}
+	datos := c.anexar(nil, m.codificado.arbol)
+	preparado, err := websocket.NewPreparedMessage(c.tipoFrame, datos)
+	if err != nil {
+		return nil, err
+	}
+	if m.codificado.otros == nil {
+		m.codificado.otros = make(map[*codec]*mensajeCodificado)
+	}
+	otro := &mensajeCodificado{datos: datos, preparado: preparado}
+	m.codificado.otros[c] = otro
+	return otro, nil
+}
+
+// escribirMensaje envía un mensaje por la conexión en el codec del cliente, usando la
+// versión preparada si el hub ya lo serializó. Los mensajes para un solo cliente se
+// codifican aquí
+func (c *Client) escribirMensaje(message *Message) error {
+	if message.codificado != nil {
+		codificado, err := message.codificadoPara(c.codec)
+		if err != nil {
+			return err
+		}
+		c.ajustarCompresion(len(codificado.datos), message.tieneImagen())
+		if conn, ok := c.conn.(escritorPreparado); ok {
+			return conn.WritePreparedMessage(codificado.preparado)
+		}
+		return c.conn.WriteMessage(c.codec.tipoFrame, codificado.datos)
+	}
+	// Se serializa antes de escribir para saber si merece la pena comprimir
+	datos, err := c.codec.codificar(message)
+	if err != nil {
+		return err
+	}
+	c.ajustarCompresion(len(datos), message.tieneImagen())
+	return c.conn.WriteMessage(c.codec.tipoFrame, datos)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestPrepararSerializaUnaVez prueba que el mensaje preparado es el mismo JSON y que las copias no lo heredan
+func TestPrepararSerializaUnaVez(t *testing.T) {
+	message := NewUserMessage("ana", "hola")
+	message.preparar()
+	if message.codificado == nil {
+		t.Fatal("El mensaje debería quedar serializado")
+	}
+	var decodificado Message
+	if err := json.Unmarshal(message.codificado.datos, &decodificado); err != nil || decodificado.ID != message.ID || decodificado.MessageContent != "hola" {
+		t.Errorf("Serialización inesperada: %s (%v)", message.codificado.datos, err)
+	}
+	primera := message.codificado
+	message.preparar()
+	if message.codificado != primera {
+		t.Error("Preparar dos veces no debería volver a serializar")
+	}
+	if message.copia().codificado != nil {
+		t.Error("Una copia modificable no debería compartir la serialización")
+	}
+}
+
+// TestCodificadoParaDesdeJSON prueba que las versiones binarias de un mensaje preparado
+// salen del JSON ya serializado, leído una vez para todos los codecs
+func TestCodificadoParaDesdeJSON(t *testing.T) {
+	message := NewUserMessage("ana", "hola")
+	message.preparar()
+	for _, c := range []*codec{codecMsgpack, codecCBOR} {
+		codificado, err := message.codificadoPara(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		directo, _ := c.codificar(message)
+		if !bytes.Equal(codificado.datos, directo) {
+			t.Errorf("%s: la versión preparada no coincide con la directa", c.subprotocolo)
+		}
+		if otra, _ := message.codificadoPara(c); otra != codificado {
+			t.Errorf("%s: debería serializarse una sola vez", c.subprotocolo)
+		}
+	}
+	if message.codificado.arbol == nil {
+		t.Error("El árbol del JSON debería guardarse para los demás codecs")
+	}
+}
+
+// clientesPrueba crea n clientes sobre conexiones en memoria. El otro extremo lee y
+// descarta todo lo que llega
+func clientesPrueba(b *testing.B, n int) []*Client {
+	b.Helper()
+	hub := NewHub()
+	clientes := make([]*Client, n)
+	for i := range clientes {
+		servidor, navegador := net.Pipe()
+		b.Cleanup(func() { navegador.Close() })
+		go io.Copy(io.Discard, navegador)
+		clientes[i] = NewClient(hub, NewConexionTramas(servidor), "destinatario")
+	}
+	return clientes
+}
+
+// BenchmarkDifusionImagen compara serializar una imagen para cada destinatario con
+// serializarla una vez y enviar el frame preparado a todos
+func BenchmarkDifusionImagen(b *testing.B) {
+	const destinatarios = 50
+	imagen := base64.StdEncoding.EncodeToString(make([]byte, 256*1024))
+	clientes := clientesPrueba(b, destinatarios)
+
+	b.Run("por_destinatario", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			message := envioImagen("ana", "foto", imagen, "image/png")
+			for _, client := range clientes {
+				if err := client.escribirMensaje(message); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("preparado", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			message := envioImagen("ana", "foto", imagen, "image/png")
+			message.preparar()
+			for _, client := range clientes {
+				if err := client.escribirMensaje(message); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Comando describe un comando de chat invocable escribiendo "/nombre argumentos"
+type Comando struct {
+	// Nombre sin la barra inicial, en minúsculas
+	Nombre string
+	// Uso muestra la sintaxis en /help
+	Uso string
+	// Descripcion breve para /help
+	Descripcion string
+	// SoloAdmin restringe el comando a los administradores del hub
+	SoloAdmin bool
+	// Ejecutar recibe el cliente que invocó el comando y el resto de la línea
+	Ejecutar func(c *Client, args string)
+}
+
+// Despachador enruta las líneas que empiezan por "/" al comando registrado
+type Despachador struct {
+	comandos map[string]*Comando
+}
+
+// NewDespachador crea un despachador con los comandos básicos del chat
+func NewDespachador() *Despachador {
+	d := &Despachador{comandos: make(map[string]*Comando)}
+	registrarComandosBasicos(d)
+	return d
+}
+
+// Registrar añade (o reemplaza) un comando. Debe llamarse antes de Hub.Run
+func (d *Despachador) Registrar(cmd *Comando) {
+	d.comandos[strings.ToLower(cmd.Nombre)] = cmd
+}
+
+// esComando indica si el texto debe tratarse como comando.
+// Una doble barra ("//texto") permite enviar literalmente un texto que empieza por "/"
+func esComando(texto string) bool {
+	return strings.HasPrefix(texto, "/") && !strings.HasPrefix(texto, "//")
+}
+
+// Despachar interpreta la línea y ejecuta el comando correspondiente.
+// Las respuestas se envían solo al cliente que lo invocó
+func (d *Despachador) Despachar(c *Client, linea string) {
+	linea = strings.TrimSpace(strings.TrimPrefix(linea, "/"))
+	nombre, args, _ := strings.Cut(linea, " ")
+	nombre = strings.ToLower(nombre)
+	args = strings.TrimSpace(args)
+
+	cmd, ok := d.comandos[nombre]
+	if !ok {
+		c.responder(fmt.Sprintf("Comando desconocido: /%s. Escribe /help para ver los disponibles.", nombre))
+		return
+	}
+	if cmd.SoloAdmin && !c.hub.esAdmin(c) {
+		c.responder(fmt.Sprintf("El comando /%s está reservado a administradores.", cmd.Nombre))
+		return
+	}
+	log.Printf("[comandos] %s ejecuta /%s %s", c.nombre(), cmd.Nombre, args)
+	cmd.Ejecutar(c, args)
+}
+
+// disponiblesPara devuelve los comandos visibles para un usuario, ordenados por nombre
+func (d *Despachador) disponiblesPara(admin bool) []*Comando {
+	lista := make([]*Comando, 0, len(d.comandos))
+	for _, cmd := range d.comandos {
+		if cmd.SoloAdmin && !admin {
+			continue
+		}
+		lista = append(lista, cmd)
+	}
+	sort.Slice(lista, func(i, j int) bool { return lista[i].Nombre < lista[j].Nombre })
+	return lista
+}
+
+// registrarComandosBasicos añade los comandos que trae el chat de serie
+func registrarComandosBasicos(d *Despachador) {
+	d.Registrar(&Comando{
+		Nombre:      "help",
+		Uso:         "/help",
+		Descripcion: "Muestra los comandos disponibles",
+		Ejecutar: func(c *Client, args string) {
+			var b strings.Builder
+			b.WriteString("Comandos disponibles:")
+			for _, cmd := range d.disponiblesPara(c.hub.esAdmin(c)) {
+				fmt.Fprintf(&b, "\n%s — %s", cmd.Uso, cmd.Descripcion)
+			}
+			c.responder(b.String())
+		},
+	})
+
+	d.Registrar(&Comando{
+		Nombre:      "who",
+		Uso:         "/who",
+		Descripcion: "Lista los usuarios conectados",
+		Ejecutar: func(c *Client, args string) {
+			// El roster incluye a quienes están conectados a otros nodos de la sala
+			roster := c.hub.GetRoster()
+			usuarios := make([]string, 0, len(roster))
+			for _, estado := range roster {
+				usuarios = append(usuarios, estado.Username)
+			}
+			c.responder(fmt.Sprintf("Conectados (%d): %s", len(usuarios), strings.Join(usuarios, ", ")))
+		},
+	})
+
+	d.Registrar(&Comando{
+		Nombre:      "me",
+		Uso:         "/me <acción>",
+		Descripcion: "Envía una acción en tercera persona",
+		Ejecutar: func(c *Client, args string) {
+			if args == "" {
+				c.responder("Uso: /me <acción>")
+				return
+			}
+			c.hub.broadcast <- NewActionMessage(c.nombre(), args)
+		},
+	})
+
+	d.Registrar(&Comando{
+		Nombre:      "msg",
+		Uso:         "/msg <usuario> <texto>",
+		Descripcion: "Envía un mensaje privado, aunque el usuario no esté conectado",
+		Ejecutar: func(c *Client, args string) {
+			para, texto, ok := c.hub.separarDestinatario(args)
+			if !ok {
+				if strings.Contains(args, " ") {
+					c.responder(errDestinatarioDesconocido.Error())
+				} else {
+					c.responder("Uso: /msg <usuario> <texto>")
+				}
+				return
+			}
+			if err := c.hub.enviarDirecto(c, para, texto); err != nil {
+				c.responder(err.Error())
+			}
+		},
+	})
+
+	d.Registrar(&Comando{
+		Nombre:      "nick",
+		Uso:         "/nick <nuevo nombre>",
+		Descripcion: "Cambia tu nombre de usuario",
+		Ejecutar: func(c *Client, args string) {
+			if args == "" {
+				c.responder("Uso: /nick <nuevo nombre>")
+				return
+			}
+			if err := c.hub.cambiarNombre(c, args); err != nil {
+				c.responder(err.Error())
+			}
+		},
+	})
+
+	d.Registrar(&Comando{
+		Nombre:      "kick",
+		Uso:         "/kick <usuario>",
+		Descripcion: "Expulsa a un usuario de la sala",
+		SoloAdmin:   true,
+		Ejecutar: func(c *Client, args string) {
+			if args == "" {
+				c.responder("Uso: /kick <usuario>")
+				return
+			}
+			if args == c.nombre() {
+				c.responder("No puedes expulsarte a ti mismo.")
+				return
+			}
+			if c.hub.expulsar(args, c.nombre()) == 0 {
+				c.responder(fmt.Sprintf("No hay ningún usuario conectado llamado %s.", args))
+			}
+		},
+	})
+}
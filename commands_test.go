@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// servirHubPrueba arranca un hub ya configurado y devuelve la URL WebSocket de un servidor
+// de test. Solo para lo que depende del propio handler WebSocket (subprotocolos,
+// compresión); el resto de pruebas se conecta en memoria
+func servirHubPrueba(t *testing.T, hub *Hub) string {
+	t.Helper()
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWS(hub, w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// enviarTexto envía un mensaje de texto como lo hace el frontend
+func enviarTexto(t *testing.T, conn Conexion, texto string) {
+	t.Helper()
+	enviarJSON(t, conn, map[string]interface{}{"message_content": texto})
+}
+
+// enviarJSON envía una operación arbitraria del protocolo
+func enviarJSON(t *testing.T, conn Conexion, operacion map[string]interface{}) {
+	t.Helper()
+	messageBytes, _ := json.Marshal(operacion)
+	if err := conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
+		t.Fatalf("Error al enviar el mensaje: %v", err)
+	}
+}
+
+// esperarMensaje lee mensajes hasta encontrar uno que cumpla la condición
+func esperarMensaje(t *testing.T, conn Conexion, cumple func(*Message) bool) *Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, receivedBytes, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("No llegó el mensaje esperado: %v", err)
+		}
+		var message Message
+		if err := json.Unmarshal(receivedBytes, &message); err != nil {
+			t.Fatalf("Error al deserializar el mensaje: %v", err)
+		}
+		if cumple(&message) {
+			return &message
+		}
+	}
+}
+
+// noRecibe comprueba que durante un intervalo corto no llega ningún mensaje que cumpla la condición
+func noRecibe(t *testing.T, conn Conexion, cumple func(*Message) bool) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		_, receivedBytes, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var message Message
+		if json.Unmarshal(receivedBytes, &message) == nil && cumple(&message) {
+			t.Errorf("Mensaje inesperado: %+v", message)
+			return
+		}
+	}
+}
+
+// esperarClave devuelve la clave que el hub entrega a la primera sesión de un nombre,
+// con la que las siguientes se conectan (?token=)
+func esperarClave(t *testing.T, conn Conexion) string {
+	t.Helper()
+	return esperarMensaje(t, conn, func(m *Message) bool { return m.Type == tipoCredencial }).Token
+}
+
+func contiene(texto string) func(*Message) bool {
+	return func(m *Message) bool { return strings.Contains(m.MessageContent, texto) }
+}
+
+func esPresencia(usuario, presencia string) func(*Message) bool {
+	return func(m *Message) bool {
+		return m.Type == tipoPresencia && m.Username == usuario && m.Presence == presencia
+	}
+}
+
+// TestEsComando prueba la detección de comandos y del escape con doble barra
+func TestEsComando(t *testing.T) {
+	pruebas := map[string]bool{
+		"/who":      true,
+		"/me baila": true,
+		"//who":     false,
+		"hola /who": false,
+		"":          false,
+	}
+	for texto, esperado := range pruebas {
+		if esComando(texto) != esperado {
+			t.Errorf("esComando(%q) = %v, se esperaba %v", texto, !esperado, esperado)
+		}
+	}
+}
+
+// TestComandoWhoRespondeSoloAlInvocador prueba que las respuestas no se difunden
+func TestComandoWhoRespondeSoloAlInvocador(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarTexto(t, ana, "/who")
+
+	respuesta := esperarMensaje(t, ana, contiene("Conectados"))
+	if respuesta.Type != tipoSistema || !strings.Contains(respuesta.MessageContent, "ana, luis") {
+		t.Errorf("Respuesta inesperada a /who: %+v", respuesta)
+	}
+	noRecibe(t, luis, contiene("Conectados"))
+}
+
+// TestComandoDesconocido prueba la respuesta ante un comando inexistente
+func TestComandoDesconocido(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+
+	enviarTexto(t, ana, "/bailar")
+	esperarMensaje(t, ana, contiene("Comando desconocido: /bailar"))
+}
+
+// TestComandoMe prueba que /me se difunde como acción
+func TestComandoMe(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarTexto(t, ana, "/me saluda a todos")
+	accion := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoAccion })
+	if accion.Username != "ana" || accion.MessageContent != "saluda a todos" {
+		t.Errorf("Acción inesperada: %+v", accion)
+	}
+}
+
+// TestComandoNick prueba el cambio de nombre y el rechazo de nombres en uso
+func TestComandoNick(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	conectarEnMemoria(t, hub, "luis")
+
+	enviarTexto(t, ana, "/nick luis")
+	esperarMensaje(t, ana, contiene("otra persona"))
+
+	enviarTexto(t, ana, "/nick anabel")
+	esperarMensaje(t, ana, esPresencia("anabel", presenciaRenombrado))
+
+	usuarios := strings.Join(hub.GetConnectedClients(), ",")
+	if !strings.Contains(usuarios, "anabel") {
+		t.Errorf("Se esperaba anabel entre los conectados, obtuvimos %s", usuarios)
+	}
+}
+
+// TestComandoKick prueba que solo los administradores pueden expulsar
+func TestComandoKick(t *testing.T) {
+	hub := NewHub()
+	hub.SetAdmins([]string{"admin"})
+	hub.SetClaveAdmin("secreta")
+	go hub.Run()
+	admin := conectarEnMemoria(t, hub, "admin&token=secreta")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarTexto(t, luis, "/kick admin")
+	esperarMensaje(t, luis, contiene("reservado a administradores"))
+
+	enviarTexto(t, admin, "/kick luis")
+	esperarMensaje(t, luis, contiene("Has sido expulsado"))
+	esperarCierre(t, luis)
+	luis.esperarFin(t)
+	if hub.GetClientCount() != 1 {
+		t.Errorf("Se esperaba 1 cliente tras la expulsión, obtuvimos %d", hub.GetClientCount())
+	}
+}
+
+// TestNombresDeAdministradorReservados prueba que el nombre de un administrador no da
+// permisos sin su clave: ni al conectarse ni con /nick
+func TestNombresDeAdministradorReservados(t *testing.T) {
+	hub := NewHub()
+	hub.SetAdmins([]string{"admin"})
+	hub.SetClaveAdmin("secreta")
+	go hub.Run()
+
+	for _, intento := range []string{"admin", "admin&token=otra"} {
+		impostor := abrirEnMemoria(t, hub, intento)
+		esperarMensaje(t, impostor, contiene("reservado"))
+		esperarCierre(t, impostor)
+		impostor.esperarFin(t)
+	}
+	luis := conectarEnMemoria(t, hub, "luis")
+	enviarTexto(t, luis, "/nick admin")
+	esperarMensaje(t, luis, contiene("reservado"))
+	if usuarios := hub.GetConnectedClients(); len(usuarios) != 1 || usuarios[0] != "luis" {
+		t.Errorf("Solo debería estar luis, obtuvimos %v", usuarios)
+	}
+
+	// Quien se renombra deja de ser administrador
+	admin := conectarEnMemoria(t, hub, "admin&token=secreta")
+	enviarTexto(t, admin, "/nick exadmin")
+	esperarMensaje(t, admin, func(m *Message) bool { return m.Type == tipoNick })
+	enviarTexto(t, admin, "/kick luis")
+	esperarMensaje(t, admin, contiene("reservado a administradores"))
+}
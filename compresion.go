@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+)
+
+// Valores por defecto de la compresión permessage-deflate
+const (
+	nivelCompresionPorDefecto  = flate.BestSpeed
+	umbralCompresionPorDefecto = 512
+)
+
+// compresion es la configuración de permessage-deflate. Cada cliente copia la del hub al
+// conectarse, así que la goroutine de escritura la consulta sin locks
+type compresion struct {
+	activa bool
+	nivel  int
+	// Por debajo de umbral bytes no compensa comprimir
+	umbral int
+	// Las imágenes ya vienen comprimidas (JPEG, PNG...): por defecto no se recomprimen
+	imagenes bool
+}
+
+// SetCompresion negocia permessage-deflate con los clientes que lo admiten. nivel va de
+// flate.HuffmanOnly a flate.BestCompression; los mensajes de menos de umbral bytes, y las
+// imágenes salvo con imagenes, se envían sin comprimir
+func (h *Hub) SetCompresion(nivel, umbral int, imagenes bool) error {
+	if nivel < flate.HuffmanOnly || nivel > flate.BestCompression {
+		return fmt.Errorf("nivel de compresión no válido: %d", nivel)
+	}
+	if umbral < 0 {
+		return fmt.Errorf("umbral de compresión no válido: %d", umbral)
+	}
+	h.clientsMutex.Lock()
+	h.compresion = compresion{activa: true, nivel: nivel, umbral: umbral, imagenes: imagenes}
+	h.clientsMutex.Unlock()
+	return nil
+}
+
+// configuracionCompresion devuelve la configuración que copia cada cliente nuevo
+func (h *Hub) configuracionCompresion() compresion {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	return h.compresion
+}
+
+// comprimir indica si merece la pena comprimir un frame de tamano bytes. conImagen
+// indica que lleva alguna imagen
+func (c compresion) comprimir(tamano int, conImagen bool) bool {
+	return c.activa && tamano >= c.umbral && (c.imagenes || !conImagen)
+}
+
+// ajustarCompresion activa o no la compresión para el siguiente frame. Solo tiene efecto
+// si el cliente la negoció en el handshake
+func (c *Client) ajustarCompresion(tamano int, conImagen bool) {
+	if conn, ok := c.conn.(conexionComprimible); ok && c.compresion.activa {
+		conn.EnableWriteCompression(c.compresion.comprimir(tamano, conImagen))
+	}
+}
+
+// tieneImagen indica si el mensaje lleva una imagen, también dentro de los mensajes que
+// incluye (historial, búsquedas, hilos)
+func (m *Message) tieneImagen() bool {
+	if m.ImagenData != "" {
+		return true
+	}
+	for _, incluido := range m.Messages {
+		if incluido.tieneImagen() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// conexionContada cuenta los bytes que llegan por la red
+type conexionContada struct {
+	net.Conn
+	leidos *atomic.Int64
+}
+
+func (c conexionContada) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.leidos.Add(int64(n))
+	return n, err
+}
+
+// conectarComprimido conecta ofreciendo permessage-deflate y devuelve la conexión, si el
+// servidor aceptó la compresión y el contador de bytes recibidos
+func conectarComprimido(t *testing.T, wsURL, usuario string) (*websocket.Conn, bool, *atomic.Int64) {
+	t.Helper()
+	leidos := new(atomic.Int64)
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(red, direccion string) (net.Conn, error) {
+			conn, err := net.Dial(red, direccion)
+			return conexionContada{conn, leidos}, err
+		},
+	}
+	conn, respuesta, err := dialer.Dial(wsURL+"?username="+usuario, nil)
+	if err != nil {
+		t.Fatalf("Error de conexión de %s: %v", usuario, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	negociada := strings.Contains(respuesta.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	return conn, negociada, leidos
+}
+
+// bytesAlRecibir mide los bytes de red que cuesta que llegue el mensaje que cumple condicion
+func bytesAlRecibir(t *testing.T, conn *websocket.Conn, leidos *atomic.Int64, condicion func(*Message) bool) int64 {
+	t.Helper()
+	antes := leidos.Load()
+	esperarMensaje(t, conn, condicion)
+	return leidos.Load() - antes
+}
+
+// TestCompresionNegociada prueba que un texto repetitivo largo viaja comprimido y que
+// una imagen no se recomprime
+func TestCompresionNegociada(t *testing.T) {
+	hub := NewHub()
+	if err := hub.SetCompresion(9, 512, false); err != nil {
+		t.Fatal(err)
+	}
+	wsURL := servirHubPrueba(t, hub)
+	ana, negociada, leidos := conectarComprimido(t, wsURL, "ana")
+	if !negociada {
+		t.Fatal("El servidor debería aceptar permessage-deflate")
+	}
+	esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoHistorial })
+
+	texto := strings.Repeat("hola a todos ", 1000)
+	enviarTexto(t, ana, texto)
+	if n := bytesAlRecibir(t, ana, leidos, contiene("hola a todos")); n > int64(len(texto))/10 {
+		t.Errorf("El texto de %d bytes ocupó %d en la red: no se comprimió", len(texto), n)
+	}
+
+	// Una imagen de ceros se comprimiría muchísimo, pero las imágenes se envían tal cual
+	imagen := base64.StdEncoding.EncodeToString(make([]byte, 12000))
+	enviarJSON(t, ana, map[string]interface{}{"message_content": "foto", "imagen_data": imagen, "imagen_type": "image/png"})
+	if n := bytesAlRecibir(t, ana, leidos, contiene("foto")); n < int64(len(imagen)) {
+		t.Errorf("La imagen de %d bytes ocupó %d en la red: se comprimió", len(imagen), n)
+	}
+}
+
+// TestCompresionDesactivada prueba que, sin SetCompresion, no se negocia permessage-deflate
+func TestCompresionDesactivada(t *testing.T) {
+	wsURL := servirHubPrueba(t, NewHub())
+	if _, negociada, _ := conectarComprimido(t, wsURL, "ana"); negociada {
+		t.Error("No debería negociarse la compresión si no está activada")
+	}
+}
+
+// TestDecidirCompresion prueba el umbral y las imágenes, también dentro del historial
+func TestDecidirCompresion(t *testing.T) {
+	c := compresion{activa: true, nivel: 1, umbral: 100}
+	conImagen := &Message{Type: tipoHistorial, Messages: []*Message{NewUserMessage("ana", "hola"), envioImagen("ana", "foto", "aW1n", "image/png")}}
+	casos := []struct {
+		nombre  string
+		c       compresion
+		tamano  int
+		imagen  bool
+		esperar bool
+	}{
+		{"grande", c, 1000, false, true},
+		{"bajo el umbral", c, 99, false, false},
+		{"con imagen", c, 1000, conImagen.tieneImagen(), false},
+		{"imagenes permitidas", compresion{activa: true, umbral: 100, imagenes: true}, 1000, true, true},
+		{"desactivada", compresion{}, 1000, false, false},
+	}
+	for _, caso := range casos {
+		if got := caso.c.comprimir(caso.tamano, caso.imagen); got != caso.esperar {
+			t.Errorf("%s: comprimir = %v, se esperaba %v", caso.nombre, got, caso.esperar)
+		}
+	}
+	if err := NewHub().SetCompresion(10, 0, false); err == nil {
+		t.Error("El nivel 10 no es válido")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conexion es el transporte por el que un Client intercambia frames con su navegador.
+// *websocket.Conn la cumple tal cual; SSE y long-polling la implementan sobre HTTP y
+// ConexionTramas sobre TCP o un net.Pipe en memoria. Los tipos de frame son los de
+// WebSocket (websocket.TextMessage, PingMessage, CloseMessage...): los ping se envían
+// con WriteMessage y el cierre es un frame CloseMessage seguido de Close
+type Conexion interface {
+	ReadMessage() (tipo int, datos []byte, err error)
+	WriteMessage(tipo int, datos []byte) error
+	NextWriter(tipo int) (io.WriteCloser, error)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// Capacidades opcionales de una Conexion que solo tiene WebSocket
+type (
+	// escritorPreparado reutiliza el frame ya construido de una difusión
+	escritorPreparado interface {
+		WritePreparedMessage(pm *websocket.PreparedMessage) error
+	}
+	// conexionComprimible activa o no permessage-deflate frame a frame
+	conexionComprimible interface {
+		EnableWriteCompression(activar bool)
+	}
+	// conexionConPong avisa de los pong que responden a nuestros ping
+	conexionConPong interface {
+		SetPongHandler(h func(datos string) error)
+	}
+)
+
+// escritorDiferido junta lo que se escribe con NextWriter y lo envía como un solo
+// mensaje al cerrarlo, para transportes que no pueden enviar un frame por partes
+type escritorDiferido struct {
+	bytes.Buffer
+	enviar func(datos []byte) error
+}
+
+func (e *escritorDiferido) Close() error {
+	return e.enviar(e.Bytes())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Tamaño máximo de un frame, como el de un mensaje enviado por POST
+	maxTrama = maxCuerpoEnvio
+	// Lo que tiene un cliente TCP para enviar el primer frame con sus opciones
+	esperaSaludoTCP = 10 * time.Second
+	// Tamaño máximo del saludo: solo lleva las opciones de conexión
+	maxSaludoTCP = 4 << 10
+	// Los datos de un frame se leen por trozos de este tamaño, así una cabecera que
+	// promete más de lo que llega no reserva memoria por adelantado
+	trozoTrama = 64 << 10
+)
+
+// ConexionTramas lleva los frames del chat sobre cualquier net.Conn: una conexión TCP
+// sin WebSocket o un net.Pipe en memoria. Cada frame es un byte con el tipo (los de
+// WebSocket), la longitud en 4 bytes big-endian y los datos. Como gorilla, ReadMessage
+// responde a los ping y convierte el frame de cierre en un *websocket.CloseError
+type ConexionTramas struct {
+	conn   net.Conn
+	lector *bufio.Reader
+	// max es el tamaño máximo de un frame que se acepta al leer
+	max uint32
+	// escritura ordena los frames de goroutineEscritura y los pong de la lectura
+	escritura sync.Mutex
+	// alPong solo se usa desde la goroutine que lee
+	alPong func(datos string) error
+}
+
+// NewConexionTramas crea una Conexion sobre conn
+func NewConexionTramas(conn net.Conn) *ConexionTramas {
+	return &ConexionTramas{conn: conn, lector: bufio.NewReader(conn), max: maxTrama}
+}
+
+// ReadMessage devuelve el siguiente frame de texto o binario, atendiendo antes los de control
+func (c *ConexionTramas) ReadMessage() (int, []byte, error) {
+	for {
+		var cabecera [5]byte
+		if _, err := io.ReadFull(c.lector, cabecera[:]); err != nil {
+			return 0, nil, err
+		}
+		tipo, n := int(cabecera[0]), binary.BigEndian.Uint32(cabecera[1:])
+		if n > c.max {
+			return 0, nil, fmt.Errorf("frame de %d bytes, el máximo es %d", n, c.max)
+		}
+		datos, err := c.leerDatos(int64(n))
+		if err != nil {
+			return 0, nil, err
+		}
+		switch tipo {
+		case websocket.TextMessage, websocket.BinaryMessage:
+			return tipo, datos, nil
+		case websocket.PingMessage:
+			if err := c.WriteMessage(websocket.PongMessage, datos); err != nil {
+				return 0, nil, err
+			}
+		case websocket.PongMessage:
+			if c.alPong != nil {
+				if err := c.alPong(string(datos)); err != nil {
+					return 0, nil, err
+				}
+			}
+		case websocket.CloseMessage:
+			// A diferencia de WebSocket no se devuelve el cierre: quien lo envió cierra
+			// la conexión justo después
+			cierre := &websocket.CloseError{Code: websocket.CloseNoStatusReceived}
+			if len(datos) >= 2 {
+				cierre.Code = int(binary.BigEndian.Uint16(datos))
+				cierre.Text = string(datos[2:])
+			}
+			return 0, nil, cierre
+		default:
+			return 0, nil, fmt.Errorf("tipo de frame desconocido: %d", tipo)
+		}
+	}
+}
+
+// leerDatos lee los n bytes de un frame. El búfer crece con lo que llega de verdad,
+// por trozos, en lugar de reservar de golpe lo que dice la cabecera
+func (c *ConexionTramas) leerDatos(n int64) ([]byte, error) {
+	var datos bytes.Buffer
+	for datos.Len() < int(n) {
+		trozo := n - int64(datos.Len())
+		if trozo > trozoTrama {
+			trozo = trozoTrama
+		}
+		if _, err := io.CopyN(&datos, c.lector, trozo); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return datos.Bytes(), nil
+}
+
+// WriteMessage envía un frame de cualquier tipo, incluidos los de control
+func (c *ConexionTramas) WriteMessage(tipo int, datos []byte) error {
+	if len(datos) > maxTrama {
+		return fmt.Errorf("frame de %d bytes, el máximo es %d", len(datos), maxTrama)
+	}
+	// Cabecera y datos en una sola escritura: net.Pipe entrega cada Write por separado
+	trama := make([]byte, 5, 5+len(datos))
+	trama[0] = byte(tipo)
+	binary.BigEndian.PutUint32(trama[1:], uint32(len(datos)))
+	trama = append(trama, datos...)
+	c.escritura.Lock()
+	defer c.escritura.Unlock()
+	_, err := c.conn.Write(trama)
+	return err
+}
+
+func (c *ConexionTramas) NextWriter(tipo int) (io.WriteCloser, error) {
+	return &escritorDiferido{enviar: func(datos []byte) error { return c.WriteMessage(tipo, datos) }}, nil
+}
+
+func (c *ConexionTramas) SetPongHandler(h func(datos string) error) {
+	c.alPong = h
+}
+
+func (c *ConexionTramas) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *ConexionTramas) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *ConexionTramas) Close() error {
+	return c.conn.Close()
+}
+
+// ServeTCP atiende en ln a clientes sin WebSocket que usan ConexionTramas. El primer
+// frame lleva las mismas opciones que la URL de /ws (username=ana&clase=movil); después
+// se intercambian los mensajes JSON de siempre
+func ServeTCP(hub *Hub, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go atenderTCP(hub, NewConexionTramas(conn))
+	}
+}
+
+// atenderTCP lee el saludo de un cliente TCP y lo registra en el hub. Hasta que se
+// presenta, un cliente solo puede enviar un frame pequeño
+func atenderTCP(hub *Hub, conn *ConexionTramas) {
+	conn.SetReadDeadline(time.Now().Add(esperaSaludoTCP))
+	conn.max = maxSaludoTCP
+	_, saludo, err := conn.ReadMessage()
+	conn.max = maxTrama
+	if err != nil {
+		log.Printf("Cliente TCP sin saludo: %v", err)
+		conn.Close()
+		return
+	}
+	var client *Client
+	opciones, err := url.ParseQuery(string(saludo))
+	if err == nil {
+		client, err = clienteDesdeSolicitud(hub, conn, nombreSolicitado(opciones), opciones)
+	}
+	if err != nil {
+		if datos, err := codecJSON.codificar(NewSystemMessage(err.Error())); err == nil {
+			conn.WriteMessage(websocket.TextMessage, datos)
+		}
+		conn.Close()
+		return
+	}
+
+	client.hub.register <- client
+	go client.goroutineEscritura()
+	go client.goroutineLectura()
+}
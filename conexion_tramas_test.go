@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sesionMemoria es un cliente del hub conectado por net.Pipe. La prueba usa el extremo
+// del navegador y puede esperar a que el servidor termine la sesión sin dormir
+type sesionMemoria struct {
+	*ConexionTramas
+	client    *Client
+	terminada chan struct{}
+}
+
+// abrirEnMemoria conecta un cliente al hub como lo hace ServeWS, con las opciones en el
+// formato de la URL ("admin&token=secreta"), sin esperar a que se registre
+func abrirEnMemoria(t *testing.T, hub *Hub, opciones string) *sesionMemoria {
+	t.Helper()
+	valores, err := url.ParseQuery("username=" + opciones)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servidor, navegador := net.Pipe()
+	conn := NewConexionTramas(servidor)
+	client, err := clienteDesdeSolicitud(hub, conn, nombreSolicitado(valores), valores)
+	sesion := &sesionMemoria{ConexionTramas: NewConexionTramas(navegador), client: client, terminada: make(chan struct{})}
+	t.Cleanup(func() { sesion.Close() })
+	if err != nil {
+		// Como ServeWS: el motivo y el cierre, sin llegar a registrarse
+		go func() {
+			if datos, err := codecJSON.codificar(NewSystemMessage(err.Error())); err == nil {
+				conn.WriteMessage(websocket.TextMessage, datos)
+			}
+			conn.Close()
+		}()
+		close(sesion.terminada)
+		return sesion
+	}
+
+	hub.register <- client
+	go func() {
+		client.goroutineEscritura()
+		// La escritura también sale si falla un envío; la sesión termina cuando el hub
+		// cierra send
+		for range client.send {
+		}
+		close(sesion.terminada)
+	}()
+	go client.goroutineLectura()
+	return sesion
+}
+
+// conectarEnMemoria abre una sesión y espera a que el hub la registre: la foto de
+// conectados es lo primero que recibe
+func conectarEnMemoria(t *testing.T, hub *Hub, opciones string) *sesionMemoria {
+	t.Helper()
+	sesion := abrirEnMemoria(t, hub, opciones)
+	esperarMensaje(t, sesion, func(m *Message) bool { return m.Type == tipoRoster })
+	return sesion
+}
+
+// esperarFin espera a que el hub dé de baja la sesión
+func (s *sesionMemoria) esperarFin(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.terminada:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("La sesión de %s no terminó", s.client.nombre())
+	}
+}
+
+// esperarCierre lee hasta el frame de cierre y devuelve su error
+func esperarCierre(t *testing.T, conn Conexion) error {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return err
+		}
+	}
+}
+
+// TestTramasControl prueba los frames de control: los ping se responden solos, los pong
+// llegan al manejador y el cierre se lee como en WebSocket
+func TestTramasControl(t *testing.T) {
+	a, b := net.Pipe()
+	izquierda, derecha := NewConexionTramas(a), NewConexionTramas(b)
+	defer izquierda.Close()
+	defer derecha.Close()
+
+	pongs := make(chan string, 1)
+	izquierda.SetPongHandler(func(datos string) error {
+		pongs <- datos
+		return nil
+	})
+	go func() {
+		// derecha responde al ping mientras espera datos
+		derecha.ReadMessage()
+	}()
+	go izquierda.WriteMessage(websocket.PingMessage, []byte("hola"))
+	go func() {
+		izquierda.ReadMessage()
+	}()
+	select {
+	case datos := <-pongs:
+		if datos != "hola" {
+			t.Errorf("Pong con %q", datos)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No llegó el pong")
+	}
+
+	c, d := net.Pipe()
+	emisor, receptor := NewConexionTramas(c), NewConexionTramas(d)
+	defer emisor.Close()
+	go emisor.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(cierreExpulsado, "fuera"))
+	_, _, err := receptor.ReadMessage()
+	if !websocket.IsCloseError(err, cierreExpulsado) || err.(*websocket.CloseError).Text != "fuera" {
+		t.Errorf("Se esperaba el cierre %d, obtuvimos %v", cierreExpulsado, err)
+	}
+}
+
+// TestTramasRechazaFramesEnormes prueba que una longitud falsa no reserva memoria
+func TestTramasRechazaFramesEnormes(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	conn := NewConexionTramas(b)
+	defer conn.Close()
+	go a.Write([]byte{websocket.TextMessage, 0xff, 0xff, 0xff, 0xff})
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("Se esperaba un error con un frame de 4 GiB")
+	}
+}
+
+// TestTramasDatosIncompletos prueba que un frame que promete más datos de los que
+// llegan da error al cortarse la conexión, y que los frames grandes se leen enteros
+func TestTramasDatosIncompletos(t *testing.T) {
+	a, b := net.Pipe()
+	conn := NewConexionTramas(b)
+	defer conn.Close()
+	go func() {
+		a.Write([]byte{websocket.TextMessage, 0x00, 0xff, 0x00, 0x00, 'h', 'o', 'l', 'a'})
+		a.Close()
+	}()
+	if _, _, err := conn.ReadMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Se esperaba io.ErrUnexpectedEOF, obtuvimos %v", err)
+	}
+
+	c, d := net.Pipe()
+	emisor, receptor := NewConexionTramas(c), NewConexionTramas(d)
+	defer emisor.Close()
+	defer receptor.Close()
+	grande := bytes.Repeat([]byte("x"), 3*trozoTrama+7)
+	go emisor.WriteMessage(websocket.BinaryMessage, grande)
+	if tipo, datos, err := receptor.ReadMessage(); err != nil || tipo != websocket.BinaryMessage || !bytes.Equal(datos, grande) {
+		t.Errorf("Frame grande mal leído: %d bytes, %v", len(datos), err)
+	}
+}
+
+// TestSaludoTCPAcotado prueba que antes de presentarse un cliente TCP no puede anunciar
+// un frame grande
+func TestSaludoTCPAcotado(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	servidor, cliente := net.Pipe()
+	defer cliente.Close()
+	go atenderTCP(hub, NewConexionTramas(servidor))
+	go cliente.Write([]byte{websocket.TextMessage, 0x00, 0x10, 0x00, 0x00})
+	cliente.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := cliente.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("El servidor debería cerrar la conexión, obtuvimos %v", err)
+	}
+	if hub.GetClientCount() != 0 {
+		t.Error("No debería registrarse ningún cliente")
+	}
+}
+
+// TestServeTCP prueba un cliente TCP de verdad, que se presenta con el primer frame
+func TestServeTCP(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeTCP(hub, ln)
+
+	luis := conectarEnMemoria(t, hub, "luis")
+	tcp, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ana := NewConexionTramas(tcp)
+	defer ana.Close()
+	if err := ana.WriteMessage(websocket.TextMessage, []byte("username=ana")); err != nil {
+		t.Fatal(err)
+	}
+	esperarMensaje(t, luis, esPresencia("ana", presenciaEntra))
+
+	enviarTexto(t, ana, "hola por TCP")
+	esperarMensaje(t, luis, contiene("hola por TCP"))
+	enviarTexto(t, luis, "hola desde memoria")
+	esperarMensaje(t, ana, contiene("hola desde memoria"))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+// Tamaño máximo por defecto de la cola en disco de un cliente lento
+const maxDerramePorDefecto = 8 << 20
+
+// Mensajes derramados que pueden esperar en memoria a que la goroutine de derrame los
+// escriba; si el disco no da abasto para tantos, se desconecta al cliente
+const maxPorDerramar = 1024
+
+var errDerrameLleno = errors.New("cola en disco llena")
+
+// colaDisco es una cola FIFO de mensajes en un archivo temporal, para los clientes lentos
+// con la política LentoDisco. Cada registro es la longitud (4 bytes) seguida del JSON.
+// No tiene lock propio: la protege derrameMu del cliente
+type colaDisco struct {
+	archivo *os.File
+	// Posiciones de lectura y escritura, mensajes guardados y bytes máximos pendientes,
+	// que es también lo más que llega a ocupar el archivo
+	lectura, escritura int64
+	pendientes         int
+	max                int64
+}
+
+// newColaDisco crea el archivo de la cola en dir
+func newColaDisco(dir string, max int64) (*colaDisco, error) {
+	archivo, err := os.CreateTemp(dir, "chat-derrame-*")
+	if err != nil {
+		return nil, err
+	}
+	return &colaDisco{archivo: archivo, max: max}, nil
+}
+
+// guardar añade un mensaje al final de la cola. El límite cuenta lo que falta por leer;
+// si el archivo no da para más, antes se compacta
+func (q *colaDisco) guardar(message *Message) error {
+	datos, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	tamaño := 4 + int64(len(datos))
+	if q.escritura-q.lectura+tamaño > q.max {
+		return errDerrameLleno
+	}
+	if q.escritura+tamaño > q.max {
+		if err := q.compactar(); err != nil {
+			return err
+		}
+	}
+	registro := make([]byte, 4+len(datos))
+	binary.BigEndian.PutUint32(registro, uint32(len(datos)))
+	copy(registro[4:], datos)
+	if _, err := q.archivo.WriteAt(registro, q.escritura); err != nil {
+		return err
+	}
+	q.escritura += int64(len(registro))
+	q.pendientes++
+	return nil
+}
+
+// sacar devuelve el mensaje más antiguo. Al vaciarse, el archivo vuelve a empezar
+func (q *colaDisco) sacar() (*Message, error) {
+	if q.pendientes == 0 {
+		return nil, io.EOF
+	}
+	var longitud [4]byte
+	if _, err := q.archivo.ReadAt(longitud[:], q.lectura); err != nil {
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(longitud[:]))
+	if n > q.escritura-q.lectura-4 {
+		return nil, errors.New("registro corrupto en la cola en disco")
+	}
+	datos := make([]byte, n)
+	if _, err := q.archivo.ReadAt(datos, q.lectura+4); err != nil {
+		return nil, err
+	}
+	q.lectura += 4 + int64(len(datos))
+	if q.pendientes--; q.pendientes == 0 {
+		q.lectura, q.escritura = 0, 0
+		q.archivo.Truncate(0)
+	}
+	var message Message
+	if err := json.Unmarshal(datos, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// compactar mueve lo pendiente al principio del archivo y descarta lo ya leído. Se copia
+// por trozos hacia atrás, así que el origen nunca se pisa antes de leerlo
+func (q *colaDisco) compactar() error {
+	trozo := make([]byte, 64<<10)
+	var copiado int64
+	for pendiente := q.escritura - q.lectura; copiado < pendiente; {
+		n := int64(len(trozo))
+		if resto := pendiente - copiado; resto < n {
+			n = resto
+		}
+		if _, err := q.archivo.ReadAt(trozo[:n], q.lectura+copiado); err != nil {
+			return err
+		}
+		if _, err := q.archivo.WriteAt(trozo[:n], copiado); err != nil {
+			return err
+		}
+		copiado += n
+	}
+	q.lectura, q.escritura = 0, copiado
+	return q.archivo.Truncate(copiado)
+}
+
+// cerrar borra el archivo de la cola
+func (q *colaDisco) cerrar() {
+	q.archivo.Close()
+	os.Remove(q.archivo.Name())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errDestinatarioDesconocido = errors.New("No conozco a ningún usuario con ese nombre.")
+	errMensajeAUnoMismo        = errors.New("No puedes enviarte un mensaje privado a ti mismo.")
+)
+
+// NewDirectMessage crea un mensaje privado de un usuario a otro. No pasa por la sala ni por el historial
+func NewDirectMessage(de, para, contenido string) *Message {
+	return &Message{
+		ID:             nuevoIDMensaje(),
+		Username:       de,
+		MessageContent: contenido,
+		Timestamp:      time.Now(),
+		Type:           tipoDirecto,
+		To:             para,
+	}
+}
+
+// destinatarioConocidoLocked devuelve el nombre registrado que corresponde a nombre, sin
+// distinguir mayúsculas. Requiere clientsMutex tomado
+func (h *Hub) destinatarioConocidoLocked(nombre string) (string, bool) {
+	if h.conocidos[nombre] {
+		return nombre, true
+	}
+	for conocido := range h.conocidos {
+		if strings.EqualFold(conocido, nombre) {
+			return conocido, true
+		}
+	}
+	return "", false
+}
+
+// separarDestinatario divide los argumentos de /msg en destinatario y texto. Como los
+// nombres pueden tener espacios, gana el usuario conocido más largo que encaje al principio
+func (h *Hub) separarDestinatario(args string) (string, string, bool) {
+	h.clientsMutex.RLock()
+	conocidos := make([]string, 0, len(h.conocidos))
+	for nombre := range h.conocidos {
+		conocidos = append(conocidos, nombre)
+	}
+	h.clientsMutex.RUnlock()
+	sort.Slice(conocidos, func(i, j int) bool { return len(conocidos[i]) > len(conocidos[j]) })
+	for _, nombre := range conocidos {
+		if len(args) > len(nombre) && args[len(nombre)] == ' ' && strings.EqualFold(args[:len(nombre)], nombre) {
+			return nombre, strings.TrimSpace(args[len(nombre):]), true
+		}
+	}
+	return "", "", false
+}
+
+// enviarDirecto entrega un mensaje privado a todas las sesiones del destinatario y del
+// remitente. Si el destinatario no está conectado, el mensaje espera en su buzón
+func (h *Hub) enviarDirecto(client *Client, para, contenido string) error {
+	contenido = strings.TrimSpace(contenido)
+	if contenido == "" {
+		return errContenidoVacio
+	}
+	de := client.nombre()
+	h.clientsMutex.Lock()
+	para, ok := h.destinatarioConocidoLocked(strings.TrimSpace(para))
+	if !ok {
+		h.clientsMutex.Unlock()
+		return errDestinatarioDesconocido
+	}
+	if para == de {
+		h.clientsMutex.Unlock()
+		return errMensajeAUnoMismo
+	}
+	message := NewDirectMessage(de, para, contenido)
+	conectado := h.nombreEnUsoLocked(para) || h.presenteEnOtroNodoLocked(para)
+	h.entregarPersonalLocked(para, message)
+	for sesion := range h.sesiones[de] {
+		h.enviarAClienteLocked(sesion, message)
+	}
+	h.clientsMutex.Unlock()
+	// Los demás nodos lo entregan a las sesiones que tengan el destinatario y el remitente
+	h.publicarSobre(&Sobre{Tipo: sobreDirecto, Mensaje: message})
+
+	if !conectado {
+		client.responder(fmt.Sprintf("%s no está conectado; recibirá tu mensaje cuando vuelva.", para))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Errores de las operaciones sobre mensajes ya enviados
+var (
+	errMensajeNoEncontrado = errors.New("Ese mensaje ya no está en el historial.")
+	errSinPermiso          = errors.New("Solo el autor del mensaje o un administrador pueden hacer eso.")
+	errMensajeBorrado      = errors.New("Ese mensaje ya fue eliminado.")
+	errContenidoVacio      = errors.New("El mensaje no puede quedar vacío; elimínalo si ya no lo necesitas.")
+)
+
+// NewEditMessage crea el evento que reemplaza el texto de un mensaje ya difundido
+func NewEditMessage(editor, messageID, contenido string, editadoEn time.Time) *Message {
+	return &Message{
+		ID:             nuevoIDMensaje(),
+		Username:       editor,
+		MessageContent: contenido,
+		Timestamp:      editadoEn,
+		Type:           tipoEditar,
+		MessageID:      messageID,
+		EditedAt:       &editadoEn,
+	}
+}
+
+// NewDeleteMessage crea el evento que elimina un mensaje ya difundido
+func NewDeleteMessage(autorBorrado, messageID string) *Message {
+	return &Message{
+		ID:        nuevoIDMensaje(),
+		Username:  autorBorrado,
+		Timestamp: time.Now(),
+		Type:      tipoBorrar,
+		MessageID: messageID,
+	}
+}
+
+// mensajeModificable comprueba que la sesión puede editar o borrar el mensaje
+func (h *Hub) mensajeModificable(client *Client, messageID string) (*Message, error) {
+	original, ok := h.historial.Buscar(messageID)
+	if !ok || (original.Type != tipoUsuario && original.Type != tipoAccion) {
+		return nil, errMensajeNoEncontrado
+	}
+	if original.Deleted {
+		return nil, errMensajeBorrado
+	}
+	if original.Username != client.nombre() && !h.esAdmin(client) {
+		return nil, errSinPermiso
+	}
+	return original, nil
+}
+
+// editarMensaje valida la edición y la difunde. El historial se actualiza en
+// broadcastMessage, igual que con cualquier otro mensaje
+func (h *Hub) editarMensaje(client *Client, messageID, contenido string) error {
+	original, err := h.mensajeModificable(client, messageID)
+	if err != nil {
+		return err
+	}
+	contenido = strings.TrimSpace(contenido)
+	if contenido == "" && original.ImagenData == "" {
+		return errContenidoVacio
+	}
+	h.broadcast <- NewEditMessage(client.nombre(), messageID, contenido, time.Now())
+	return nil
+}
+
+// borrarMensaje valida el borrado y lo difunde
+func (h *Hub) borrarMensaje(client *Client, messageID string) error {
+	if _, err := h.mensajeModificable(client, messageID); err != nil {
+		return err
+	}
+	h.broadcast <- NewDeleteMessage(client.nombre(), messageID)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestHistorialEditarYBorrar prueba la modificación de mensajes guardados
+func TestHistorialEditarYBorrar(t *testing.T) {
+	hist := NewHistorial(10)
+	texto := NewUserMessage("ana", "contraseña: 1234")
+	imagen := envioImagen("ana", "foto", "datosImagen", "image/png")
+	hist.Agregar(texto)
+	hist.Agregar(imagen)
+
+	editadoEn := time.Now()
+	if !hist.Editar(texto.ID, "ups, ignorad esto", editadoEn) {
+		t.Fatal("Se esperaba poder editar el mensaje")
+	}
+	editado, _ := hist.Buscar(texto.ID)
+	if editado.MessageContent != "ups, ignorad esto" || editado.EditedAt == nil || !editado.EditedAt.Equal(editadoEn) {
+		t.Errorf("Edición no aplicada: %+v", editado)
+	}
+
+	if !hist.Borrar(imagen.ID) {
+		t.Fatal("Se esperaba poder borrar el mensaje")
+	}
+	borrado, _ := hist.Buscar(imagen.ID)
+	if !borrado.Deleted || borrado.ImagenData != "" || borrado.MessageContent != "" {
+		t.Errorf("El borrado debería descartar el contenido: %+v", borrado)
+	}
+	if hist.Editar(imagen.ID, "otra cosa", editadoEn) || hist.Borrar(imagen.ID) {
+		t.Error("Un mensaje borrado no se puede editar ni volver a borrar")
+	}
+}
+
+// TestEditarYBorrarMensajes prueba permisos, propagación y reflejo en el historial
+func TestEditarYBorrarMensajes(t *testing.T) {
+	hub := NewHub()
+	hub.SetAdmins([]string{"admin"})
+	hub.SetClaveAdmin("secreta")
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+	admin := conectarEnMemoria(t, hub, "admin&token=secreta")
+
+	enviarTexto(t, ana, "hola a todoss")
+	original := esperarMensaje(t, luis, contiene("hola a todoss"))
+
+	// Solo el autor puede editar
+	enviarJSON(t, luis, map[string]interface{}{"type": "edit", "message_id": original.ID, "message_content": "hackeado"})
+	esperarMensaje(t, luis, contiene("Solo el autor"))
+
+	enviarJSON(t, ana, map[string]interface{}{"type": "edit", "message_id": original.ID, "message_content": "hola a todos"})
+	edicion := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoEditar })
+	if edicion.MessageID != original.ID || edicion.MessageContent != "hola a todos" || edicion.EditedAt == nil {
+		t.Errorf("Evento de edición inesperado: %+v", edicion)
+	}
+
+	// Un administrador puede borrar mensajes ajenos
+	enviarJSON(t, admin, map[string]interface{}{"type": "delete", "message_id": original.ID})
+	borrado := esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoBorrar })
+	if borrado.MessageID != original.ID || borrado.Username != "admin" {
+		t.Errorf("Evento de borrado inesperado: %+v", borrado)
+	}
+
+	// Quien llega después ve el mensaje ya borrado en el historial
+	nuevo := conectarEnMemoria(t, hub, "nuevo")
+	historial := esperarMensaje(t, nuevo, func(m *Message) bool { return m.Type == tipoHistorial })
+	encontrado := false
+	for _, m := range historial.Messages {
+		if m.ID == original.ID {
+			encontrado = true
+			if !m.Deleted || m.MessageContent != "" || m.EditedAt == nil {
+				t.Errorf("Se esperaba el mensaje editado y borrado, obtuvimos %+v", m)
+			}
+		}
+	}
+	if !encontrado {
+		t.Error("El mensaje borrado debería seguir en el historial como eliminado")
+	}
+}
+
+// TestEditarTrasCambiarNombre prueba que los mensajes siguen siendo de quien cambia de
+// nombre y que nadie puede tomar el nombre anterior para modificarlos
+func TestEditarTrasCambiarNombre(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+	enviarTexto(t, ana, "hola a todoss")
+	original := esperarMensaje(t, luis, contiene("hola a todoss"))
+
+	enviarJSON(t, ana, map[string]interface{}{"type": "nick", "username": "anabel"})
+	esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoNick })
+	if guardado, _ := hub.historial.Buscar(original.ID); guardado.Username != "anabel" {
+		t.Errorf("El mensaje debería pasar a anabel, es de %s", guardado.Username)
+	}
+	enviarJSON(t, ana, map[string]interface{}{"type": "edit", "message_id": original.ID, "message_content": "hola a todos"})
+	edicion := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoEditar })
+	if edicion.Username != "anabel" || edicion.MessageContent != "hola a todos" {
+		t.Errorf("Evento de edición inesperado: %+v", edicion)
+	}
+	if resultados := hub.historial.BuscarTexto(Consulta{Autor: "anabel"}); len(resultados) != 1 {
+		t.Errorf("La búsqueda por autor debería encontrar el mensaje con el nuevo nombre: %v", resultados)
+	}
+
+	// El nombre anterior no queda libre para otra persona
+	impostor := abrirEnMemoria(t, hub, "ana")
+	esperarMensaje(t, impostor, contiene("pertenece a otra persona"))
+	enviarJSON(t, luis, map[string]interface{}{"type": "nick", "username": "ana"})
+	esperarMensaje(t, luis, contiene("ya lo ha usado otra persona"))
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formatos de exportación de la transcripción
+const (
+	formatoJSONL = "jsonl"
+	formatoCSV   = "csv"
+	formatoTexto = "txt"
+	formatoHTML  = "html"
+)
+
+// Tipos de contenido de cada formato para la descarga HTTP
+var tiposContenido = map[string]string{
+	formatoJSONL: "application/x-ndjson; charset=utf-8",
+	formatoCSV:   "text/csv; charset=utf-8",
+	formatoTexto: "text/plain; charset=utf-8",
+	formatoHTML:  "text/html; charset=utf-8",
+}
+
+// Transcripciones de más de este tamaño por línea no se pueden leer (imágenes incluidas)
+const maxLineaTranscripcion = 16 << 20
+
+// FiltroExportacion acota qué parte del historial se exporta. Los campos vacíos no filtran
+type FiltroExportacion struct {
+	Sala  string
+	Desde time.Time
+	Hasta time.Time
+}
+
+// incluye indica si un mensaje entra en el filtro
+func (f FiltroExportacion) incluye(message *Message) bool {
+	if f.Sala != "" && message.Room != f.Sala {
+		return false
+	}
+	if !f.Desde.IsZero() && message.Timestamp.Before(f.Desde) {
+		return false
+	}
+	return f.Hasta.IsZero() || !message.Timestamp.After(f.Hasta)
+}
+
+// Exportables devuelve copias de los mensajes guardados que entran en el filtro, del más
+// antiguo al más nuevo. Incluye los mensajes del sistema y los borrados (sin contenido)
+func (hist *Historial) Exportables(filtro FiltroExportacion) []*Message {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	var mensajes []*Message
+	for _, message := range hist.mensajes {
+		if filtro.incluye(message) {
+			mensajes = append(mensajes, message.copia())
+		}
+	}
+	return mensajes
+}
+
+// formatoValido indica si se sabe exportar en ese formato
+func formatoValido(formato string) bool {
+	_, ok := tiposContenido[formato]
+	return ok
+}
+
+// exportar escribe los mensajes en el formato indicado
+func exportar(w io.Writer, formato, sala string, mensajes []*Message) error {
+	switch formato {
+	case formatoJSONL:
+		return exportarJSONL(w, mensajes)
+	case formatoCSV:
+		return exportarCSV(w, mensajes)
+	case formatoTexto:
+		return exportarTexto(w, mensajes)
+	case formatoHTML:
+		return exportarHTML(w, sala, mensajes)
+	}
+	return fmt.Errorf("formato de exportación desconocido: %q (jsonl, csv, txt o html)", formato)
+}
+
+// exportarJSONL escribe un mensaje JSON por línea, con todos sus campos
+func exportarJSONL(w io.Writer, mensajes []*Message) error {
+	encoder := json.NewEncoder(w)
+	for _, message := range mensajes {
+		if err := encoder.Encode(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// celdaCSV neutraliza lo que una hoja de cálculo ejecutaría como fórmula: una celda que
+// empieza por =, +, -, @, tabulador o retorno de carro se escribe precedida de '
+func celdaCSV(valor string) string {
+	if valor != "" && strings.ContainsRune("=+-@\t\r", rune(valor[0])) {
+		return "'" + valor
+	}
+	return valor
+}
+
+// exportarCSV escribe una fila por mensaje. Las imágenes solo constan por su tipo. Las
+// celdas pasan por celdaCSV: el texto lo escriben los usuarios
+func exportarCSV(w io.Writer, mensajes []*Message) error {
+	escritor := csv.NewWriter(w)
+	escritor.Write([]string{"id", "timestamp", "room", "username", "type", "message_content", "imagen_type", "reply_to", "edited_at", "deleted"})
+	for _, message := range mensajes {
+		editado := ""
+		if message.EditedAt != nil {
+			editado = message.EditedAt.Format(time.RFC3339)
+		}
+		fila := []string{
+			message.ID,
+			message.Timestamp.Format(time.RFC3339),
+			message.Room,
+			message.Username,
+			message.Type,
+			message.MessageContent,
+			message.ImagenType,
+			message.ReplyTo,
+			editado,
+			strconv.FormatBool(message.Deleted),
+		}
+		for i, celda := range fila {
+			fila[i] = celdaCSV(celda)
+		}
+		escritor.Write(fila)
+	}
+	escritor.Flush()
+	return escritor.Error()
+}
+
+// lineaTexto da la forma legible de un mensaje, sin la hora
+func lineaTexto(message *Message) string {
+	switch {
+	case message.Deleted:
+		return fmt.Sprintf("%s: [mensaje eliminado]", message.Username)
+	case message.Type == tipoSistema:
+		return "-- " + message.MessageContent
+	case message.Type == tipoAccion:
+		return fmt.Sprintf("* %s %s", message.Username, message.MessageContent)
+	}
+	texto := message.MessageContent
+	if message.ImagenType != "" {
+		texto = strings.TrimSpace(fmt.Sprintf("[imagen %s] %s", message.ImagenType, texto))
+	}
+	if message.EditedAt != nil {
+		texto += " (editado)"
+	}
+	return fmt.Sprintf("%s: %s", message.Username, texto)
+}
+
+// exportarTexto escribe una línea por mensaje con su hora
+func exportarTexto(w io.Writer, mensajes []*Message) error {
+	b := bufio.NewWriter(w)
+	for _, message := range mensajes {
+		fmt.Fprintf(b, "[%s] %s\n", message.Timestamp.Format("2006-01-02 15:04:05"), lineaTexto(message))
+	}
+	return b.Flush()
+}
+
+// plantillaHTML genera un archivo que se ve igual sin conexión: estilos y fotos van dentro
+var plantillaHTML = template.Must(template.New("transcripcion").Parse(`<!DOCTYPE html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<title>Transcripción de {{.Sala}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 800px; margin: 2rem auto; color: #1f2937; }
+.mensaje { margin: 0.4rem 0; }
+.hora { color: #6b7280; font-size: 0.8rem; margin-right: 0.5rem; }
+.sistema { color: #6b7280; font-style: italic; }
+.eliminado { color: #9ca3af; font-style: italic; }
+img { max-width: 320px; display: block; margin-top: 0.3rem; border-radius: 6px; }
+</style>
+</head>
+<body>
+<h1>Transcripción de {{.Sala}}</h1>
+<p>Exportada el {{.Generada}} · {{len .Mensajes}} mensajes</p>
+{{range .Mensajes}}<div class="mensaje{{if .Sistema}} sistema{{end}}{{if .Eliminado}} eliminado{{end}}"><span class="hora">{{.Hora}}</span>{{.Texto}}{{if .Imagen}}<img src="{{.Imagen}}" alt="Imagen de {{.Autor}}">{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+// lineaHTML es un mensaje preparado para la plantilla
+type lineaHTML struct {
+	Hora      string
+	Autor     string
+	Texto     string
+	Imagen    template.URL
+	Sistema   bool
+	Eliminado bool
+}
+
+// exportarHTML escribe una página autocontenida con las imágenes incrustadas
+func exportarHTML(w io.Writer, sala string, mensajes []*Message) error {
+	lineas := make([]lineaHTML, 0, len(mensajes))
+	for _, message := range mensajes {
+		linea := lineaHTML{
+			Hora:      message.Timestamp.Format("2006-01-02 15:04:05"),
+			Autor:     message.Username,
+			Texto:     lineaTexto(message),
+			Sistema:   message.Type == tipoSistema,
+			Eliminado: message.Deleted,
+		}
+		// Solo se incrustan tipos de imagen admitidos, como al recibirlas
+		if message.ImagenData != "" && validarTipoImagen(message.ImagenType) {
+			linea.Imagen = template.URL("data:" + message.ImagenType + ";base64," + message.ImagenData)
+		}
+		lineas = append(lineas, linea)
+	}
+	return plantillaHTML.Execute(w, map[string]interface{}{
+		"Sala":     sala,
+		"Generada": time.Now().Format("2006-01-02 15:04"),
+		"Mensajes": lineas,
+	})
+}
+
+// leerTranscripcion lee un mensaje JSON por línea, como los que escribe exportarJSONL
+func leerTranscripcion(r io.Reader) ([]*Message, error) {
+	lector := bufio.NewScanner(r)
+	lector.Buffer(make([]byte, 0, 64*1024), maxLineaTranscripcion)
+	var mensajes []*Message
+	for numero := 1; lector.Scan(); numero++ {
+		linea := strings.TrimSpace(lector.Text())
+		if linea == "" {
+			continue
+		}
+		var message Message
+		if err := json.Unmarshal([]byte(linea), &message); err != nil {
+			return nil, fmt.Errorf("línea %d: %v", numero, err)
+		}
+		mensajes = append(mensajes, &message)
+	}
+	return mensajes, lector.Err()
+}
+
+// filtroDesdeConsulta lee sala y rango de fechas de los parámetros de una petición
+func filtroDesdeConsulta(sala, desde, hasta string) (FiltroExportacion, error) {
+	filtro := FiltroExportacion{Sala: strings.TrimSpace(sala)}
+	var err error
+	if filtro.Desde, err = leerFecha(desde, false); err != nil {
+		return filtro, err
+	}
+	filtro.Hasta, err = leerFecha(hasta, true)
+	return filtro, err
+}
+
+// ServeExport atiende GET /export?format=jsonl|csv|txt|html&room=...&from=...&to=... y
+// devuelve la transcripción como archivo descargable. Pide una clave del chat
+// (ver autorizarHistorial)
+func ServeExport(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hub.autorizarHistorial(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	formato := q.Get("format")
+	if formato == "" {
+		formato = formatoJSONL
+	}
+	if !formatoValido(formato) {
+		http.Error(w, "Formato no válido: usa jsonl, csv, txt o html.", http.StatusBadRequest)
+		return
+	}
+	filtro, err := filtroDesdeConsulta(q.Get("room"), q.Get("from"), q.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sala := filtro.Sala
+	if sala == "" {
+		sala = hub.sala
+	}
+	w.Header().Set("Content-Type", tiposContenido[formato])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-%s-%s.%s"`,
+		url.PathEscape(sala), time.Now().Format("20060102-150405"), formato))
+	if err := exportar(w, formato, sala, hub.historial.Exportables(filtro)); err != nil {
+		// Las cabeceras ya salieron: solo queda dejar constancia
+		log.Printf("[export] Error exportando la transcripción: %v", err)
+	}
+}
+
+// comandoExportar implementa "chat-app export": descarga la transcripción de un servidor
+// en marcha (el historial vive en su memoria) o convierte una transcripción JSON Lines
+// ya exportada a otro formato
+func comandoExportar(args []string, salida io.Writer) error {
+	banderas := flag.NewFlagSet("export", flag.ContinueOnError)
+	servidor := banderas.String("servidor", "http://localhost:8080", "Servidor del que descargar el historial")
+	token := banderas.String("token", "", "Clave de administración del servidor (ADMIN_SECRET)")
+	entrada := banderas.String("entrada", "", "Transcripción JSON Lines a convertir en lugar de descargarla")
+	formato := banderas.String("formato", formatoJSONL, "Formato: jsonl, csv, txt o html")
+	sala := banderas.String("sala", "", "Exportar solo esta sala")
+	desde := banderas.String("desde", "", "Desde esta fecha (AAAA-MM-DD o RFC 3339)")
+	hasta := banderas.String("hasta", "", "Hasta esta fecha, incluida (AAAA-MM-DD o RFC 3339)")
+	archivo := banderas.String("o", "", "Archivo de salida (por defecto, la salida estándar)")
+	if err := banderas.Parse(args); err != nil {
+		return err
+	}
+	if !formatoValido(*formato) {
+		return fmt.Errorf("formato de exportación desconocido: %q (jsonl, csv, txt o html)", *formato)
+	}
+	filtro, err := filtroDesdeConsulta(*sala, *desde, *hasta)
+	if err != nil {
+		return err
+	}
+
+	var mensajes []*Message
+	if *entrada != "" {
+		f, err := os.Open(*entrada)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		todos, err := leerTranscripcion(f)
+		if err != nil {
+			return err
+		}
+		for _, message := range todos {
+			if filtro.incluye(message) {
+				mensajes = append(mensajes, message)
+			}
+		}
+	} else if mensajes, err = descargarTranscripcion(*servidor, *token, *sala, *desde, *hasta); err != nil {
+		return err
+	}
+
+	if *archivo != "" {
+		f, err := os.Create(*archivo)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		salida = f
+	}
+	nombreSala := *sala
+	if nombreSala == "" && len(mensajes) > 0 {
+		nombreSala = mensajes[0].Room
+	}
+	if nombreSala == "" {
+		nombreSala = salaPorDefecto
+	}
+	return exportar(salida, *formato, nombreSala, mensajes)
+}
+
+// clienteDescarga es el cliente HTTP con el que el subcomando export descarga el historial
+var clienteDescarga = http.DefaultClient
+
+// descargarTranscripcion pide al servidor el historial en JSON Lines
+func descargarTranscripcion(servidor, token, sala, desde, hasta string) ([]*Message, error) {
+	parametros := url.Values{"format": {formatoJSONL}}
+	for clave, valor := range map[string]string{"token": token, "room": sala, "from": desde, "to": hasta} {
+		if valor != "" {
+			parametros.Set(clave, valor)
+		}
+	}
+	respuesta, err := clienteDescarga.Get(strings.TrimRight(servidor, "/") + "/export?" + parametros.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer respuesta.Body.Close()
+	if respuesta.StatusCode != http.StatusOK {
+		detalle, _ := io.ReadAll(io.LimitReader(respuesta.Body, 1024))
+		return nil, errors.New(strings.TrimSpace(fmt.Sprintf("el servidor respondió %s: %s", respuesta.Status, detalle)))
+	}
+	return leerTranscripcion(respuesta.Body)
+}
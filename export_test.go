@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// transcripcionPrueba crea un historial pequeño con todos los tipos de mensaje exportables
+func transcripcionPrueba() []*Message {
+	inicio := time.Date(2024, 5, 14, 9, 0, 0, 0, time.UTC)
+	entrada := NewSystemMessage("ana se ha unido al chat")
+	texto := NewUserMessage("ana", "Orden del día: <script>alert(1)</script>")
+	accion := NewActionMessage("luis", "toma notas")
+	imagen := envioImagen("luis", "pizarra", "aW1hZ2Vu", "image/png")
+	borrado := NewUserMessage("ana", "secreto")
+	borrado.Deleted, borrado.MessageContent = true, ""
+	mensajes := []*Message{entrada, texto, accion, imagen, borrado}
+	for i, message := range mensajes {
+		message.Timestamp = inicio.Add(time.Duration(i) * time.Minute)
+		message.Room = salaPorDefecto
+	}
+	return mensajes
+}
+
+// TestExportarFormatos prueba el contenido de cada formato de exportación
+func TestExportarFormatos(t *testing.T) {
+	mensajes := transcripcionPrueba()
+	salida := func(formato string) string {
+		var b bytes.Buffer
+		if err := exportar(&b, formato, "general", mensajes); err != nil {
+			t.Fatalf("%s: %v", formato, err)
+		}
+		return b.String()
+	}
+
+	// JSON Lines se puede volver a leer sin perder nada
+	leidos, err := leerTranscripcion(strings.NewReader(salida(formatoJSONL)))
+	if err != nil || len(leidos) != len(mensajes) || leidos[3].ImagenData != "aW1hZ2Vu" || !leidos[4].Deleted {
+		t.Errorf("La transcripción JSON Lines no se recupera: %v %+v", err, leidos)
+	}
+
+	filas, err := csv.NewReader(strings.NewReader(salida(formatoCSV))).ReadAll()
+	if err != nil || len(filas) != len(mensajes)+1 || filas[2][3] != "ana" || filas[4][6] != "image/png" {
+		t.Errorf("CSV inesperado: %v %v", err, filas)
+	}
+
+	lineas := strings.Split(strings.TrimSpace(salida(formatoTexto)), "\n")
+	esperadas := []string{
+		"[2024-05-14 09:00:00] -- ana se ha unido al chat",
+		"[2024-05-14 09:02:00] * luis toma notas",
+		"[2024-05-14 09:03:00] luis: [imagen image/png] pizarra",
+		"[2024-05-14 09:04:00] ana: [mensaje eliminado]",
+	}
+	if len(lineas) != 5 || !reflect.DeepEqual([]string{lineas[0], lineas[2], lineas[3], lineas[4]}, esperadas) {
+		t.Errorf("Texto inesperado:\n%s", strings.Join(lineas, "\n"))
+	}
+
+	html := salida(formatoHTML)
+	if !strings.Contains(html, `src="data:image/png;base64,aW1hZ2Vu"`) {
+		t.Error("El HTML debería incrustar la imagen")
+	}
+	if strings.Contains(html, "<script>alert") {
+		t.Error("El HTML debe escapar el contenido de los mensajes")
+	}
+
+	if err := exportar(&bytes.Buffer{}, "pdf", "general", mensajes); err == nil {
+		t.Error("Se esperaba error con un formato desconocido")
+	}
+}
+
+// TestCeldaCSV prueba que el CSV no deja fórmulas que una hoja de cálculo ejecutaría
+func TestCeldaCSV(t *testing.T) {
+	casos := map[string]string{
+		`=HYPERLINK("http://malo")`: `'=HYPERLINK("http://malo")`,
+		"+1+1":                      "'+1+1",
+		"-2":                        "'-2",
+		"@SUM(A1)":                  "'@SUM(A1)",
+		"\t=1":                      "'\t=1",
+		"hola = adiós":              "hola = adiós",
+		"":                          "",
+	}
+	for entrada, esperada := range casos {
+		if obtenida := celdaCSV(entrada); obtenida != esperada {
+			t.Errorf("celdaCSV(%q) = %q, se esperaba %q", entrada, obtenida, esperada)
+		}
+	}
+	var b strings.Builder
+	exportarCSV(&b, []*Message{NewUserMessage("ana", "=1+1")})
+	filas, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil || len(filas) != 2 || filas[1][5] != "'=1+1" {
+		t.Errorf("CSV inesperado: %v %v", err, filas)
+	}
+}
+
+// TestServeExport prueba la descarga HTTP con filtro de fechas
+func TestServeExport(t *testing.T) {
+	hub := NewHub()
+	for _, message := range transcripcionPrueba() {
+		hub.historial.Agregar(message)
+	}
+
+	hub.SetClaveAdmin("secreta")
+
+	respuesta := httptest.NewRecorder()
+	ServeExport(hub, respuesta, httptest.NewRequest(http.MethodGet, "/export?format=txt", nil))
+	if respuesta.Code != http.StatusUnauthorized {
+		t.Errorf("Sin clave se esperaba 401, obtuvimos %d", respuesta.Code)
+	}
+
+	respuesta = httptest.NewRecorder()
+	ServeExport(hub, respuesta, httptest.NewRequest(http.MethodGet, "/export?format=txt&from=2024-05-14T09:01:00Z&to=2024-05-14&token=secreta", nil))
+	if !strings.Contains(respuesta.Header().Get("Content-Disposition"), `filename="chat-general-`) {
+		t.Errorf("Falta el nombre del archivo: %q", respuesta.Header().Get("Content-Disposition"))
+	}
+	if lineas := strings.Split(strings.TrimSpace(respuesta.Body.String()), "\n"); len(lineas) == 0 || strings.Contains(lineas[0], "unido") {
+		t.Errorf("El filtro de fechas no se aplicó:\n%s", respuesta.Body.String())
+	}
+
+	respuesta = httptest.NewRecorder()
+	ServeExport(hub, respuesta, httptest.NewRequest(http.MethodGet, "/export?format=doc&token=secreta", nil))
+	if respuesta.Code != http.StatusBadRequest {
+		t.Errorf("Se esperaba 400, obtuvimos %d", respuesta.Code)
+	}
+}
+
+// transporteHandler responde a las peticiones de un http.Client con un handler, sin
+// abrir ningún puerto
+type transporteHandler http.HandlerFunc
+
+func (h transporteHandler) RoundTrip(r *http.Request) (*http.Response, error) {
+	registro := httptest.NewRecorder()
+	h(registro, r)
+	return registro.Result(), nil
+}
+
+// TestComandoExportar prueba el subcomando contra un servidor y sobre un archivo
+func TestComandoExportar(t *testing.T) {
+	hub := NewHub()
+	for _, message := range transcripcionPrueba() {
+		hub.historial.Agregar(message)
+	}
+	anterior := clienteDescarga
+	clienteDescarga = &http.Client{Transport: transporteHandler(func(w http.ResponseWriter, r *http.Request) {
+		ServeExport(hub, w, r)
+	})}
+	defer func() { clienteDescarga = anterior }()
+
+	dir := t.TempDir()
+	transcripcion := filepath.Join(dir, "general.jsonl")
+	hub.SetClaveAdmin("secreta")
+	if err := comandoExportar([]string{"-servidor", "http://chat.prueba", "-o", transcripcion}, nil); err == nil {
+		t.Error("Sin -token el servidor debería rechazar la descarga")
+	}
+	if err := comandoExportar([]string{"-servidor", "http://chat.prueba", "-token", "secreta", "-o", transcripcion}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var csvSalida bytes.Buffer
+	if err := comandoExportar([]string{"-entrada", transcripcion, "-formato", "csv", "-desde", "2024-05-14T09:02:00+00:00"}, &csvSalida); err != nil {
+		t.Fatal(err)
+	}
+	filas, _ := csv.NewReader(&csvSalida).ReadAll()
+	if len(filas) == 0 || filas[0][0] != "id" {
+		t.Errorf("CSV inesperado: %v", filas)
+	}
+	if _, err := os.Stat(transcripcion); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Difusiones pendientes que admite cada fragmento antes de que quien difunde espere
+const capacidadFragmento = 1024
+
+// fragmento reparte las difusiones a una parte de los clientes desde su propia goroutine.
+// Nunca espera a un cliente: si el canal send de uno está lleno, aplica su política de
+// clientes lentos, así un cliente lento no retrasa a los demás ni al bucle del hub
+type fragmento struct {
+	// Clientes asignados a este fragmento (protegido por clientsMutex del hub)
+	clientes map[*Client]bool
+	entrada  chan *difusion
+}
+
+// difusion es un mensaje camino de los fragmentos
+type difusion struct {
+	message *Message
+	// Aviso para los mencionados en el mensaje, que reciben justo después de él
+	aviso *Message
+	// Orden de la difusión: no se entrega a quien se registró después (ya la tiene en su
+	// historial o, si es efímera, no le interesa)
+	secuencia    uint64
+	excluirAutor bool
+}
+
+// newFragmentos crea n fragmentos vacíos
+func newFragmentos(n int) []*fragmento {
+	fragmentos := make([]*fragmento, n)
+	for i := range fragmentos {
+		fragmentos[i] = &fragmento{
+			clientes: make(map[*Client]bool),
+			entrada:  make(chan *difusion, capacidadFragmento),
+		}
+	}
+	return fragmentos
+}
+
+// SetFragmentos reparte los clientes en n fragmentos (por defecto uno por CPU). Debe llamarse antes de Run
+func (h *Hub) SetFragmentos(n int) error {
+	if n < 1 {
+		return errors.New("hace falta al menos un fragmento")
+	}
+	h.fragmentos = newFragmentos(n)
+	return nil
+}
+
+// numFragmentosPorDefecto usa un fragmento por CPU disponible
+func numFragmentosPorDefecto() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// asignarFragmentoLocked reparte los clientes entre los fragmentos por turnos.
+// Requiere clientsMutex tomado en escritura
+func (h *Hub) asignarFragmentoLocked(client *Client) {
+	f := h.fragmentos[h.siguienteFragmento%len(h.fragmentos)]
+	h.siguienteFragmento++
+	f.clientes[client] = true
+	client.fragmento = f
+	client.registradoEn = h.secuencia.Load()
+}
+
+// repartir entrega las difusiones de un fragmento. Cada fragmento tiene su goroutine, que
+// arranca Run
+func (h *Hub) repartir(f *fragmento) {
+	for d := range f.entrada {
+		h.entregarFragmento(f, d)
+	}
+}
+
+// entregarFragmento envía una difusión a los clientes del fragmento sin bloquear, según
+// la política de cada uno con los lentos. Se hace bajo el lock de lectura para no
+// competir con el cierre de send en cerrarSesionLocked
+func (h *Hub) entregarFragmento(f *fragmento, d *difusion) {
+	var lentos []*Client
+	// Mencionados con alguna sesión que recibió el aviso y con alguna que lo perdió
+	avisados := make(map[string]bool)
+	sinAviso := make(map[string]bool)
+	h.clientsMutex.RLock()
+	for client := range f.clientes {
+		if d.secuencia <= client.registradoEn {
+			continue
+		}
+		nombre := client.nombre()
+		if d.excluirAutor && nombre == d.message.Username {
+			continue
+		}
+		mencionado := d.aviso != nil && nombre != d.message.Username && contieneUsuario(d.message.Mentions, nombre)
+		resultado := h.encolarLocked(client, d.message)
+		if resultado == encolado && mencionado {
+			resultado = h.encolarLocked(client, d.aviso)
+		}
+		if mencionado {
+			if resultado == encolado {
+				avisados[nombre] = true
+			} else {
+				sinAviso[nombre] = true
+			}
+		}
+		if resultado == desbordado {
+			lentos = append(lentos, client)
+		}
+	}
+	h.clientsMutex.RUnlock()
+
+	h.guardarAvisosPerdidos(d, avisados, sinAviso)
+	h.desconectarLentos(lentos)
+}
+
+// guardarAvisosPerdidos deja en el buzón el aviso de mención de quien no lo recibió en
+// ninguna de sus sesiones del fragmento porque su cola estaba llena; así lo recibe al
+// reconectar como si no hubiera estado conectado. Con un mensaje de otro nodo el buzón
+// es cosa del de origen
+func (h *Hub) guardarAvisosPerdidos(d *difusion, avisados, sinAviso map[string]bool) {
+	if len(sinAviso) == 0 || d.message.remoto {
+		return
+	}
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	for nombre := range sinAviso {
+		if !avisados[nombre] {
+			h.guardarEnBuzonLocked(nombre, d.aviso)
+		}
+	}
+}
+
+// difundir pasa una difusión a todos los fragmentos, que la entregan en paralelo. Con
+// esperar, se bloquea si un fragmento va atrasado (los mensajes de la conversación no se
+// pueden perder); sin él, el fragmento atrasado se la salta. No debe llamarse con
+// clientsMutex tomado en escritura: los fragmentos lo necesitan para vaciar su cola
+func (h *Hub) difundir(d *difusion, esperar bool) {
+	// Se serializa aquí una vez en lugar de una vez por destinatario
+	d.message.preparar()
+	d.aviso.preparar()
+	d.secuencia = h.secuencia.Add(1)
+	for _, f := range h.fragmentos {
+		if esperar {
+			f.entrada <- d
+			continue
+		}
+		select {
+		case f.entrada <- d:
+		default:
+		}
+	}
+}
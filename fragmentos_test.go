@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestFragmentoNoEntregaAnterioresAlRegistro prueba que un cliente no recibe difusiones
+// numeradas antes de registrarse, que ya tiene en su historial
+func TestFragmentoNoEntregaAnterioresAlRegistro(t *testing.T) {
+	hub := NewHub()
+	hub.SetFragmentos(1)
+	client := NewClient(hub, nil, "ana")
+	hub.secuencia.Store(5)
+	hub.clientsMutex.Lock()
+	hub.clients[client] = true
+	hub.asignarFragmentoLocked(client)
+	hub.clientsMutex.Unlock()
+
+	anterior := &difusion{message: NewUserMessage("luis", "antes"), secuencia: 5}
+	posterior := &difusion{message: NewUserMessage("luis", "después"), secuencia: 6}
+	hub.entregarFragmento(hub.fragmentos[0], anterior)
+	hub.entregarFragmento(hub.fragmentos[0], posterior)
+	if len(client.send) != 1 || (<-client.send).MessageContent != "después" {
+		t.Error("Solo debería recibirse la difusión posterior al registro")
+	}
+}
+
+// conexionRetenida es la conexión de un cliente que no lee: cualquier escritura espera
+// hasta que se cierra liberar
+type conexionRetenida struct {
+	liberar chan struct{}
+}
+
+func (c *conexionRetenida) ReadMessage() (int, []byte, error) {
+	<-c.liberar
+	return 0, nil, io.EOF
+}
+
+func (c *conexionRetenida) WriteMessage(int, []byte) error {
+	<-c.liberar
+	return nil
+}
+
+func (c *conexionRetenida) NextWriter(tipo int) (io.WriteCloser, error) {
+	return &escritorDiferido{enviar: func(datos []byte) error { return c.WriteMessage(tipo, datos) }}, nil
+}
+
+func (c *conexionRetenida) SetReadDeadline(time.Time) error  { return nil }
+func (c *conexionRetenida) SetWriteDeadline(time.Time) error { return nil }
+func (c *conexionRetenida) Close() error                     { return nil }
+
+// TestClienteLentoNoRetrasaALosDemas prueba que un cliente que no lee se desconecta sin
+// frenar la entrega a los demás: todo llega a luis mientras la conexión del lento sigue
+// bloqueada, y solo después se libera
+func TestClienteLentoNoRetrasaALosDemas(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	conn := &conexionRetenida{liberar: make(chan struct{})}
+	// Caben la foto de conectados, el historial y las entradas de luis y ana, y nada más
+	lento := NewClient(hub, conn, "lento")
+	lento.send = make(chan *Message, 4)
+	hub.register <- lento
+	terminado := make(chan struct{})
+	go func() {
+		lento.goroutineEscritura()
+		close(terminado)
+	}()
+	luis := conectarEnMemoria(t, hub, "luis")
+	ana := conectarEnMemoria(t, hub, "ana")
+	esperarMensaje(t, luis, esPresencia("ana", presenciaEntra))
+
+	for i := 0; i < 20; i++ {
+		enviarTexto(t, ana, fmt.Sprintf("mensaje %d", i))
+	}
+	for i := 0; i < 20; i++ {
+		esperarMensaje(t, luis, contiene(fmt.Sprintf("mensaje %d", i)))
+	}
+	select {
+	case <-terminado:
+		t.Fatal("La conexión del lento no debería haber avanzado")
+	default:
+	}
+
+	// Al liberarlo, entrega lo que tenía en cola y ve que el hub lo dio de baja
+	close(conn.liberar)
+	select {
+	case <-terminado:
+	case <-time.After(2 * time.Second):
+		t.Fatal("El cliente lento debería haberse desconectado")
+	}
+	enviarTexto(t, luis, "/who")
+	if quien := esperarMensaje(t, luis, contiene("Conectados")); quien.MessageContent != "Conectados (2): ana, luis" {
+		t.Errorf("El cliente lento debería haberse desconectado: %q", quien.MessageContent)
+	}
+}
+
+// benchmarkDifusion mide cuánto tarda un mensaje en llegar a todos los clientes. lentos
+// clientes más no leen nunca: no deberían cambiar el resultado
+func benchmarkDifusion(b *testing.B, numClientes, lentos int) {
+	hub := NewHub()
+	go hub.Run()
+	var pendientes atomic.Int64
+	listo := make(chan struct{})
+	// Run registra en orden: cuando el último cliente que lee recibe su foto de
+	// conectados, ya están todos
+	registrados := make(chan struct{})
+	for i := 0; i < lentos; i++ {
+		client := NewClient(hub, nil, "bench")
+		client.verificado = true
+		hub.register <- client
+	}
+	for i := 0; i < numClientes; i++ {
+		// Todas las conexiones son sesiones del mismo usuario, para no difundir n entradas.
+		// Como si presentaran la clave del nombre
+		client := NewClient(hub, nil, "bench")
+		client.verificado = true
+		ultimo := i == numClientes-1
+		go func() {
+			for m := range client.send {
+				if m.Type == tipoRoster && ultimo {
+					close(registrados)
+				}
+				if m.Type == tipoUsuario && pendientes.Add(-1) == 0 {
+					listo <- struct{}{}
+				}
+			}
+		}()
+		hub.register <- client
+	}
+	<-registrados
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pendientes.Store(int64(numClientes))
+		hub.broadcast <- NewUserMessage("autor", "mensaje de prueba")
+		<-listo
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N*numClientes)/b.Elapsed().Seconds(), "entregas/s")
+}
+
+// BenchmarkDifusionFragmentada mide la difusión con 1k y 10k conexiones
+func BenchmarkDifusionFragmentada(b *testing.B) {
+	for _, caso := range []struct {
+		nombre             string
+		conexiones, lentos int
+	}{
+		{"1k", 1000, 0},
+		{"10k", 10000, 0},
+		{"10k_con_100_lentos", 10000, 100},
+	} {
+		b.Run(caso.nombre, func(b *testing.B) {
+			benchmarkDifusion(b, caso.conexiones, caso.lentos)
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Valores por defecto del historial
+const (
+	capacidadHistorialPorDefecto = 500
+	// Mensajes recientes que recibe un cliente al conectarse
+	tamanoReplayPorDefecto = 50
+)
+
+// Historial guarda los últimos mensajes de la sala y la marca de lectura de cada usuario.
+// Guarda copias: los *Message difundidos se comparten entre los clientes y no deben mutarse
+type Historial struct {
+	mu        sync.RWMutex
+	mensajes  []*Message
+	capacidad int
+	// Posición absoluta de cada mensaje guardado; descartados cuenta los que ya salieron
+	// por el principio, así las posiciones no cambian al recortar
+	posiciones  map[string]int
+	descartados int
+	// Último mensaje leído por cada usuario
+	marcadores map[string]string
+	// Mensajes fijados, en el orden en que se fijaron. No se recortan con la capacidad:
+	// un mensaje fijado sigue disponible aunque haya salido de mensajes
+	fijados []*Message
+	// Índice de búsqueda de los mensajes guardados
+	indice *Indice
+}
+
+// NewHistorial crea un historial que conserva como máximo capacidad mensajes
+func NewHistorial(capacidad int) *Historial {
+	if capacidad <= 0 {
+		capacidad = capacidadHistorialPorDefecto
+	}
+	return &Historial{
+		capacidad:  capacidad,
+		posiciones: make(map[string]int),
+		marcadores: make(map[string]string),
+		indice:     NewIndice(),
+	}
+}
+
+// esPersistente indica si un mensaje forma parte de la conversación y se guarda en el historial
+func esPersistente(message *Message) bool {
+	switch message.Type {
+	case tipoUsuario, tipoAccion, tipoSistema:
+		return message.ID != ""
+	}
+	return false
+}
+
+// Agregar guarda una copia del mensaje, descartando los más antiguos si se supera la
+// capacidad. Devuelve false si el mensaje ya estaba guardado
+func (hist *Historial) Agregar(message *Message) bool {
+	copia := message.copia()
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	if _, repetido := hist.posiciones[copia.ID]; repetido {
+		return false
+	}
+	hist.posiciones[copia.ID] = hist.descartados + len(hist.mensajes)
+	hist.mensajes = append(hist.mensajes, copia)
+	if esBuscable(copia) {
+		hist.indice.Agregar(copia)
+	}
+	// Solo llegan ya fijados los mensajes importados de una transcripción
+	if copia.Pinned {
+		hist.fijados = append(hist.fijados, copia)
+	}
+	if raiz := hist.buscarLocked(copia.ReplyTo); raiz != nil {
+		raiz.ReplyCount++
+	}
+	if exceso := len(hist.mensajes) - hist.capacidad; exceso > 0 {
+		for _, viejo := range hist.mensajes[:exceso] {
+			delete(hist.posiciones, viejo.ID)
+			hist.indice.Quitar(viejo.ID)
+		}
+		hist.mensajes = append([]*Message(nil), hist.mensajes[exceso:]...)
+		hist.descartados += exceso
+	}
+	return true
+}
+
+// Recientes devuelve copias de los últimos n mensajes, del más antiguo al más nuevo
+func (hist *Historial) Recientes(n int) []*Message {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	if n > len(hist.mensajes) {
+		n = len(hist.mensajes)
+	}
+	return copiarMensajes(hist.mensajes[len(hist.mensajes)-n:])
+}
+
+// Buscar devuelve una copia del mensaje con ese ID si sigue en el historial
+func (hist *Historial) Buscar(id string) (*Message, bool) {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	message := hist.buscarLocked(id)
+	if message == nil {
+		return nil, false
+	}
+	return message.copia(), true
+}
+
+// buscarLocked devuelve el mensaje guardado (no una copia). Requiere mu tomado
+func (hist *Historial) buscarLocked(id string) *Message {
+	posicion, ok := hist.posiciones[id]
+	if !ok {
+		for _, fijado := range hist.fijados {
+			if fijado.ID == id {
+				return fijado
+			}
+		}
+		return nil
+	}
+	return hist.mensajes[posicion-hist.descartados]
+}
+
+// Hilo devuelve el ID del mensaje raíz del hilo al que pertenece id y copias de la raíz
+// seguida de sus respuestas. Si la raíz ya salió del historial se devuelven solo las respuestas
+func (hist *Historial) Hilo(id string) (string, []*Message, bool) {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	message := hist.buscarLocked(id)
+	if message == nil {
+		return "", nil, false
+	}
+	raiz := message.ID
+	if message.ReplyTo != "" {
+		raiz = message.ReplyTo
+	}
+	var hilo []*Message
+	for _, m := range hist.mensajes {
+		if m.ID == raiz || m.ReplyTo == raiz {
+			hilo = append(hilo, m.copia())
+		}
+	}
+	return raiz, hilo, true
+}
+
+// Editar reemplaza el texto de un mensaje guardado. Devuelve false si ya no está o fue borrado
+func (hist *Historial) Editar(id, contenido string, editadoEn time.Time) bool {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	message := hist.buscarLocked(id)
+	if message == nil || message.Deleted {
+		return false
+	}
+	message.MessageContent = contenido
+	message.EditedAt = &editadoEn
+	if _, guardado := hist.posiciones[id]; guardado {
+		hist.indice.Quitar(id)
+		hist.indice.Agregar(message)
+	}
+	return true
+}
+
+// Borrar marca un mensaje como eliminado y descarta su contenido, imagen incluida.
+// El mensaje sigue en el historial para que las respuestas y marcas de lectura no se pierdan
+func (hist *Historial) Borrar(id string) bool {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	message := hist.buscarLocked(id)
+	if message == nil || message.Deleted {
+		return false
+	}
+	message.Deleted = true
+	message.MessageContent = ""
+	message.ImagenData = ""
+	message.ImagenType = ""
+	message.Reactions = nil
+	hist.desfijarLocked(message)
+	hist.indice.Quitar(id)
+	// Una respuesta borrada deja de contar en su hilo
+	if raiz := hist.buscarLocked(message.ReplyTo); raiz != nil && raiz.ReplyCount > 0 {
+		raiz.ReplyCount--
+	}
+	return true
+}
+
+// Fijar fija o desfija un mensaje guardado, sin pasar de maxFijados. Devuelve false si
+// no cambió nada
+func (hist *Historial) Fijar(id, por string, fijar bool) bool {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	message := hist.buscarLocked(id)
+	if message == nil || message.Deleted || message.Pinned == fijar {
+		return false
+	}
+	if !fijar {
+		hist.desfijarLocked(message)
+		return true
+	}
+	if len(hist.fijados) >= maxFijados {
+		return false
+	}
+	message.Pinned = true
+	message.PinnedBy = por
+	hist.fijados = append(hist.fijados, message)
+	return true
+}
+
+// desfijarLocked quita un mensaje de los fijados. Requiere mu tomado
+func (hist *Historial) desfijarLocked(message *Message) {
+	if !message.Pinned {
+		return
+	}
+	message.Pinned = false
+	message.PinnedBy = ""
+	for i, fijado := range hist.fijados {
+		if fijado == message {
+			hist.fijados = append(hist.fijados[:i:i], hist.fijados[i+1:]...)
+			break
+		}
+	}
+}
+
+// Fijados devuelve copias de los mensajes fijados, en el orden en que se fijaron
+func (hist *Historial) Fijados() []*Message {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	return copiarMensajes(hist.fijados)
+}
+
+// NumFijados devuelve cuántos mensajes hay fijados
+func (hist *Historial) NumFijados() int {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	return len(hist.fijados)
+}
+
+// aplicarAlHistorial refleja en el historial un mensaje difundido: guarda los mensajes
+// de la conversación y aplica los eventos que modifican mensajes anteriores. Devuelve
+// false si el evento ya no cambia nada y no hay que difundirlo: las comprobaciones previas
+// al envío pueden quedar viejas si otro cliente se adelanta
+func (h *Hub) aplicarAlHistorial(message *Message) bool {
+	switch {
+	case esPersistente(message):
+		h.historial.Agregar(message)
+	case message.Type == tipoEditar:
+		h.historial.Editar(message.MessageID, message.MessageContent, *message.EditedAt)
+	case message.Type == tipoBorrar:
+		h.historial.Borrar(message.MessageID)
+	case message.Type == tipoFijar, message.Type == tipoDesfijar:
+		return h.historial.Fijar(message.MessageID, message.Username, message.Type == tipoFijar)
+	case message.Type == tipoReaccionAgregar, message.Type == tipoReaccionQuitar:
+		return h.historial.Reaccionar(message.MessageID, message.Username, message.Emoji, message.Type == tipoReaccionAgregar)
+	case message.Type == tipoPresencia && message.Presence == presenciaRenombrado && message.remoto:
+		// Los renombres locales ya se aplicaron en cambiarNombre
+		h.historial.RenombrarUsuario(message.PreviousUsername, message.Username)
+	}
+	return true
+}
+
+// MarcarLeido mueve la marca de lectura del usuario hasta el mensaje indicado.
+// Solo avanza: devuelve false si el mensaje no existe o es anterior a la marca actual
+func (hist *Historial) MarcarLeido(usuario, id string) bool {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	nueva, ok := hist.posiciones[id]
+	if !ok {
+		return false
+	}
+	if actual, ok := hist.posiciones[hist.marcadores[usuario]]; ok && actual >= nueva {
+		return false
+	}
+	hist.marcadores[usuario] = id
+	return true
+}
+
+// Marcador devuelve el último mensaje leído por el usuario ("" si no hay marca)
+func (hist *Historial) Marcador(usuario string) string {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	return hist.marcadores[usuario]
+}
+
+// Marcadores devuelve una copia de las marcas de lectura de todos los usuarios
+func (hist *Historial) Marcadores() map[string]string {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	marcadores := make(map[string]string, len(hist.marcadores))
+	for usuario, id := range hist.marcadores {
+		marcadores[usuario] = id
+	}
+	return marcadores
+}
+
+// RenombrarUsuario traslada a un usuario que cambió de nombre la autoría de sus mensajes
+// (y de las citas y fijados que los nombran), su marca de lectura y sus reacciones. Sin
+// esto dejaría de poder editar lo suyo y quien tomara el nombre anterior podría hacerlo
+func (hist *Historial) RenombrarUsuario(anterior, nuevo string) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	if id, ok := hist.marcadores[anterior]; ok {
+		delete(hist.marcadores, anterior)
+		hist.marcadores[nuevo] = id
+	}
+	// Los fijados que ya salieron del historial siguen guardados aparte
+	revisados := make(map[*Message]bool, len(hist.mensajes))
+	for _, lista := range [][]*Message{hist.mensajes, hist.fijados} {
+		for _, message := range lista {
+			if revisados[message] {
+				continue
+			}
+			revisados[message] = true
+			if message.Username == anterior {
+				message.Username = nuevo
+				if _, guardado := hist.posiciones[message.ID]; guardado && esBuscable(message) {
+					hist.indice.Quitar(message.ID)
+					hist.indice.Agregar(message)
+				}
+			}
+			if message.Quote != nil && message.Quote.Username == anterior {
+				// Las copias entregadas comparten la cita: se reemplaza en lugar de modificarla
+				cita := *message.Quote
+				cita.Username = nuevo
+				message.Quote = &cita
+			}
+			if message.PinnedBy == anterior {
+				message.PinnedBy = nuevo
+			}
+			for emoji, usuarios := range message.Reactions {
+				for i, u := range usuarios {
+					if u == anterior {
+						usuarios[i] = nuevo
+						sort.Strings(usuarios)
+						message.Reactions[emoji] = usuarios
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// NoLeidos cuenta los mensajes de otros usuarios posteriores a la marca de lectura.
+// Sin marca (o si el mensaje marcado ya salió del historial) cuenta todo el historial
+func (hist *Historial) NoLeidos(usuario string) int {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	desde := 0
+	if posicion, ok := hist.posiciones[hist.marcadores[usuario]]; ok {
+		desde = posicion - hist.descartados + 1
+	}
+	noLeidos := 0
+	for _, message := range hist.mensajes[desde:] {
+		if message.Username != usuario && message.Type != tipoSistema {
+			noLeidos++
+		}
+	}
+	return noLeidos
+}
+
+// copiarMensajes devuelve copias independientes de una lista de mensajes
+func copiarMensajes(mensajes []*Message) []*Message {
+	copias := make([]*Message, len(mensajes))
+	for i, message := range mensajes {
+		copias[i] = message.copia()
+	}
+	return copias
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestHistorialCapacidad prueba que el historial conserva solo los últimos mensajes
+func TestHistorialCapacidad(t *testing.T) {
+	hist := NewHistorial(3)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		message := NewUserMessage("ana", fmt.Sprintf("Mensaje %d", i))
+		ids = append(ids, message.ID)
+		hist.Agregar(message)
+	}
+
+	recientes := hist.Recientes(10)
+	if len(recientes) != 3 {
+		t.Fatalf("Se esperaban 3 mensajes, obtuvimos %d", len(recientes))
+	}
+	if recientes[0].MessageContent != "Mensaje 2" || recientes[2].MessageContent != "Mensaje 4" {
+		t.Errorf("Orden inesperado: %s ... %s", recientes[0].MessageContent, recientes[2].MessageContent)
+	}
+	if _, ok := hist.Buscar(ids[0]); ok {
+		t.Error("El mensaje más antiguo debería haber salido del historial")
+	}
+	if _, ok := hist.Buscar(ids[4]); !ok {
+		t.Error("El mensaje más reciente debería seguir en el historial")
+	}
+
+	// Las copias devueltas no modifican lo guardado
+	recientes[2].MessageContent = "modificado"
+	if guardado, _ := hist.Buscar(ids[4]); guardado.MessageContent != "Mensaje 4" {
+		t.Errorf("El historial se modificó a través de una copia: %s", guardado.MessageContent)
+	}
+}
+
+// TestHistorialMarcasDeLectura prueba que las marcas solo avanzan y el cálculo de no leídos
+func TestHistorialMarcasDeLectura(t *testing.T) {
+	hist := NewHistorial(10)
+	primero := NewUserMessage("ana", "uno")
+	propio := NewUserMessage("luis", "dos")
+	ultimo := NewUserMessage("ana", "tres")
+	for _, message := range []*Message{primero, propio, ultimo} {
+		hist.Agregar(message)
+	}
+
+	if n := hist.NoLeidos("luis"); n != 2 {
+		t.Errorf("Sin marca se esperaban 2 no leídos (los propios no cuentan), obtuvimos %d", n)
+	}
+	if !hist.MarcarLeido("luis", propio.ID) {
+		t.Fatal("Se esperaba poder marcar como leído")
+	}
+	if n := hist.NoLeidos("luis"); n != 1 {
+		t.Errorf("Se esperaba 1 no leído, obtuvimos %d", n)
+	}
+	if hist.MarcarLeido("luis", primero.ID) {
+		t.Error("La marca de lectura no debería retroceder")
+	}
+	if hist.MarcarLeido("luis", "inexistente") {
+		t.Error("No se debería poder marcar un mensaje inexistente")
+	}
+	if hist.Marcador("luis") != propio.ID {
+		t.Errorf("Marca inesperada: %s", hist.Marcador("luis"))
+	}
+}
+
+// TestHistorialYNoLeidosAlReconectar prueba las confirmaciones de lectura de extremo a extremo
+func TestHistorialYNoLeidosAlReconectar(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	enviarTexto(t, ana, "primero")
+	enviarTexto(t, ana, "segundo")
+	esperarMensaje(t, ana, contiene("segundo"))
+
+	// Al conectarse luis recibe el historial con los dos mensajes sin leer
+	luis := conectarEnMemoria(t, hub, "luis")
+	clave := esperarClave(t, luis)
+	historial := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoHistorial })
+	if len(historial.Messages) != 2 || historial.Unread != 2 {
+		t.Fatalf("Se esperaban 2 mensajes sin leer, obtuvimos %d mensajes y %d sin leer",
+			len(historial.Messages), historial.Unread)
+	}
+
+	// luis lee el primero: ana recibe la confirmación
+	leido := historial.Messages[0].ID
+	enviarJSON(t, luis, map[string]interface{}{"type": "read", "message_id": leido})
+	recibo := esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoRecibo })
+	if recibo.Username != "luis" || recibo.MessageID != leido {
+		t.Errorf("Confirmación inesperada: %+v", recibo)
+	}
+
+	// Al reconectar, luis sabe dónde se quedó y cuántos le faltan
+	luis.Close()
+	luis.esperarFin(t)
+	luis = conectarEnMemoria(t, hub, "luis&token="+clave)
+	historial = esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoHistorial })
+	if historial.LastRead != leido || historial.Unread != 1 {
+		t.Errorf("Se esperaba la marca %s y 1 sin leer, obtuvimos %s y %d", leido, historial.LastRead, historial.Unread)
+	}
+	if historial.ReadMarkers["luis"] != leido {
+		t.Errorf("Las marcas de la sala no incluyen la de luis: %v", historial.ReadMarkers)
+	}
+}
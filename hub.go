@@ -1,12 +1,54 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Errores devueltos por las operaciones del hub sobre clientes
+var (
+	errClienteNoRegistrado = errors.New("No estás registrado en el chat.")
+	errNombreEnUso         = errors.New("Este nombre de usuario ya está conectado. Elige otro.")
+	// errNombreOcupado se usa al renombrar: el frontend trata errNombreEnUso como
+	// un rechazo de conexión y cerraría la sesión del usuario que ya está dentro
+	errNombreOcupado = errors.New("Ese nombre ya lo está usando otra persona. Elige otro.")
+	// errNombreReservado: el nombre es de un administrador y no se presentó su clave. Al
+	// renombrar se usa errRenombrarReservado, por lo mismo que errNombreOcupado
+	errNombreReservado    = errors.New("Este nombre de usuario está reservado. Elige otro.")
+	errRenombrarReservado = errors.New("Ese nombre está reservado. Elige otro.")
+	// errNombreNoValido rechaza al conectarse un nombre que el formulario no habría dejado
+	// pasar; el motivo concreto solo se da al renombrar
+	errNombreNoValido = errors.New("Este nombre de usuario no es válido. Elige otro.")
+	// errNombreConocido: al renombrar, el nombre ya lo usó otra persona que ahora no está
+	errNombreConocido = errors.New("Ese nombre ya lo ha usado otra persona. Elige otro.")
+	// errNombreRegistrado: al conectarse, el nombre tiene clave y no se presentó
+	errNombreRegistrado = errors.New("Este nombre de usuario pertenece a otra persona. Elige otro.")
+)
+
+// Políticas para un usuario que abre más de una conexión a la vez
+const (
+	// SesionesMultiples permite varias conexiones (dispositivos) por usuario
+	SesionesMultiples = "multiple"
+	// SesionUnica rechaza una segunda conexión con el mismo nombre
+	SesionUnica = "unica"
+)
+
+// Sala que atiende el hub si no se indica otra
+const salaPorDefecto = "general"
+
+// Códigos de cierre WebSocket que usa el servidor (rango 4000-4999 reservado a aplicaciones)
+const (
+	cierreSesionReemplazada = 4001
+	cierreExpulsado         = 4002
+)
+
 // Hub mantiene el conjunto de clientes activos y difunde mensajes
 type Hub struct {
 	clients      map[*Client]bool
@@ -14,6 +56,78 @@ type Hub struct {
 	register     chan *Client
 	unregister   chan *Client
 	clientsMutex sync.RWMutex
+	// Sesiones abiertas por cada usuario (protegido por clientsMutex).
+	// Un usuario está conectado mientras tenga al menos una sesión
+	sesiones map[string]map[*Client]bool
+	// Política ante conexiones repetidas: SesionesMultiples o SesionUnica
+	politicaSesiones string
+	// Quién puede fijar mensajes: FijadoAdmins o FijadoTodos
+	politicaFijado string
+	// Último estado de presencia publicado de cada usuario conectado (protegido por clientsMutex)
+	presencia map[string]*EstadoPresencia
+	// Sesiones cuya actividad puede haber cambiado el estado de su usuario
+	cambiosPresencia chan *Client
+	// Tiempo sin actividad tras el que un usuario pasa a inactivo y cada cuánto se revisa
+	umbralInactividad  time.Duration
+	intervaloPresencia time.Duration
+	// Indicadores de escritura: eventos de los clientes y caducidad de cada usuario que
+	// está escribiendo. tecleando solo se usa desde Run, así que no necesita lock
+	escribiendo          chan *Message
+	tecleando            map[string]time.Time
+	caducidadEscribiendo time.Duration
+	intervaloEscribiendo time.Duration
+	// Usuarios con permisos de administración y clave con la que demuestran que lo son
+	// (?token=). Sus nombres quedan reservados: nadie más puede usarlos (protegido por
+	// clientsMutex)
+	admins     map[string]bool
+	claveAdmin string
+	// Clave de cada usuario, creada con su primera sesión. Las demás sesiones del nombre
+	// tienen que presentarla (?token=): sin ella recibirían sus mensajes privados y su
+	// buzón (protegido por clientsMutex)
+	claves map[string]string
+	// Nombre actual de quien usaba cada nombre antes de /nick: mientras siga en el chat,
+	// la clave anterior le guarda también el nombre anterior (protegido por clientsMutex)
+	renombres map[string]string
+	// Comandos "/..." disponibles en la sala
+	comandos *Despachador
+	// Mensajes guardados de la sala y cuántos se reenvían a quien se conecta
+	historial    *Historial
+	tamanoReplay int
+	// Nombre de la sala que atiende el hub; se anota en los mensajes de la conversación
+	sala string
+	// Usuarios que se han conectado alguna vez (se pueden mencionar o escribir en privado)
+	// y buzón de mensajes privados y avisos pendientes de cada uno (protegidos por clientsMutex)
+	conocidos map[string]bool
+	buzones   map[string][]*Message
+	// Reparto entre instancias: broker compartido (nil con una sola instancia), nombre de
+	// este nodo, sobres recibidos y pendientes de publicar, IDs ya recibidos (solo desde
+	// Run) y presencia de los demás nodos (protegida por clientsMutex)
+	broker          Broker
+	nodo            string
+	remotos         chan *Sobre
+	salientes       chan *Sobre
+	vistos          *registroVistos
+	presenciaRemota map[string]*nodoRemoto
+	intervaloLatido time.Duration
+	// Nombres apartados en el cluster por este nodo y por los demás, y reservas propias
+	// esperando respuesta (protegidos por clientsMutex)
+	reservasPropias map[string]*reserva
+	reservasRemotas map[string]*reserva
+	consultasNombre map[string]chan bool
+	// Fragmentos que reparten las difusiones, cada uno con su goroutine, turno para
+	// asignar el siguiente cliente (protegido por clientsMutex) y número de la última difusión
+	fragmentos         []*fragmento
+	siguienteFragmento int
+	secuencia          atomic.Uint64
+	// Qué hacer con los clientes lentos: política general, la de cada clase de cliente y
+	// cola en disco de LentoDisco (protegidos por clientsMutex), y lo que se ha hecho con ellos
+	politicaLentos string
+	clasesLentos   map[string]string
+	dirDerrame     string
+	maxDerrame     int64
+	metricasLentos *metricasLentos
+	// Compresión permessage-deflate de los clientes nuevos (protegida por clientsMutex)
+	compresion compresion
 }
 
 // NewHub crea un nuevo hub de chat
@@ -23,12 +137,212 @@ func NewHub() *Hub {
 		broadcast:  make(chan *Message, 256), // Buffer para evitar bloqueos
 		register:   make(chan *Client, 256),
 		unregister: make(chan *Client, 256),
+		sesiones:   make(map[string]map[*Client]bool),
+		presencia:  make(map[string]*EstadoPresencia),
+		admins:     make(map[string]bool),
+		claves:     make(map[string]string),
+		renombres:  make(map[string]string),
+		comandos:   NewDespachador(),
+
+		politicaSesiones:   SesionesMultiples,
+		politicaFijado:     FijadoAdmins,
+		cambiosPresencia:   make(chan *Client, 256),
+		umbralInactividad:  umbralInactividadPorDefecto,
+		intervaloPresencia: intervaloPresenciaPorDefecto,
+
+		escribiendo:          make(chan *Message, 256),
+		tecleando:            make(map[string]time.Time),
+		caducidadEscribiendo: caducidadEscribiendoPorDefecto,
+		intervaloEscribiendo: intervaloEscribiendoPorDefecto,
+
+		historial:    NewHistorial(capacidadHistorialPorDefecto),
+		tamanoReplay: tamanoReplayPorDefecto,
+		sala:         salaPorDefecto,
+
+		conocidos: make(map[string]bool),
+		buzones:   make(map[string][]*Message),
+
+		nodo:            nuevoIDMensaje(),
+		remotos:         make(chan *Sobre, capacidadSobres),
+		salientes:       make(chan *Sobre, capacidadSobres),
+		vistos:          newRegistroVistos(capacidadVistos),
+		presenciaRemota: make(map[string]*nodoRemoto),
+		intervaloLatido: intervaloLatidoPorDefecto,
+		reservasPropias: make(map[string]*reserva),
+		reservasRemotas: make(map[string]*reserva),
+		consultasNombre: make(map[string]chan bool),
+
+		fragmentos: newFragmentos(numFragmentosPorDefecto()),
+
+		politicaLentos: LentoDesconectar,
+		clasesLentos:   make(map[string]string),
+		maxDerrame:     maxDerramePorDefecto,
+		metricasLentos: newMetricasLentos(),
+	}
+}
+
+// SetSala da nombre a la sala que atiende el hub. Debe llamarse antes de Run
+func (h *Hub) SetSala(nombre string) error {
+	nombre = strings.TrimSpace(nombre)
+	if nombre == "" {
+		return errors.New("la sala necesita un nombre")
+	}
+	h.sala = nombre
+	return nil
+}
+
+// SetCapacidadHistorial fija cuántos mensajes conserva la sala. Debe llamarse antes de Run
+func (h *Hub) SetCapacidadHistorial(capacidad int) {
+	h.historial = NewHistorial(capacidad)
+}
+
+// SetPoliticaSesiones elige si un usuario puede conectarse desde varios dispositivos a la vez
+func (h *Hub) SetPoliticaSesiones(politica string) error {
+	if politica != SesionesMultiples && politica != SesionUnica {
+		return fmt.Errorf("política de sesiones desconocida: %q", politica)
+	}
+	h.clientsMutex.Lock()
+	h.politicaSesiones = politica
+	h.clientsMutex.Unlock()
+	return nil
+}
+
+// SetAdmins define los usuarios que pueden usar los comandos de administración
+func (h *Hub) SetAdmins(nombres []string) {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	h.admins = make(map[string]bool)
+	for _, nombre := range nombres {
+		if nombre = strings.TrimSpace(nombre); nombre != "" {
+			h.admins[nombre] = true
+		}
+	}
+}
+
+// SetClaveAdmin fija la clave que presentan los administradores al conectarse. Sin
+// clave nadie puede usar los nombres de administrador
+func (h *Hub) SetClaveAdmin(clave string) {
+	h.clientsMutex.Lock()
+	h.claveAdmin = clave
+	h.clientsMutex.Unlock()
+}
+
+// credencialValida indica si token demuestra que la conexión es del usuario nombre: la
+// clave de administración para un administrador y la clave del usuario para los demás.
+// La clave de administración vale además para cualquier nombre: con ella el operador del
+// servidor reproduce transcripciones (chat-app replay -token) con nombres que ya tienen clave
+func (h *Hub) credencialValida(nombre, token string) bool {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	clave := h.claves[nombre]
+	if h.admins[nombre] {
+		clave = h.claveAdmin
+	}
+	if clave != "" && subtle.ConstantTimeCompare([]byte(token), []byte(clave)) == 1 {
+		return true
+	}
+	return h.claveAdmin != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.claveAdmin)) == 1
+}
+
+// autorizarHistorial comprueba que una petición HTTP que lee el historial (/search,
+// /export) viene de alguien del chat: la clave de administración en ?token= o la clave
+// de un usuario junto a su nombre (?username=&token=). Si no, responde 401 y devuelve false
+func (h *Hub) autorizarHistorial(w http.ResponseWriter, r *http.Request) bool {
+	q := r.URL.Query()
+	token := q.Get("token")
+	h.clientsMutex.RLock()
+	clave := h.claveAdmin
+	h.clientsMutex.RUnlock()
+	if clave != "" && subtle.ConstantTimeCompare([]byte(token), []byte(clave)) == 1 {
+		return true
+	}
+	if h.credencialValida(nombreSolicitado(q), token) {
+		return true
+	}
+	http.Error(w, "Hace falta una clave del chat (?token=).", http.StatusUnauthorized)
+	return false
+}
+
+// asignarClaveLocked crea la clave de un nombre que aún no tiene y la entrega a sus
+// sesiones, que quedan verificadas. Requiere clientsMutex tomado en escritura
+func (h *Hub) asignarClaveLocked(nombre string, sesiones ...*Client) error {
+	clave, err := nuevoTokenSesion()
+	if err != nil {
+		return err
+	}
+	h.claves[nombre] = clave
+	for _, sesion := range sesiones {
+		sesion.verificar()
+		h.enviarAClienteLocked(sesion, NewCredencialMessage(nombre, clave))
+	}
+	return nil
+}
+
+// claveVigenteLocked indica si la clave del nombre sigue protegiendo algo: sesiones
+// abiertas, mensajes en el buzón o, si su dueño se renombró, el nombre que usa ahora.
+// Una clave que ya no protege nada caduca y el nombre queda libre para quien llegue sin
+// ella, como otro dispositivo o un navegador que borró sus datos. Requiere clientsMutex
+// tomado en escritura
+func (h *Hub) claveVigenteLocked(nombre string) bool {
+	if h.claves[nombre] == "" {
+		return false
+	}
+	// Se sigue la cadena de renombres; /nick no deja volver a un nombre conocido, así que
+	// no hay ciclos, pero el límite de saltos lo garantiza
+	actual := nombre
+	for saltos := 0; actual != "" && saltos <= len(h.renombres); saltos++ {
+		if len(h.sesiones[actual]) > 0 || len(h.buzones[actual]) > 0 {
+			return true
+		}
+		actual = h.renombres[actual]
 	}
+	delete(h.claves, nombre)
+	delete(h.renombres, nombre)
+	// Quien llegue con este nombre no guarda los nombres que usó su anterior dueño
+	for anterior, siguiente := range h.renombres {
+		if siguiente == nombre {
+			delete(h.renombres, anterior)
+		}
+	}
+	return false
+}
+
+// nombreReservadoLocked indica si el nombre solo se puede usar con credencial.
+// Requiere clientsMutex tomado
+func (h *Hub) nombreReservadoLocked(nombre string) bool {
+	return esNombreDelSistema(nombre) || h.admins[nombre]
+}
+
+// esAdmin indica si una sesión tiene permisos de administración: el nombre tiene que
+// ser de un administrador y la sesión tiene que haberlo demostrado al conectarse con la
+// clave de administración, que es la única credencial que vale para esos nombres
+func (h *Hub) esAdmin(client *Client) bool {
+	nombre, verificado := client.identidad()
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	return verificado && h.admins[nombre]
 }
 
 // Run ejecuta el bucle principal del hub
 func (h *Hub) Run() {
 	log.Println("Iniciando el nodo principal del chat")
+	for _, f := range h.fragmentos {
+		go h.repartir(f)
+	}
+	// Revisión periódica de inactividad
+	presenciaTicker := time.NewTicker(h.intervaloPresencia)
+	defer presenciaTicker.Stop()
+	// Caducidad de los indicadores de escritura
+	escribiendoTicker := time.NewTicker(h.intervaloEscribiendo)
+	defer escribiendoTicker.Stop()
+	// Latido y caducidad de la presencia de los demás nodos, solo con broker
+	var latido <-chan time.Time
+	if h.broker != nil {
+		latidoTicker := time.NewTicker(h.intervaloLatido)
+		defer latidoTicker.Stop()
+		latido = latidoTicker.C
+		h.iniciarBroker()
+	}
 	for {
 		select {
 		case client := <-h.register:
@@ -42,114 +356,210 @@ func (h *Hub) Run() {
 		case message := <-h.broadcast:
 			// Difundir mensaje a todos los clientes
 			h.broadcastMessage(message)
+
+		case client := <-h.cambiosPresencia:
+			// Una sesión volvió a estar activa o avisó de ausencia
+			h.clientsMutex.Lock()
+			evento := h.actualizarPresenciaLocked(client.nombre(), time.Now())
+			h.clientsMutex.Unlock()
+			if evento != nil {
+				h.broadcastMessage(evento)
+			}
+
+		case <-presenciaTicker.C:
+			h.revisarPresencia()
+
+		case evento := <-h.escribiendo:
+			// Indicadores efímeros: no pasan por broadcastMessage ni por el log
+			h.procesarEscritura(evento)
+
+		case <-escribiendoTicker.C:
+			h.caducarEscritura()
+
+		case sobre := <-h.remotos:
+			// Mensajes y presencia de otros nodos
+			h.recibirSobre(sobre)
+
+		case <-latido:
+			h.caducarNodos()
 		}
 	}
 }
 
-// registerClient registra un nuevo cliente
+// rechazar avisa a un cliente que no llegó a registrarse y cierra su canal send
+func rechazar(client *Client, err error) {
+	go func() {
+		client.send <- NewSystemMessage(err.Error())
+		close(client.send)
+	}()
+}
+
+// registerClient registra una nueva sesión. Con SesionesMultiples un usuario puede tener
+// varias; la entrada a la sala solo se anuncia con la primera
 func (h *Hub) registerClient(client *Client) {
+	nombre, verificado := client.identidad()
+
 	h.clientsMutex.Lock()
-	for c := range h.clients {
-		if c.username == client.username {
-			h.clientsMutex.Unlock()
-			// Enviar mensaje de error y cerrar la conexión
-			go func() {
-				errMsg := NewSystemMessage("Este nombre de usuario ya está conectado. Elige otro.")
-				client.send <- errMsg
-				close(client.send)
-			}()
-			return
+	if err := h.comprobarRegistroLocked(client, nombre, verificado); err != nil {
+		// El nombre se reservó en el cluster al conectarse (comprobarNombreEnCluster) y no
+		// se va a usar: los demás nodos no tienen que esperar a que caduque. Si el nombre
+		// es de una sesión de este nodo, la reserva la sigue cubriendo
+		deEsteNodo := len(h.sesiones[nombre]) > 0
+		h.clientsMutex.Unlock()
+		if !deEsteNodo {
+			h.soltarNombre(nombre)
+		}
+		rechazar(client, err)
+		return
+	}
+	anteriores := h.sesiones[nombre]
+	primeraSesion := len(anteriores) == 0
+
+	// En modo "tomar el control" las sesiones anteriores se cierran sin anunciar la salida
+	if client.tomarControl {
+		for anterior := range anteriores {
+			h.enviarAClienteLocked(anterior, NewSystemMessage("Tu sesión se ha abierto en otro dispositivo."))
+			anterior.fijarCierre(cierreSesionReemplazada, "sesión reemplazada")
+			h.cerrarSesionLocked(anterior)
 		}
 	}
+
 	h.clients[client] = true
+	h.asignarFragmentoLocked(client)
+	if h.sesiones[nombre] == nil {
+		h.sesiones[nombre] = make(map[*Client]bool)
+	}
+	h.sesiones[nombre][client] = true
+	h.conocidos[nombre] = true
+	client.registrarActividad()
+	ahora := time.Now()
+	if primeraSesion {
+		h.presencia[nombre] = &EstadoPresencia{Username: nombre, Status: presenciaActivo, Since: ahora}
+	}
+	// Una sesión nueva puede sacar al usuario de inactivo o ausente
+	cambioEstado := h.actualizarPresenciaLocked(nombre, ahora)
+	// La foto de conectados es lo primero que recibe el cliente, seguida de la clave de un
+	// nombre nuevo y del historial
+	h.enviarAClienteLocked(client, NewRosterMessage(h.rosterLocked()))
+	if !verificado {
+		if err := h.asignarClaveLocked(nombre, client); err != nil {
+			log.Printf("No se pudo crear la clave de %s: %v", nombre, err)
+		}
+	}
+	h.enviarAClienteLocked(client, h.instantaneaHistorial(nombre))
+	h.entregarBuzonLocked(client, nombre)
 	clientCount := len(h.clients)
+	numSesiones := len(h.sesiones[nombre])
 	h.clientsMutex.Unlock()
 
-	log.Printf("Cliente %s conectado. Total de clientes: %d", client.username, clientCount)
-	// Notificar a todos los clientes que alguien se conectó a la sala.
-	systemMessage := NewSystemMessage(fmt.Sprintf("%s se ha conectado", client.username))
-	// Envío asíncrono para evitar bloqueos
-	go func() {
-		select {
-		case h.broadcast <- systemMessage:
-		case <-time.After(time.Second):
-			log.Printf("Timeout enviando mensaje de conexión para %s", client.username)
-		}
-	}()
+	log.Printf("Cliente %s conectado (%d sesiones). Total de clientes: %d", nombre, numSesiones, clientCount)
+	if primeraSesion {
+		// Notificar a todos los clientes que alguien se conectó a la sala.
+		h.difundirAsincrono(NewPresenceMessage(nombre, presenciaEntra))
+	} else if cambioEstado != nil {
+		h.difundirAsincrono(cambioEstado)
+	}
+}
+
+// comprobarRegistroLocked indica por qué una sesión nueva no puede usar el nombre.
+// Requiere clientsMutex tomado en escritura
+func (h *Hub) comprobarRegistroLocked(client *Client, nombre string, verificado bool) error {
+	if h.nombreReservadoLocked(nombre) && !verificado {
+		return errNombreReservado
+	}
+	if validarNombreUsuario(nombre) != nil {
+		return errNombreNoValido
+	}
+	// Con las dos políticas, un nombre conectado en otro nodo del cluster no se puede usar
+	// en este: la clave del nombre solo la conoce su nodo. Tomar el control solo cierra
+	// las sesiones de este nodo
+	enOtroNodo := h.ocupadoEnOtroNodoLocked(nombre, time.Now())
+	if enOtroNodo || (h.politicaSesiones == SesionUnica && len(h.sesiones[nombre]) > 0 && !client.tomarControl) {
+		return errNombreEnUso
+	}
+	// Sin la clave del nombre, la sesión recibiría los mensajes privados y el buzón de otro
+	if !verificado && h.claveVigenteLocked(nombre) {
+		return errNombreRegistrado
+	}
+	return nil
 }
 
-// unregisterClient desregistra un cliente
+// unregisterClient desregistra una sesión; la salida se anuncia al cerrarse la última
 func (h *Hub) unregisterClient(client *Client) {
 	h.clientsMutex.Lock()
 	if _, ok := h.clients[client]; ok {
-		delete(h.clients, client)
-		//Cierre seguro del canal
-		select {
-		case <-client.send:
-		default:
-			close(client.send)
-		}
+		ultimaSesion := h.cerrarSesionLocked(client)
+		// Las sesiones que quedan pueden cambiar el estado del usuario
+		cambioEstado := h.actualizarPresenciaLocked(client.nombre(), time.Now())
 		clientCount := len(h.clients)
 		h.clientsMutex.Unlock()
 
-		log.Printf("Cliente %s desconectado. Total de clientes: %d", client.username, clientCount)
-		// Notificar a todos los clientes que alguien se desconectó
-		systemMessage := NewSystemMessage(fmt.Sprintf("%s se ha desconectado", client.username))
-		//Envío asíncrono
-		go func() {
-			select {
-			case h.broadcast <- systemMessage:
-			case <-time.After(time.Second):
-				log.Printf("Timeout enviando mensaje de desconexión para %s", client.username)
-			}
-		}()
+		log.Printf("Cliente %s desconectado. Total de clientes: %d", client.nombre(), clientCount)
+		if ultimaSesion {
+			// Quien se va deja de escribir
+			h.terminarEscritura(client.nombre())
+			// Notificar a todos los clientes que alguien se desconectó
+			h.difundirAsincrono(NewPresenceMessage(client.nombre(), presenciaSale))
+		} else if cambioEstado != nil {
+			h.difundirAsincrono(cambioEstado)
+		}
 	} else {
 		h.clientsMutex.Unlock()
 	}
 }
 
+// cerrarSesionLocked quita una sesión registrada y cierra su canal send.
+// Devuelve true si era la última sesión del usuario. Requiere clientsMutex tomado
+// y solo debe llamarse desde el bucle del hub, que es quien escribe en los canales send
+func (h *Hub) cerrarSesionLocked(client *Client) bool {
+	nombre := client.nombre()
+	delete(h.clients, client)
+	delete(client.fragmento.clientes, client)
+	delete(h.sesiones[nombre], client)
+	ultima := len(h.sesiones[nombre]) == 0
+	if ultima {
+		delete(h.sesiones, nombre)
+		delete(h.presencia, nombre)
+	}
+	// Solo el hub cierra send y únicamente mientras el cliente está en el mapa,
+	// así que no hay doble cierre. Los mensajes pendientes (por ejemplo el aviso
+	// de /kick) se siguen entregando antes de que la escritura vea el cierre.
+	close(client.send)
+	return ultima
+}
+
 // broadcastMessage difunde un mensaje a todos los clientes conectados
 func (h *Hub) broadcastMessage(message *Message) {
-	h.clientsMutex.RLock()
-	// Se crea una copia de los clientes para evitar problemas de concurrencia
-	copiaClientes := make([]*Client, 0, len(h.clients))
-	for client := range h.clients {
-		copiaClientes = append(copiaClientes, client)
+	// Al enviar el mensaje el autor deja de estar escribiendo
+	if message.Type == tipoUsuario || message.Type == tipoAccion {
+		h.terminarEscritura(message.Username)
 	}
-
-	//subir imagenes. 
-	h.clientsMutex.RUnlock()
-
-	log.Printf("Difundiendo mensaje a %d clientes: [%s] %s",
-		len(copiaClientes), message.Username, message.MessageContent)
-
-	// Lista de clientes que fallan para desconectar después
-	var clientesFallados []*Client
-
-	// Se envia el mensaje a todos los clientes
-	for _, client := range copiaClientes {
-		select {
-		case client.send <- message:
-			log.Printf("Mensaje enviado a %s", client.username)
-		case <-time.After(100 * time.Millisecond):
-			// CORREGIDO: Timeout en lugar de default inmediato
-			log.Printf("Timeout enviando mensaje a %s, marcando para desconexión", client.username)
-			clientesFallados = append(clientesFallados, client)
+	if esPersistente(message) && message.Room == "" {
+		message.Room = h.sala
+	}
+	if !message.remoto {
+		// Las menciones de otro nodo ya vienen detectadas
+		h.detectarMenciones(message)
+	}
+	if !h.aplicarAlHistorial(message) {
+		return
+	}
+	h.publicarMensaje(message)
+	if message.Type == tipoPresencia && !message.remoto {
+		h.publicarPresencia()
+		if h.presenciaCubierta(message) {
+			return
 		}
 	}
 
-	//  Desconectar clientes que fallaron de forma asíncrona
-	if len(clientesFallados) > 0 {
-		go func() {
-			for _, client := range clientesFallados {
-				select {
-				case h.unregister <- client:
-				case <-time.After(time.Second):
-					log.Printf("Timeout desregistrando cliente %s", client.username)
-				}
-			}
-		}()
-	}
+	aviso := h.notificarMenciones(message)
+
+	log.Printf("Difundiendo mensaje a %d clientes en %d fragmentos: [%s] %s",
+		h.GetClientCount(), len(h.fragmentos), message.Username, message.MessageContent)
+
+	// Cada fragmento lo entrega a sus clientes en paralelo y sin esperar a ninguno: los
+	// lentos se desconectan en lugar de retrasar a los demás
+	h.difundir(&difusion{message: message, aviso: aviso}, true)
 }
 
 // GetClientCount retorna el número de clientes conectados
@@ -159,14 +569,174 @@ func (h *Hub) GetClientCount() int {
 	return len(h.clients)
 }
 
-// Metodo para obtener lista de usuarios conectados
+// Metodo para obtener lista de usuarios conectados (una vez por usuario aunque tenga varias sesiones)
 func (h *Hub) GetConnectedClients() []string {
 	h.clientsMutex.RLock()
 	defer h.clientsMutex.RUnlock()
-	usernames := make([]string, 0, len(h.clients))
-	for client := range h.clients {
-		usernames = append(usernames, client.username)
+	usernames := make([]string, 0, len(h.sesiones))
+	for username := range h.sesiones {
+		usernames = append(usernames, username)
 	}
 
 	return usernames
 }
+
+// difundirAsincrono encola un mensaje en broadcast sin bloquear el bucle del hub
+func (h *Hub) difundirAsincrono(message *Message) {
+	go func() {
+		select {
+		case h.broadcast <- message:
+		case <-time.After(time.Second):
+			log.Printf("Timeout difundiendo mensaje de sistema: %s", message.MessageContent)
+		}
+	}()
+}
+
+// enviarACliente entrega un mensaje solo a un cliente registrado, sin bloquear.
+// Se hace bajo el lock de lectura para no competir con el cierre de send en unregisterClient
+func (h *Hub) enviarACliente(client *Client, message *Message) bool {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	return h.enviarAClienteLocked(client, message)
+}
+
+// enviarAClienteLocked es enviarACliente con clientsMutex ya tomado (lectura o escritura)
+func (h *Hub) enviarAClienteLocked(client *Client, message *Message) bool {
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+	switch h.encolarLocked(client, message) {
+	case encolado:
+		return true
+	case desbordado:
+		h.desconectarLentos([]*Client{client})
+	default:
+		log.Printf("Canal de %s lleno, mensaje directo descartado", client.nombre())
+	}
+	return false
+}
+
+// nombreEnUsoLocked indica si algún usuario conectado, a este nodo o a otro del cluster,
+// usa ya el nombre. Debe llamarse con clientsMutex tomado, para que comprobar y asignar sea atómico
+func (h *Hub) nombreEnUsoLocked(nombre string) bool {
+	return len(h.sesiones[nombre]) > 0 || h.ocupadoEnOtroNodoLocked(nombre, time.Now())
+}
+
+// cambiarNombre renombra al usuario del cliente, con todas sus sesiones, si el nuevo
+// nombre es válido y está libre. La comprobación y la asignación ocurren bajo el mismo
+// lock que usa registerClient, así dos usuarios no pueden quedarse con el mismo nombre
+func (h *Hub) cambiarNombre(client *Client, nuevo string) error {
+	nuevo = normalizarNombre(nuevo)
+	if err := validarNombreUsuario(nuevo); err != nil {
+		return err
+	}
+	// Antes de reservar: reservar el nombre propio lo soltaría en los demás nodos
+	if client.nombre() == nuevo {
+		return fmt.Errorf("Ya te llamas %s.", nuevo)
+	}
+	// Con varios nodos, el nombre se aparta en todos antes de comprobarlo aquí
+	if err := h.reservarNombre(nuevo); err != nil {
+		return errNombreOcupado
+	}
+
+	h.clientsMutex.Lock()
+	anterior := client.nombre()
+	if err := h.comprobarRenombreLocked(client, anterior, nuevo); err != nil {
+		// La reserva no se va a usar: los demás nodos no tienen que esperar a que caduque.
+		// Si el nombre es de una sesión de este nodo, la reserva la sigue cubriendo
+		deEsteNodo := len(h.sesiones[nuevo]) > 0
+		h.clientsMutex.Unlock()
+		if !deEsteNodo {
+			h.soltarNombre(nuevo)
+		}
+		return err
+	}
+	sesiones := h.sesiones[anterior]
+	delete(h.sesiones, anterior)
+	h.sesiones[nuevo] = sesiones
+	if estado, ok := h.presencia[anterior]; ok {
+		delete(h.presencia, anterior)
+		estado.Username = nuevo
+		h.presencia[nuevo] = estado
+	}
+	h.historial.RenombrarUsuario(anterior, nuevo)
+	// El nombre anterior sigue siendo conocido y conserva su clave mientras su dueño siga
+	// en el chat: nadie más puede conectarse ni renombrarse con él y hacerse pasar por él
+	h.conocidos[nuevo] = true
+	h.renombres[anterior] = nuevo
+	// Se suma al buzón de nuevo en lugar de reemplazarlo: así nunca se pierde un mensaje
+	for _, message := range h.buzones[anterior] {
+		h.guardarEnBuzonLocked(nuevo, message)
+	}
+	delete(h.buzones, anterior)
+	renombrado := NewPresenceMessage(nuevo, presenciaRenombrado)
+	renombrado.PreviousUsername = anterior
+	// El indicador de escritura sigue al usuario. tecleando solo se toca desde Run, así
+	// que se le pasa por la misma cola que los typing_start, antes de confirmar el nombre
+	select {
+	case h.escribiendo <- renombrado.copia():
+	default:
+	}
+	renombradas := make([]*Client, 0, len(sesiones))
+	for sesion := range sesiones {
+		sesion.asignarNombre(nuevo)
+		// Confirmar a cada sesión su nuevo nombre antes del aviso general
+		h.enviarAClienteLocked(sesion, NewNickMessage(nuevo))
+		renombradas = append(renombradas, sesion)
+	}
+	// El nuevo nombre estrena su clave
+	if err := h.asignarClaveLocked(nuevo, renombradas...); err != nil {
+		log.Printf("No se pudo crear la clave de %s: %v", nuevo, err)
+	}
+	h.clientsMutex.Unlock()
+
+	log.Printf("Cliente %s ahora se llama %s", anterior, nuevo)
+	h.difundirAsincrono(renombrado)
+	return nil
+}
+
+// comprobarRenombreLocked indica por qué el cliente no puede pasar de anterior a nuevo.
+// Requiere clientsMutex tomado
+func (h *Hub) comprobarRenombreLocked(client *Client, anterior, nuevo string) error {
+	if _, ok := h.clients[client]; !ok {
+		return errClienteNoRegistrado
+	}
+	if anterior == nuevo {
+		return fmt.Errorf("Ya te llamas %s.", nuevo)
+	}
+	if h.nombreEnUsoLocked(nuevo) {
+		return errNombreOcupado
+	}
+	// /nick no lleva credencial: los nombres reservados solo se usan al conectarse
+	if h.nombreReservadoLocked(nuevo) {
+		return errRenombrarReservado
+	}
+	// Un nombre que ya usó otra persona tiene su buzón y sus marcas de lectura: quien se
+	// renombrara así heredaría sus mensajes privados
+	if h.conocidos[nuevo] || len(h.buzones[nuevo]) > 0 {
+		return errNombreConocido
+	}
+	return nil
+}
+
+// expulsar desconecta todas las sesiones de un usuario y devuelve cuántas se cerraron.
+// El cierre pasa por unregister para que solo el bucle del hub cierre los canales send
+func (h *Hub) expulsar(objetivo, por string) int {
+	h.clientsMutex.RLock()
+	expulsados := make([]*Client, 0, len(h.sesiones[objetivo]))
+	for client := range h.sesiones[objetivo] {
+		expulsados = append(expulsados, client)
+	}
+	h.clientsMutex.RUnlock()
+
+	for _, client := range expulsados {
+		h.enviarACliente(client, NewSystemMessage(fmt.Sprintf("Has sido expulsado de la sala por %s.", por)))
+		client.fijarCierre(cierreExpulsado, "expulsado")
+		h.unregister <- client
+	}
+	if len(expulsados) > 0 {
+		log.Printf("%s expulsó a %s", por, objetivo)
+		h.difundirAsincrono(NewSystemMessage(fmt.Sprintf("%s fue expulsado por %s", objetivo, por)))
+	}
+	return len(expulsados)
+}
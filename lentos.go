@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Políticas ante un cliente lento, cuyo canal send está lleno
+const (
+	// LentoDesconectar cierra la sesión del cliente (comportamiento por defecto)
+	LentoDesconectar = "desconectar"
+	// LentoDescartarAntiguos tira el mensaje más antiguo de la cola para hacer sitio
+	LentoDescartarAntiguos = "descartar-antiguos"
+	// LentoDescartarNuevos tira el mensaje que no cabe
+	LentoDescartarNuevos = "descartar-nuevos"
+	// LentoDescartarEfimeros quita de la cola los indicadores de escritura, recibos y
+	// presencia; si aun así no cabe, desconecta
+	LentoDescartarEfimeros = "descartar-efimeros"
+	// LentoDisco guarda lo que no cabe en una cola en disco acotada; si se llena, desconecta
+	LentoDisco = "disco"
+)
+
+var politicasLentos = []string{LentoDesconectar, LentoDescartarAntiguos, LentoDescartarNuevos, LentoDescartarEfimeros, LentoDisco}
+
+// Lo que se hace con un cliente lento, tal como aparece en las métricas
+const (
+	accionDescartadoEfimero = "descartado_efimero"
+	accionDescartadoAntiguo = "descartado_antiguo"
+	accionDescartadoNuevo   = "descartado_nuevo"
+	accionPurgado           = "purgado"
+	accionDerramado         = "derramado"
+	accionRecuperado        = "recuperado"
+	accionDesconectado      = "desconectado"
+)
+
+var accionesLentos = []string{accionDescartadoEfimero, accionDescartadoAntiguo, accionDescartadoNuevo, accionPurgado, accionDerramado, accionRecuperado, accionDesconectado}
+
+// Resultado de poner un mensaje en la cola de un cliente
+type resultadoEnvio int
+
+const (
+	// encolado: el cliente lo recibirá (desde el canal o desde su cola en disco)
+	encolado resultadoEnvio = iota
+	// descartado: la política decidió perderlo y el cliente sigue conectado
+	descartado
+	// desbordado: no cabe y hay que desconectar al cliente
+	desbordado
+)
+
+// metricasLentos cuenta, por política y acción, lo que se ha hecho con los clientes
+// lentos. El mapa no cambia tras crearse; los contadores son atómicos
+type metricasLentos struct {
+	contadores map[string]map[string]*atomic.Uint64
+}
+
+func newMetricasLentos() *metricasLentos {
+	m := &metricasLentos{contadores: make(map[string]map[string]*atomic.Uint64)}
+	for _, politica := range politicasLentos {
+		m.contadores[politica] = make(map[string]*atomic.Uint64)
+		for _, accion := range accionesLentos {
+			m.contadores[politica][accion] = new(atomic.Uint64)
+		}
+	}
+	return m
+}
+
+// sumar anota n acciones de una política
+func (m *metricasLentos) sumar(politica, accion string, n int) {
+	m.contadores[politica][accion].Add(uint64(n))
+}
+
+// valor devuelve el contador de una política y acción
+func (m *metricasLentos) valor(politica, accion string) uint64 {
+	return m.contadores[politica][accion].Load()
+}
+
+// esPoliticaLentos indica si la política existe
+func esPoliticaLentos(politica string) bool {
+	for _, p := range politicasLentos {
+		if p == politica {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPoliticaLentos elige qué hacer con los clientes lentos que no tienen una clase propia
+func (h *Hub) SetPoliticaLentos(politica string) error {
+	if !esPoliticaLentos(politica) {
+		return fmt.Errorf("política de clientes lentos desconocida: %q", politica)
+	}
+	h.clientsMutex.Lock()
+	h.politicaLentos = politica
+	h.clientsMutex.Unlock()
+	return nil
+}
+
+// SetClaseLentos asigna una política a una clase de clientes, que la eligen al
+// conectarse con ?clase= (por ejemplo "movil")
+func (h *Hub) SetClaseLentos(clase, politica string) error {
+	if clase == "" {
+		return fmt.Errorf("clase de cliente vacía")
+	}
+	if !esPoliticaLentos(politica) {
+		return fmt.Errorf("política de clientes lentos desconocida: %q", politica)
+	}
+	h.clientsMutex.Lock()
+	h.clasesLentos[clase] = politica
+	h.clientsMutex.Unlock()
+	return nil
+}
+
+// SetDerrame configura la cola en disco de LentoDisco: directorio (vacío para el
+// temporal del sistema) y bytes máximos por cliente
+func (h *Hub) SetDerrame(dir string, max int64) error {
+	if max <= 0 {
+		return fmt.Errorf("el tamaño de la cola en disco tiene que ser positivo")
+	}
+	h.clientsMutex.Lock()
+	h.dirDerrame, h.maxDerrame = dir, max
+	h.clientsMutex.Unlock()
+	return nil
+}
+
+// politicaDeClase devuelve la política de una clase de clientes, o "" si la clase no
+// tiene una propia y se le aplica la general
+func (h *Hub) politicaDeClase(clase string) string {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	if politica, ok := h.clasesLentos[clase]; ok {
+		return politica
+	}
+	return ""
+}
+
+// esPrescindible indica si un mensaje se puede perder sin que el cliente se entere de
+// nada importante: los efímeros y los cambios de presencia, que el siguiente corrige
+func esPrescindible(message *Message) bool {
+	return esEfimero(message) || message.Type == tipoPresencia
+}
+
+// politicaLocked devuelve la política que se aplica al cliente. Requiere clientsMutex tomado
+func (h *Hub) politicaLocked(client *Client) string {
+	if client.politicaLenta != "" {
+		return client.politicaLenta
+	}
+	return h.politicaLentos
+}
+
+// encolarLocked pone un mensaje en la cola del cliente sin bloquear y, si no cabe,
+// aplica su política. Se llama con clientsMutex tomado (lectura o escritura), que
+// impide que se cierre send mientras tanto; colaMu ordena a quienes encolan a la vez
+func (h *Hub) encolarLocked(client *Client, message *Message) resultadoEnvio {
+	client.colaMu.Lock()
+	defer client.colaMu.Unlock()
+	politica := h.politicaLocked(client)
+
+	// Mientras queden mensajes derramados, los nuevos van detrás para no desordenarlos
+	if client.derramados > 0 {
+		return h.derramarLocked(client, politica, message)
+	}
+	select {
+	case client.send <- message:
+		return encolado
+	default:
+	}
+
+	// Con la cola llena, lo prescindible se pierde con cualquier política
+	if esPrescindible(message) {
+		h.metricasLentos.sumar(politica, accionDescartadoEfimero, 1)
+		return descartado
+	}
+	switch politica {
+	case LentoDescartarAntiguos:
+		// Quien encola tiene colaMu y la goroutine de escritura solo saca: tras sacar uno, cabe
+		select {
+		case <-client.send:
+			h.metricasLentos.sumar(politica, accionDescartadoAntiguo, 1)
+		default:
+		}
+		client.send <- message
+		return encolado
+	case LentoDescartarNuevos:
+		h.metricasLentos.sumar(politica, accionDescartadoNuevo, 1)
+		return descartado
+	case LentoDescartarEfimeros:
+		h.metricasLentos.sumar(politica, accionPurgado, purgarPrescindibles(client.send))
+		select {
+		case client.send <- message:
+			return encolado
+		default:
+		}
+	case LentoDisco:
+		return h.derramarLocked(client, politica, message)
+	}
+	h.metricasLentos.sumar(politica, accionDesconectado, 1)
+	return desbordado
+}
+
+// purgarPrescindibles quita de la cola los mensajes prescindibles y deja los demás en
+// el mismo orden. Devuelve cuántos quitó. Requiere colaMu del cliente tomado
+func purgarPrescindibles(send chan *Message) int {
+	var quedan []*Message
+	purgados := 0
+	for vaciar := true; vaciar; {
+		select {
+		case m := <-send:
+			if esPrescindible(m) {
+				purgados++
+			} else {
+				quedan = append(quedan, m)
+			}
+		default:
+			vaciar = false
+		}
+	}
+	for _, m := range quedan {
+		send <- m
+	}
+	return purgados
+}
+
+// derramarLocked deja el mensaje para la cola en disco del cliente. Se escribe desde la
+// goroutine de derrame del cliente, que se crea con el primero: con clientsMutex tomado
+// un disco lento retrasaría a todos los clientes del fragmento. Requiere colaMu del
+// cliente tomado
+func (h *Hub) derramarLocked(client *Client, politica string, message *Message) resultadoEnvio {
+	if client.derrameCerrado {
+		return descartado
+	}
+	// Si el disco no da abasto, la espera en memoria también está acotada
+	if len(client.porDerramar) >= maxPorDerramar {
+		h.metricasLentos.sumar(politica, accionDesconectado, 1)
+		return desbordado
+	}
+	client.porDerramar = append(client.porDerramar, message)
+	client.derramados++
+	if client.avisoDerrame == nil {
+		client.avisoDerrame = make(chan struct{}, 1)
+		go client.goroutineDerrame(client.avisoDerrame, h.dirDerrame, h.maxDerrame)
+	}
+	select {
+	case client.avisoDerrame <- struct{}{}:
+	default:
+	}
+	h.metricasLentos.sumar(politica, accionDerramado, 1)
+	return encolado
+}
+
+// goroutineDerrame escribe en disco lo que va derramando el cliente hasta que termina
+// la sesión
+func (c *Client) goroutineDerrame(aviso <-chan struct{}, dir string, max int64) {
+	for range aviso {
+		c.volcarDerrame(dir, max)
+	}
+}
+
+// volcarDerrame pasa a la cola en disco, creándola si hace falta, los mensajes que
+// esperan en memoria. Si no caben o no se pueden escribir, se desconecta al cliente
+func (c *Client) volcarDerrame(dir string, max int64) {
+	c.derrameMu.Lock()
+	defer c.derrameMu.Unlock()
+	c.colaMu.Lock()
+	lote, cerrado := c.porDerramar, c.derrameCerrado
+	c.porDerramar = nil
+	c.colaMu.Unlock()
+	if cerrado || len(lote) == 0 {
+		return
+	}
+	if c.derrame == nil {
+		derrame, err := newColaDisco(dir, max)
+		if err != nil {
+			c.fallarDerrameLocked(fmt.Errorf("no se pudo crear: %w", err))
+			return
+		}
+		c.derrame = derrame
+	}
+	for _, message := range lote {
+		if err := c.derrame.guardar(message); err != nil {
+			c.fallarDerrameLocked(err)
+			return
+		}
+	}
+}
+
+// siguienteDerramado saca el siguiente mensaje derramado, pero solo cuando el canal send
+// está vacío: lo que hay en el canal es anterior. Lo que está en disco es anterior a lo
+// que aún espera en memoria, que sale directamente si el disco está vacío
+func (c *Client) siguienteDerramado() *Message {
+	c.derrameMu.Lock()
+	defer c.derrameMu.Unlock()
+	c.colaMu.Lock()
+	if c.derramados == 0 || c.derrameCerrado || len(c.send) > 0 {
+		c.colaMu.Unlock()
+		return nil
+	}
+	if c.derrame == nil || c.derrame.pendientes == 0 {
+		message := c.porDerramar[0]
+		c.porDerramar = c.porDerramar[1:]
+		c.derramados--
+		c.colaMu.Unlock()
+		c.hub.metricasLentos.sumar(LentoDisco, accionRecuperado, 1)
+		return message
+	}
+	c.colaMu.Unlock()
+	message, err := c.derrame.sacar()
+	if err != nil {
+		c.fallarDerrameLocked(fmt.Errorf("error de lectura: %w", err))
+		return nil
+	}
+	c.colaMu.Lock()
+	c.derramados--
+	c.colaMu.Unlock()
+	c.hub.metricasLentos.sumar(LentoDisco, accionRecuperado, 1)
+	return message
+}
+
+// fallarDerrameLocked cierra una cola en disco que no se puede usar: el cliente ya no
+// recibiría lo que falta en orden, así que se le desconecta como a un cliente desbordado.
+// Lo que llegue después se descarta. Requiere derrameMu tomado
+func (c *Client) fallarDerrameLocked(err error) {
+	log.Printf("Cola en disco de %s: %v", c.nombre(), err)
+	if c.derrame != nil {
+		c.derrame.cerrar()
+		c.derrame = nil
+	}
+	c.colaMu.Lock()
+	c.derrameCerrado = true
+	c.porDerramar = nil
+	c.colaMu.Unlock()
+	c.hub.metricasLentos.sumar(LentoDisco, accionDesconectado, 1)
+	c.hub.desconectarLentos([]*Client{c})
+}
+
+// cerrarDerrame borra la cola en disco al terminar la sesión y para su goroutine
+func (c *Client) cerrarDerrame() {
+	c.derrameMu.Lock()
+	defer c.derrameMu.Unlock()
+	c.colaMu.Lock()
+	if c.avisoDerrame != nil {
+		close(c.avisoDerrame)
+		c.avisoDerrame = nil
+	}
+	c.derrameCerrado = true
+	c.porDerramar = nil
+	c.colaMu.Unlock()
+	if c.derrame != nil {
+		c.derrame.cerrar()
+		c.derrame = nil
+	}
+}
+
+// desconectarLentos da de baja, de forma asíncrona, a los clientes que no dan abasto.
+// No se puede hacer con clientsMutex tomado: unregister lo necesita
+func (h *Hub) desconectarLentos(lentos []*Client) {
+	if len(lentos) == 0 {
+		return
+	}
+	go func() {
+		for _, client := range lentos {
+			log.Printf("Canal de %s lleno, desconectando cliente lento", client.nombre())
+			select {
+			case h.unregister <- client:
+			case <-time.After(time.Second):
+				log.Printf("Timeout desregistrando cliente %s", client.nombre())
+			}
+		}
+	}()
+}
+
+// ServeMetricas publica los contadores de clientes lentos en el formato de texto de Prometheus
+func ServeMetricas(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP chat_clientes_lentos_total Mensajes y sesiones afectados por la política de clientes lentos.")
+	fmt.Fprintln(w, "# TYPE chat_clientes_lentos_total counter")
+	politicas := append([]string(nil), politicasLentos...)
+	sort.Strings(politicas)
+	for _, politica := range politicas {
+		for _, accion := range accionesLentos {
+			fmt.Fprintf(w, "chat_clientes_lentos_total{politica=%q,accion=%q} %d\n", politica, accion, hub.metricasLentos.valor(politica, accion))
+		}
+	}
+}
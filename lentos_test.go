@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clienteLentoPrueba registra en el hub, sin conexión, un cliente con una cola de
+// capacidad mensajes y la política indicada
+func clienteLentoPrueba(hub *Hub, capacidad int, politica string) *Client {
+	client := &Client{hub: hub, send: make(chan *Message, capacidad), username: "lento", politicaLenta: politica}
+	hub.clientsMutex.Lock()
+	hub.clients[client] = true
+	hub.clientsMutex.Unlock()
+	return client
+}
+
+// contenidos vacía la cola del cliente y devuelve el tipo o texto de cada mensaje
+func contenidos(client *Client) []string {
+	var lista []string
+	for len(client.send) > 0 {
+		m := <-client.send
+		if m.Type == tipoUsuario {
+			lista = append(lista, m.MessageContent)
+		} else {
+			lista = append(lista, m.Type)
+		}
+	}
+	return lista
+}
+
+// TestPoliticasLentos prueba qué hace cada política cuando la cola está llena
+func TestPoliticasLentos(t *testing.T) {
+	casos := []struct {
+		politica  string
+		resultado resultadoEnvio
+		cola      string
+		accion    string
+	}{
+		{LentoDesconectar, desbordado, "typing_start,uno", accionDesconectado},
+		{LentoDescartarAntiguos, encolado, "uno,dos", accionDescartadoAntiguo},
+		{LentoDescartarNuevos, descartado, "typing_start,uno", accionDescartadoNuevo},
+		{LentoDescartarEfimeros, encolado, "uno,dos", accionPurgado},
+	}
+	for _, caso := range casos {
+		t.Run(caso.politica, func(t *testing.T) {
+			hub := NewHub()
+			client := clienteLentoPrueba(hub, 2, caso.politica)
+			client.send <- NewTypingMessage("ana", tipoEscribiendo)
+			client.send <- NewUserMessage("ana", "uno")
+
+			// Lo prescindible no cabe, pero no cuenta como lentitud
+			if r := hub.enviarACliente(client, NewTypingMessage("luis", tipoEscribiendo)); r {
+				t.Error("Un evento efímero no debería caber en la cola llena")
+			}
+			if n := hub.metricasLentos.valor(caso.politica, accionDescartadoEfimero); n != 1 {
+				t.Errorf("Efímeros descartados = %d, se esperaba 1", n)
+			}
+
+			hub.clientsMutex.RLock()
+			resultado := hub.encolarLocked(client, NewUserMessage("ana", "dos"))
+			hub.clientsMutex.RUnlock()
+			if resultado != caso.resultado {
+				t.Errorf("Resultado = %d, se esperaba %d", resultado, caso.resultado)
+			}
+			if cola := strings.Join(contenidos(client), ","); cola != caso.cola {
+				t.Errorf("Cola = %s, se esperaba %s", cola, caso.cola)
+			}
+			if n := hub.metricasLentos.valor(caso.politica, caso.accion); n != 1 {
+				t.Errorf("%s = %d, se esperaba 1", caso.accion, n)
+			}
+		})
+	}
+}
+
+// TestDescartarEfimerosSinEfimerosDesconecta prueba que, si no hay nada prescindible que
+// quitar, descartar-efimeros desconecta
+func TestDescartarEfimerosSinEfimerosDesconecta(t *testing.T) {
+	hub := NewHub()
+	client := clienteLentoPrueba(hub, 1, LentoDescartarEfimeros)
+	client.send <- NewUserMessage("ana", "uno")
+	hub.clientsMutex.RLock()
+	defer hub.clientsMutex.RUnlock()
+	if r := hub.encolarLocked(client, NewUserMessage("ana", "dos")); r != desbordado {
+		t.Errorf("Resultado = %d, se esperaba desbordado", r)
+	}
+}
+
+// TestDerrameConservaElOrden prueba que lo que no cabe va a disco y sale detrás de lo
+// que ya estaba en el canal, en orden
+func TestDerrameConservaElOrden(t *testing.T) {
+	hub := NewHub()
+	hub.SetDerrame(t.TempDir(), maxDerramePorDefecto)
+	client := clienteLentoPrueba(hub, 1, LentoDisco)
+	for _, texto := range []string{"uno", "dos", "tres"} {
+		if !hub.enviarACliente(client, NewUserMessage("ana", texto)) {
+			t.Fatalf("No se encoló %q", texto)
+		}
+	}
+	// Como la goroutine de derrame, que puede haberlo hecho ya
+	client.volcarDerrame(hub.dirDerrame, hub.maxDerrame)
+	client.derrameMu.Lock()
+	enDisco := client.derrame != nil && client.derrame.pendientes == 2
+	client.derrameMu.Unlock()
+	if !enDisco {
+		t.Fatal("Deberían haberse guardado dos mensajes en disco")
+	}
+
+	// Como la goroutine de escritura: primero el canal y, vacío, el disco
+	var recibidos []string
+	if client.siguienteDerramado() != nil {
+		t.Error("No debería salir nada del disco mientras quede algo en el canal")
+	}
+	recibidos = append(recibidos, (<-client.send).MessageContent)
+	for m := client.siguienteDerramado(); m != nil; m = client.siguienteDerramado() {
+		recibidos = append(recibidos, m.MessageContent)
+	}
+	if got := strings.Join(recibidos, ","); got != "uno,dos,tres" {
+		t.Errorf("Orden = %s", got)
+	}
+	if n := hub.metricasLentos.valor(LentoDisco, accionRecuperado); n != 2 {
+		t.Errorf("Recuperados = %d, se esperaba 2", n)
+	}
+
+	// Vacía la cola en disco, lo siguiente vuelve al canal
+	hub.enviarACliente(client, NewUserMessage("ana", "cuatro"))
+	if len(client.send) != 1 {
+		t.Error("Con el disco vacío el mensaje debería ir al canal")
+	}
+	archivo := client.derrame.archivo.Name()
+	client.cerrarDerrame()
+	if _, err := os.Stat(archivo); !os.IsNotExist(err) {
+		t.Error("La cola en disco debería borrarse al cerrar la sesión")
+	}
+}
+
+// TestDerrameLlenoDesconecta prueba que la cola en disco está acotada: lo que no cabe
+// desconecta al cliente desde la goroutine de derrame
+func TestDerrameLlenoDesconecta(t *testing.T) {
+	hub := NewHub()
+	hub.SetDerrame(t.TempDir(), 200)
+	client := clienteLentoPrueba(hub, 1, LentoDisco)
+	defer client.cerrarDerrame()
+	for i := 0; i < 3; i++ {
+		hub.enviarACliente(client, NewUserMessage("ana", "un mensaje de relleno"))
+	}
+	select {
+	case desconectado := <-hub.unregister:
+		if desconectado != client {
+			t.Error("Se desconectó otro cliente")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Con la cola en disco llena el cliente debería desconectarse")
+	}
+	if hub.metricasLentos.valor(LentoDisco, accionDesconectado) != 1 {
+		t.Error("Debería contarse la desconexión")
+	}
+}
+
+// TestDerrameNoRetieneElLock prueba que encolar para un cliente con LentoDisco no espera
+// al disco: con la escritura en disco bloqueada, encolar sigue respondiendo
+func TestDerrameNoRetieneElLock(t *testing.T) {
+	hub := NewHub()
+	hub.SetDerrame(t.TempDir(), maxDerramePorDefecto)
+	client := clienteLentoPrueba(hub, 1, LentoDisco)
+	defer client.cerrarDerrame()
+	// Mientras se tenga derrameMu, la goroutine de derrame no puede escribir
+	client.derrameMu.Lock()
+	encolados := make(chan int)
+	go func() {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if hub.enviarACliente(client, NewUserMessage("ana", fmt.Sprintf("m%d", i))) {
+				n++
+			}
+		}
+		encolados <- n
+	}()
+	select {
+	case n := <-encolados:
+		if n != 10 {
+			t.Errorf("Se encolaron %d mensajes, se esperaban 10", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Encolar esperó a la escritura en disco")
+	}
+	client.derrameMu.Unlock()
+}
+
+// TestDerrameCompacta prueba que el límite es de lo pendiente: una cola que se lee a la
+// vez que se escribe no se llena aunque escriba mucho más que el máximo
+func TestDerrameCompacta(t *testing.T) {
+	cola, err := newColaDisco(t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cola.cerrar()
+	var esperados []string
+	for i := 0; i < 50; i++ {
+		// Entran dos y sale uno hasta tener unos cuantos pendientes; luego uno y uno
+		entran := 1
+		if i < 3 {
+			entran = 2
+		}
+		for j := 0; j < entran; j++ {
+			texto := fmt.Sprintf("m%d-%d", i, j)
+			if err := cola.guardar(NewUserMessage("ana", texto)); err != nil {
+				t.Fatalf("Vuelta %d: %v", i, err)
+			}
+			esperados = append(esperados, texto)
+		}
+		m, err := cola.sacar()
+		if err != nil || m.MessageContent != esperados[0] {
+			t.Fatalf("Vuelta %d: se esperaba %s, obtuvimos %v %v", i, esperados[0], m, err)
+		}
+		esperados = esperados[1:]
+		if info, _ := cola.archivo.Stat(); info.Size() > cola.max {
+			t.Fatalf("El archivo ocupa %d bytes, más que el máximo", info.Size())
+		}
+	}
+}
+
+// TestDerrameIlegibleDesconecta prueba que si la cola en disco no se puede leer se
+// cierra y el cliente se desconecta, en lugar de quedarse sin recibir nada
+func TestDerrameIlegibleDesconecta(t *testing.T) {
+	hub := NewHub()
+	hub.SetDerrame(t.TempDir(), maxDerramePorDefecto)
+	client := clienteLentoPrueba(hub, 1, LentoDisco)
+	for _, texto := range []string{"uno", "dos"} {
+		hub.enviarACliente(client, NewUserMessage("ana", texto))
+	}
+	<-client.send
+	client.volcarDerrame(hub.dirDerrame, hub.maxDerrame)
+	client.derrameMu.Lock()
+	client.derrame.archivo.Truncate(0)
+	client.derrameMu.Unlock()
+
+	if client.siguienteDerramado() != nil {
+		t.Error("No debería salir nada de una cola ilegible")
+	}
+	if client.derrame != nil || !client.derrameCerrado {
+		t.Error("La cola en disco debería cerrarse")
+	}
+	select {
+	case desconectado := <-hub.unregister:
+		if desconectado != client {
+			t.Error("Se desconectó otro cliente")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("El cliente debería desconectarse")
+	}
+}
+
+// TestClaseLentosYMetricas prueba la política por clase de cliente y el endpoint de métricas
+func TestClaseLentosYMetricas(t *testing.T) {
+	hub := NewHub()
+	if err := hub.SetPoliticaLentos("ignorar"); err == nil {
+		t.Error("Una política desconocida debería rechazarse")
+	}
+	if err := hub.SetClaseLentos("movil", LentoDescartarEfimeros); err != nil {
+		t.Fatal(err)
+	}
+	if p := hub.politicaDeClase("movil"); p != LentoDescartarEfimeros {
+		t.Errorf("Política de movil = %q", p)
+	}
+	if p := hub.politicaDeClase("web"); p != "" {
+		t.Errorf("Una clase sin política propia usa la general, no %q", p)
+	}
+
+	client := clienteLentoPrueba(hub, 0, "")
+	hub.enviarACliente(client, NewUserMessage("ana", "hola"))
+	registro := httptest.NewRecorder()
+	ServeMetricas(hub, registro, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(registro.Body.String(), `chat_clientes_lentos_total{politica="desconectar",accion="desconectado"} 1`) {
+		t.Errorf("Métricas inesperadas:\n%s", registro.Body.String())
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+// Mensajes que se agrupan como máximo en un mismo frame
+const maxLote = 64
+
+// juntarLote añade al lote los mensajes que ya esperan en send, sin bloquear y hasta
+// maxLote. Devuelve también si send se cerró mientras tanto
+func (c *Client) juntarLote(lote []*Message) ([]*Message, bool) {
+	for len(lote) < maxLote {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return lote, true
+			}
+			lote = append(lote, message)
+		default:
+			return lote, false
+		}
+	}
+	return lote, false
+}
+
+// escribirLote envía varios mensajes en un solo frame, como un array en el codec del
+// cliente que se va escribiendo con NextWriter. Un mensaje suelto se envía tal cual,
+// sin array
+func (c *Client) escribirLote(lote []*Message) error {
+	if len(lote) == 1 {
+		return c.escribirMensaje(lote[0])
+	}
+	// Las difusiones ya vienen serializadas; el resto se codifica aquí
+	partes := make([][]byte, len(lote))
+	tamano, conImagen := len(lote)+1, false
+	for i, message := range lote {
+		datos, err := message.codificarCon(c.codec)
+		if err != nil {
+			return err
+		}
+		partes[i] = datos
+		tamano += len(datos)
+		conImagen = conImagen || message.tieneImagen()
+	}
+	c.ajustarCompresion(tamano, conImagen)
+
+	w, err := c.conn.NextWriter(c.codec.tipoFrame)
+	if err != nil {
+		return err
+	}
+	// En JSON, "[a,b,c]"; en los binarios, la cabecera del array seguida de los elementos
+	cierre := []byte{']'}
+	if c.codec != codecJSON {
+		if _, err := w.Write(c.codec.cabeceraArray(len(partes))); err != nil {
+			return err
+		}
+		cierre = nil
+	}
+	for i, datos := range partes {
+		if c.codec == codecJSON {
+			separador := []byte{','}
+			if i == 0 {
+				separador[0] = '['
+			}
+			if _, err := w.Write(separador); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(datos); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(cierre); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// codificarCon devuelve el mensaje en el codec indicado, reutilizando la serialización
+// de preparar si la hay
+func (m *Message) codificarCon(c *codec) ([]byte, error) {
+	if m.codificado != nil {
+		codificado, err := m.codificadoPara(c)
+		if err != nil {
+			return nil, err
+		}
+		return codificado.datos, nil
+	}
+	return c.codificar(m)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// parConexionesPrueba devuelve los dos extremos de una conexión en memoria: el del
+// servidor, para un Client, y el del navegador
+func parConexionesPrueba(t *testing.T) (*ConexionTramas, *ConexionTramas) {
+	t.Helper()
+	servidor, navegador := net.Pipe()
+	t.Cleanup(func() { navegador.Close() })
+	return NewConexionTramas(servidor), NewConexionTramas(navegador)
+}
+
+// TestAgruparMensajesEnUnFrame prueba que, con batch=1, lo que espera en send sale en
+// un solo frame como array JSON, y que sin él cada mensaje va en su frame
+func TestAgruparMensajesEnUnFrame(t *testing.T) {
+	for _, agrupar := range []bool{true, false} {
+		servidor, navegador := parConexionesPrueba(t)
+		client := NewClient(NewHub(), servidor, "ana")
+		client.agrupar = agrupar
+		difundido := NewUserMessage("luis", "difundido")
+		difundido.preparar()
+		client.send <- NewSystemMessage("uno")
+		client.send <- difundido
+		client.send <- NewUserMessage("luis", "tres")
+		close(client.send)
+		go client.goroutineEscritura()
+
+		var frames []string
+		for {
+			_, datos, err := navegador.ReadMessage()
+			if err != nil {
+				break
+			}
+			frames = append(frames, string(datos))
+		}
+		if !agrupar {
+			if len(frames) != 3 {
+				t.Errorf("Sin agrupar se esperaban 3 frames, llegaron %d", len(frames))
+			}
+			continue
+		}
+		if len(frames) != 1 {
+			t.Fatalf("Se esperaba un solo frame, llegaron %d", len(frames))
+		}
+		var lote []Message
+		if err := json.Unmarshal([]byte(frames[0]), &lote); err != nil {
+			t.Fatalf("El frame no es un array JSON: %v", err)
+		}
+		if len(lote) != 3 || lote[0].MessageContent != "uno" || lote[1].MessageContent != "difundido" || lote[2].MessageContent != "tres" {
+			t.Errorf("Lote inesperado: %+v", lote)
+		}
+	}
+}
+
+// TestLoteDeUnMensajeNoEsArray prueba que un mensaje suelto no se envuelve en un array
+func TestLoteDeUnMensajeNoEsArray(t *testing.T) {
+	servidor, navegador := parConexionesPrueba(t)
+	client := NewClient(NewHub(), servidor, "ana")
+	client.agrupar = true
+	// En memoria escribir espera a que el otro extremo lea
+	escrito := make(chan error, 1)
+	go func() { escrito <- client.escribirLote([]*Message{NewSystemMessage("solo")}) }()
+	_, datos, err := navegador.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-escrito; err != nil {
+		t.Fatal(err)
+	}
+	var message Message
+	if err := json.Unmarshal(datos, &message); err != nil || message.MessageContent != "solo" {
+		t.Errorf("Se esperaba un objeto suelto: %s", datos)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+// Avisos que se guardan como máximo para un usuario desconectado; se descartan los más antiguos
+const maxBuzon = 100
+
+// guardarEnBuzonLocked guarda un mensaje privado o un aviso para un usuario que no lo pudo
+// recibir. Requiere clientsMutex tomado en escritura
+func (h *Hub) guardarEnBuzonLocked(nombre string, message *Message) {
+	pendientes := append(h.buzones[nombre], message)
+	if exceso := len(pendientes) - maxBuzon; exceso > 0 {
+		pendientes = append([]*Message(nil), pendientes[exceso:]...)
+	}
+	h.buzones[nombre] = pendientes
+}
+
+// entregarPersonalLocked envía un mensaje a todas las sesiones de un usuario y lo guarda en
+// su buzón si no llegó a ninguna y tampoco está conectado a otro nodo, que se lo entregará.
+// Requiere clientsMutex tomado en escritura
+func (h *Hub) entregarPersonalLocked(nombre string, message *Message) {
+	if !h.entregarASesionesLocked(nombre, message) && !h.presenteEnOtroNodoLocked(nombre) {
+		h.guardarEnBuzonLocked(nombre, message)
+	}
+}
+
+// entregarASesionesLocked envía un mensaje a las sesiones de un usuario en este nodo y
+// devuelve si llegó a alguna. Requiere clientsMutex tomado
+func (h *Hub) entregarASesionesLocked(nombre string, message *Message) bool {
+	entregado := false
+	for sesion := range h.sesiones[nombre] {
+		if h.enviarAClienteLocked(sesion, message) {
+			entregado = true
+		}
+	}
+	return entregado
+}
+
+// entregarBuzonLocked envía a una sesión recién conectada lo que se acumuló en el buzón.
+// Los mensajes siguen en el buzón hasta que el cliente confirma que los recibió, así que
+// si la conexión se cae antes se vuelven a entregar. Requiere clientsMutex tomado
+func (h *Hub) entregarBuzonLocked(client *Client, nombre string) {
+	for _, message := range h.buzones[nombre] {
+		h.enviarAClienteLocked(client, message)
+	}
+}
+
+// confirmarRecibidos quita del buzón del usuario los mensajes que el cliente ya recibió
+func (h *Hub) confirmarRecibidos(client *Client, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	confirmados := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		confirmados[id] = true
+	}
+	nombre := client.nombre()
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	pendientes := h.buzones[nombre][:0]
+	for _, message := range h.buzones[nombre] {
+		if !confirmados[message.ID] {
+			pendientes = append(pendientes, message)
+		}
+	}
+	if len(pendientes) == 0 {
+		delete(h.buzones, nombre)
+	} else {
+		h.buzones[nombre] = pendientes
+	}
+}
+
+// Pendientes devuelve cuántos mensajes esperan en el buzón del usuario
+func (h *Hub) Pendientes(nombre string) int {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	return len(h.buzones[nombre])
+}
@@ -0,0 +1,156 @@
+package main
+
+import "testing"
+
+// TestMensajeDirectoConectado prueba /msg entre usuarios conectados
+func TestMensajeDirectoConectado(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+	esperarMensaje(t, ana, esPresencia("luis", presenciaEntra))
+
+	enviarTexto(t, ana, "/msg Luis ¿comemos juntos?")
+	directo := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoDirecto })
+	if directo.Username != "ana" || directo.To != "luis" || directo.MessageContent != "¿comemos juntos?" {
+		t.Errorf("Mensaje privado inesperado: %+v", directo)
+	}
+	// El remitente recibe su copia en todas sus sesiones
+	esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoDirecto && m.ID == directo.ID })
+
+	enviarTexto(t, ana, "/msg nadie hola")
+	esperarMensaje(t, ana, contiene("No conozco"))
+}
+
+// TestBuzonDesconectado prueba la entrega al volver y que solo la confirmación vacía el buzón
+func TestBuzonDesconectado(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	eva := conectarEnMemoria(t, hub, "eva")
+	clave := esperarClave(t, eva)
+	esperarMensaje(t, ana, esPresencia("eva", presenciaEntra))
+	eva.Close()
+	esperarMensaje(t, ana, esPresencia("eva", presenciaSale))
+
+	enviarJSON(t, ana, map[string]interface{}{"type": "direct", "to": "eva", "message_content": "El informe está en la carpeta"})
+	esperarMensaje(t, ana, contiene("no está conectado"))
+	enviarTexto(t, ana, "@eva mira el informe")
+	esperarMensaje(t, ana, contiene("mira el informe"))
+	if n := hub.Pendientes("eva"); n != 2 {
+		t.Fatalf("Se esperaban 2 mensajes en el buzón, hay %d", n)
+	}
+
+	// Sin confirmación, el buzón se vuelve a entregar en la siguiente conexión
+	eva = conectarEnMemoria(t, hub, "eva&token="+clave)
+	esperarMensaje(t, eva, func(m *Message) bool { return m.Type == tipoDirecto })
+	eva.Close()
+	esperarMensaje(t, ana, esPresencia("eva", presenciaSale))
+
+	eva = conectarEnMemoria(t, hub, "eva&token="+clave)
+	directo := esperarMensaje(t, eva, func(m *Message) bool { return m.Type == tipoDirecto })
+	mencion := esperarMensaje(t, eva, func(m *Message) bool { return m.Type == tipoMencion })
+	enviarJSON(t, eva, map[string]interface{}{"type": "ack", "message_ids": []string{directo.ID, mencion.ID}})
+	// Las operaciones de un cliente se procesan en orden: cuando responde /who ya se confirmó
+	enviarTexto(t, eva, "/who")
+	esperarMensaje(t, eva, contiene("Conectados"))
+	if n := hub.Pendientes("eva"); n != 0 {
+		t.Errorf("El buzón debería quedar vacío tras confirmar, hay %d", n)
+	}
+}
+
+// TestRenombrarNoHeredaBuzon prueba que /nick no permite quedarse con el nombre de
+// alguien desconectado ni con su buzón, y que el buzón propio acompaña al renombrado
+func TestRenombrarNoHeredaBuzon(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	eva := conectarEnMemoria(t, hub, "eva")
+	esperarMensaje(t, ana, esPresencia("eva", presenciaEntra))
+	eva.Close()
+	esperarMensaje(t, ana, esPresencia("eva", presenciaSale))
+	enviarJSON(t, ana, map[string]interface{}{"type": "direct", "to": "eva", "message_content": "Solo para eva"})
+	esperarMensaje(t, ana, contiene("no está conectado"))
+
+	intruso := conectarEnMemoria(t, hub, "luis")
+	enviarTexto(t, intruso, "/nick eva")
+	esperarMensaje(t, intruso, contiene("ya lo ha usado otra persona"))
+	if n := hub.Pendientes("eva"); n != 1 {
+		t.Errorf("El buzón de eva debería seguir con 1 mensaje, hay %d", n)
+	}
+
+	// El buzón de quien se renombra va con él
+	hub.clientsMutex.Lock()
+	hub.guardarEnBuzonLocked("luis", NewSystemMessage("pendiente de luis"))
+	hub.clientsMutex.Unlock()
+	enviarTexto(t, intruso, "/nick luisito")
+	esperarMensaje(t, intruso, func(m *Message) bool { return m.Type == tipoNick })
+	if hub.Pendientes("luis") != 0 || hub.Pendientes("luisito") != 1 || hub.Pendientes("eva") != 1 {
+		t.Errorf("Buzones inesperados: luis %d, luisito %d, eva %d",
+			hub.Pendientes("luis"), hub.Pendientes("luisito"), hub.Pendientes("eva"))
+	}
+}
+
+// TestBuzonSoloConClave prueba que conectarse con el nombre de otro no da acceso a su
+// buzón: sin la clave del nombre la conexión se rechaza y los mensajes siguen esperando
+func TestBuzonSoloConClave(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	eva := conectarEnMemoria(t, hub, "eva")
+	clave := esperarClave(t, eva)
+	esperarMensaje(t, ana, esPresencia("eva", presenciaEntra))
+	eva.Close()
+	esperarMensaje(t, ana, esPresencia("eva", presenciaSale))
+	enviarJSON(t, ana, map[string]interface{}{"type": "direct", "to": "eva", "message_content": "Solo para eva"})
+	esperarMensaje(t, ana, contiene("no está conectado"))
+
+	intruso := abrirEnMemoria(t, hub, "eva&token=inventada")
+	esperarMensaje(t, intruso, contiene("pertenece a otra persona"))
+	esperarCierre(t, intruso)
+	if n := hub.Pendientes("eva"); n != 1 {
+		t.Errorf("El buzón de eva debería seguir con 1 mensaje, hay %d", n)
+	}
+
+	eva = conectarEnMemoria(t, hub, "eva&token="+clave)
+	esperarMensaje(t, eva, func(m *Message) bool { return m.Type == tipoDirecto })
+
+	// Al renombrarse llega la clave del nombre nuevo; la anterior solo vale para eva, que
+	// sigue apartado para quien lo usaba
+	enviarTexto(t, eva, "/nick evita")
+	nueva := esperarClave(t, eva)
+	if nueva == "" || nueva == clave {
+		t.Errorf("Se esperaba una clave nueva para evita, obtuvimos %q", nueva)
+	}
+	if !hub.credencialValida("evita", nueva) || !hub.credencialValida("eva", clave) || hub.credencialValida("evita", clave) {
+		t.Error("Las claves no siguieron al cambio de nombre")
+	}
+}
+
+// TestClaveCaducaSinSesiones prueba que un nombre sin sesiones ni buzón vuelve a estar
+// libre para quien llega sin su clave, y que un nombre renombrado sigue apartado mientras
+// su dueño está conectado con el nombre nuevo
+func TestClaveCaducaSinSesiones(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	luis := conectarEnMemoria(t, hub, "luis")
+	eva := conectarEnMemoria(t, hub, "eva")
+	clave := esperarClave(t, eva)
+	eva.Close()
+	esperarMensaje(t, luis, esPresencia("eva", presenciaSale))
+
+	// Otro dispositivo, sin la clave: el nombre ya no protege nada y recibe una clave nueva
+	otra := conectarEnMemoria(t, hub, "eva")
+	if nueva := esperarClave(t, otra); nueva == "" || nueva == clave || hub.credencialValida("eva", clave) {
+		t.Errorf("Se esperaba una clave nueva para eva, obtuvimos %q", nueva)
+	}
+
+	// El nombre anterior de quien se renombra queda apartado mientras siga conectado
+	enviarTexto(t, otra, "/nick evita")
+	esperarMensaje(t, otra, func(m *Message) bool { return m.Type == tipoNick })
+	intruso := abrirEnMemoria(t, hub, "eva")
+	esperarMensaje(t, intruso, contiene("pertenece a otra persona"))
+	otra.Close()
+	esperarMensaje(t, luis, esPresencia("evita", presenciaSale))
+	conectarEnMemoria(t, hub, "eva")
+}
@@ -1,13 +1,143 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"log"
+	"os"
+	"strings"
 )
 
+// Subcomandos del binario ("chat-app export ...") que no arrancan el servidor
+var subcomandos = map[string]func(args []string, salida io.Writer) error{
+	"export": comandoExportar,
+	"replay": comandoReproducir,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if subcomando, ok := subcomandos[os.Args[1]]; ok {
+			if err := subcomando(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	admins := flag.String("admins", "", "Usuarios administradores separados por comas (pueden usar /kick)")
+	sesiones := flag.String("sesiones", SesionesMultiples, "Conexiones por usuario: multiple o unica. En un cluster, las de un mismo nombre tienen que ir al mismo nodo")
+	historial := flag.Int("historial", capacidadHistorialPorDefecto, "Mensajes que conserva la sala")
+	fijar := flag.String("fijar", FijadoAdmins, "Quién puede fijar mensajes: admins o todos")
+	sala := flag.String("sala", salaPorDefecto, "Nombre de la sala")
+	importar := flag.String("importar", "", "Transcripción JSON Lines que cargar en el historial al arrancar")
+	redis := flag.String("redis", "", "Servidor Redis (host:puerto) para repartir la sala entre varias instancias")
+	canal := flag.String("redis-canal", canalRedisPorDefecto, "Canal de Redis que comparten las instancias")
+	nodo := flag.String("nodo", "", "Nombre de esta instancia entre las que comparten sala (por defecto uno aleatorio)")
+	pares := flag.String("pares", "", "Otros servidores del cluster (https://host:puerto, o host:puerto en esta máquina) separados por comas, sin broker externo")
+	paresCA := flag.String("pares-ca", "", "Certificados PEM de la CA con la que verificar a los pares (por defecto las raíces del sistema)")
+	paresEnClaro := flag.Bool("pares-en-claro", false, "Permitir pares sin TLS fuera de esta máquina; el secreto del cluster viaja sin cifrar")
+	certificado := flag.String("tls-cert", "", "Certificado PEM con el que servir por HTTPS (junto con -tls-key)")
+	claveTLS := flag.String("tls-key", "", "Clave privada PEM del certificado de -tls-cert")
+	fragmentos := flag.Int("fragmentos", numFragmentosPorDefecto(), "Goroutines que reparten las difusiones entre los clientes")
+	lentos := flag.String("lentos", LentoDesconectar, "Qué hacer con un cliente que no da abasto: desconectar, descartar-antiguos, descartar-nuevos, descartar-efimeros o disco")
+	clases := flag.String("lentos-clases", "", "Política de cada clase de cliente (?clase=), por ejemplo movil=descartar-efimeros,web=disco")
+	derrameDir := flag.String("derrame-dir", "", "Directorio de las colas en disco de los clientes lentos (por defecto el temporal)")
+	derrameMax := flag.Int64("derrame-max", maxDerramePorDefecto, "Bytes máximos de la cola en disco de cada cliente lento")
+	comprimir := flag.Bool("compresion", true, "Negociar permessage-deflate con los navegadores que lo admiten")
+	nivelCompresion := flag.Int("compresion-nivel", nivelCompresionPorDefecto, "Nivel de compresión, de -2 (solo Huffman) a 9 (máxima)")
+	umbralCompresion := flag.Int("compresion-umbral", umbralCompresionPorDefecto, "Bytes por debajo de los cuales un mensaje se envía sin comprimir")
+	comprimirImagenes := flag.Bool("compresion-imagenes", false, "Comprimir también los mensajes con imágenes, que ya suelen venir comprimidas")
+	tcp := flag.String("tcp", "", "Dirección (host:puerto) en la que atender clientes TCP sin WebSocket; vacío para no hacerlo")
+	flag.Parse()
+
 	// Crear el hub de chat
 	hub := NewHub()
+	hub.SetAdmins(strings.Split(*admins, ","))
+	// Los administradores demuestran quiénes son con esta clave (?token=), que se lee del
+	// entorno para que no aparezca en la lista de procesos
+	claveAdmin := os.Getenv("ADMIN_SECRET")
+	if strings.TrimSpace(*admins) != "" && claveAdmin == "" {
+		log.Fatal("-admins necesita la clave de los administradores en ADMIN_SECRET")
+	}
+	hub.SetClaveAdmin(claveAdmin)
+	if err := hub.SetPoliticaSesiones(*sesiones); err != nil {
+		log.Fatal(err)
+	}
+	hub.SetCapacidadHistorial(*historial)
+	if err := hub.SetPoliticaFijado(*fijar); err != nil {
+		log.Fatal(err)
+	}
+	if err := hub.SetSala(*sala); err != nil {
+		log.Fatal(err)
+	}
+	if err := hub.SetFragmentos(*fragmentos); err != nil {
+		log.Fatal(err)
+	}
+	if err := hub.SetPoliticaLentos(*lentos); err != nil {
+		log.Fatal(err)
+	}
+	for _, clase := range strings.Split(*clases, ",") {
+		if strings.TrimSpace(clase) == "" {
+			continue
+		}
+		nombre, politica, _ := strings.Cut(clase, "=")
+		if err := hub.SetClaseLentos(strings.TrimSpace(nombre), strings.TrimSpace(politica)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := hub.SetDerrame(*derrameDir, *derrameMax); err != nil {
+		log.Fatal(err)
+	}
+	if *comprimir {
+		if err := hub.SetCompresion(*nivelCompresion, *umbralCompresion, *comprimirImagenes); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *importar != "" {
+		importados, err := hub.ImportarArchivo(*importar)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Importados %d mensajes de %s", importados, *importar)
+	}
+	if *redis != "" {
+		// La contraseña se lee del entorno para que no aparezca en la lista de procesos
+		broker := NewBrokerRedis(*redis, *canal, os.Getenv("REDIS_PASSWORD"))
+		hub.SetBroker(broker, *nodo)
+	}
+	var cluster *BrokerCluster
+	if *pares != "" {
+		if *redis != "" {
+			log.Fatal("-redis y -pares son alternativas: usa solo una")
+		}
+		var err error
+		// Todos los nodos comparten el secreto, que se lee del entorno
+		secreto := os.Getenv("CLUSTER_SECRET")
+		if secreto == "" {
+			log.Fatal("-pares necesita CLUSTER_SECRET: sin él cualquiera podría unirse al cluster")
+		}
+		if cluster, err = NewBrokerCluster(strings.Split(*pares, ","), secreto, *paresEnClaro); err != nil {
+			log.Fatal(err)
+		}
+		if *paresCA != "" {
+			pem, err := os.ReadFile(*paresCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+			raices := x509.NewCertPool()
+			if !raices.AppendCertsFromPEM(pem) {
+				log.Fatalf("%s no contiene certificados PEM", *paresCA)
+			}
+			cluster.SetTLS(&tls.Config{RootCAs: raices})
+		}
+		hub.SetBroker(cluster, *nodo)
+	}
 	
 	// Iniciar el hub en una goroutine separada
 	go hub.Run()
@@ -17,11 +147,53 @@ func main() {
 		ServeWS(hub, w, r)
 	})
 	
+	// Alternativas a WebSocket: recibir por SSE o long-polling y enviar por POST
+	transportes := NewTransportesHTTP(hub)
+	http.HandleFunc("/sse", transportes.ServeSSE)
+	http.HandleFunc("/poll", transportes.ServeSondeo)
+	http.HandleFunc("/send", transportes.ServeEnviar)
+	
+	// Búsqueda en el historial
+	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		ServeSearch(hub, w, r)
+	})
+	
+	// Descarga de la transcripción
+	http.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		ServeExport(hub, w, r)
+	})
+	
+	// Contadores de los clientes lentos para Prometheus
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		ServeMetricas(hub, w, r)
+	})
+	
+	// Enlaces de los demás nodos del cluster
+	if cluster != nil {
+		http.HandleFunc("/cluster", cluster.ServeCluster)
+	}
+	
+	// Clientes TCP con frames propios, sin WebSocket
+	if *tcp != "" {
+		ln, err := net.Listen("tcp", *tcp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Atendiendo clientes TCP en %s", ln.Addr())
+		go func() { log.Fatal(ServeTCP(hub, ln)) }()
+	}
+	
 	// Servir archivos estáticos (HTML, CSS, JS)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "index.html")
 	})
 	
+	if (*certificado == "") != (*claveTLS == "") {
+		log.Fatal("-tls-cert y -tls-key van juntos")
+	}
 	log.Println("Jose santamaria Servidor de chat iniciado en :8080")
+	if *certificado != "" {
+		log.Fatal(http.ListenAndServeTLS(":8080", *certificado, *claveTLS, nil))
+	}
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
\ No newline at end of file
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NewMentionMessage crea el aviso que recibe un usuario mencionado en un mensaje
+func NewMentionMessage(message *Message) *Message {
+	return &Message{
+		ID:             nuevoIDMensaje(),
+		Username:       message.Username,
+		MessageContent: message.MessageContent,
+		Timestamp:      message.Timestamp,
+		Type:           tipoMencion,
+		MessageID:      message.ID,
+	}
+}
+
+// extraerMenciones busca "@nombre" en el texto entre los nombres conocidos, sin distinguir
+// mayúsculas, y devuelve los nombres tal como están registrados. Como los nombres pueden
+// tener espacios, en cada "@" gana el nombre conocido más largo que encaje
+func extraerMenciones(texto string, conocidos []string) []string {
+	if !strings.Contains(texto, "@") || len(conocidos) == 0 {
+		return nil
+	}
+	candidatos := append([]string(nil), conocidos...)
+	sort.Slice(candidatos, func(i, j int) bool { return len(candidatos[i]) > len(candidatos[j]) })
+
+	var menciones []string
+	vistos := make(map[string]bool)
+	for i := 0; i < len(texto); i++ {
+		if texto[i] != '@' {
+			continue
+		}
+		// "ana@correo.com" no es una mención
+		if anterior, _ := utf8.DecodeLastRuneInString(texto[:i]); i > 0 && esParteDeNombre(anterior) {
+			continue
+		}
+		resto := texto[i+1:]
+		for _, nombre := range candidatos {
+			if len(resto) < len(nombre) || !strings.EqualFold(resto[:len(nombre)], nombre) {
+				continue
+			}
+			if siguiente, _ := utf8.DecodeRuneInString(resto[len(nombre):]); len(resto) > len(nombre) && esParteDeNombre(siguiente) {
+				continue
+			}
+			if !vistos[nombre] {
+				vistos[nombre] = true
+				menciones = append(menciones, nombre)
+			}
+			i += len(nombre)
+			break
+		}
+	}
+	return menciones
+}
+
+// esParteDeNombre indica si la runa puede continuar un nombre de usuario
+func esParteDeNombre(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
+
+// detectarMenciones rellena las menciones de un mensaje de la conversación que aún no las tenga.
+// Se llama desde Run antes de difundir el mensaje
+func (h *Hub) detectarMenciones(message *Message) {
+	if (message.Type != tipoUsuario && message.Type != tipoAccion) || message.Mentions != nil {
+		return
+	}
+	h.clientsMutex.RLock()
+	conocidos := make([]string, 0, len(h.conocidos))
+	for nombre := range h.conocidos {
+		conocidos = append(conocidos, nombre)
+	}
+	h.clientsMutex.RUnlock()
+	message.Mentions = extraerMenciones(message.MessageContent, conocidos)
+}
+
+// notificarMenciones prepara el aviso de mención, que los fragmentos entregan a las
+// sesiones de cada mencionado justo después del mensaje, y lo deja en el buzón de los
+// mencionados que no están conectados. Mencionarse a uno mismo no genera aviso. Con un
+// mensaje de otro nodo no se usa el buzón: de eso se encarga el nodo de origen
+func (h *Hub) notificarMenciones(message *Message) *Message {
+	if len(message.Mentions) == 0 {
+		return nil
+	}
+	aviso := NewMentionMessage(message)
+	if message.remoto {
+		return aviso
+	}
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	for _, nombre := range message.Mentions {
+		if nombre != message.Username && !h.nombreEnUsoLocked(nombre) {
+			h.guardarEnBuzonLocked(nombre, aviso)
+		}
+	}
+	return aviso
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestExtraerMenciones prueba la detección de "@nombre" entre los usuarios conocidos
+func TestExtraerMenciones(t *testing.T) {
+	conocidos := []string{"ana", "luis", "juan", "juan carlos", "eva-2"}
+	casos := []struct {
+		texto    string
+		esperado []string
+	}{
+		{"hola @ana", []string{"ana"}},
+		{"@LUIS, ¿vienes?", []string{"luis"}},
+		{"@juan carlos y @juan", []string{"juan carlos", "juan"}},
+		{"@ana @ana @ana", []string{"ana"}},
+		{"escribe a ana@correo.com", nil},
+		{"@anabel no existe", nil},
+		{"@eva-2: listo", []string{"eva-2"}},
+		{"sin menciones", nil},
+	}
+	for _, caso := range casos {
+		if obtenido := extraerMenciones(caso.texto, conocidos); !reflect.DeepEqual(obtenido, caso.esperado) {
+			t.Errorf("%q: se esperaba %v, obtuvimos %v", caso.texto, caso.esperado, obtenido)
+		}
+	}
+}
+
+// TestMencionesNotificadas prueba el aviso a conectados y la cola para desconectados
+func TestMencionesNotificadas(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+	eva := conectarEnMemoria(t, hub, "eva")
+	clave := esperarClave(t, eva)
+	esperarMensaje(t, ana, esPresencia("eva", presenciaEntra))
+	eva.Close()
+	esperarMensaje(t, ana, esPresencia("eva", presenciaSale))
+
+	enviarTexto(t, ana, "@Luis y @eva, revisad esto")
+	message := esperarMensaje(t, luis, contiene("revisad esto"))
+	if !reflect.DeepEqual(message.Mentions, []string{"luis", "eva"}) {
+		t.Errorf("Menciones inesperadas: %v", message.Mentions)
+	}
+	aviso := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoMencion })
+	if aviso.MessageID != message.ID || aviso.Username != "ana" {
+		t.Errorf("Aviso de mención inesperado: %+v", aviso)
+	}
+
+	// El aviso a luis sale después de encolar el de eva, así que eva ya lo tiene pendiente
+	eva = conectarEnMemoria(t, hub, "eva&token="+clave)
+	esperarMensaje(t, eva, func(m *Message) bool { return m.Type == tipoHistorial })
+	pendiente := esperarMensaje(t, eva, func(m *Message) bool { return m.Type == tipoMencion })
+	if pendiente.MessageID != message.ID {
+		t.Errorf("Mención pendiente inesperada: %+v", pendiente)
+	}
+}
+
+// TestAvisoPerdidoVaAlBuzon prueba que el aviso de mención que no cabe en la cola del
+// mencionado se guarda en su buzón en lugar de perderse
+func TestAvisoPerdidoVaAlBuzon(t *testing.T) {
+	hub := NewHub()
+	eva := &Client{hub: hub, send: make(chan *Message, 2), username: "eva", politicaLenta: LentoDescartarNuevos}
+	hub.clientsMutex.Lock()
+	hub.clients[eva] = true
+	hub.asignarFragmentoLocked(eva)
+	hub.clientsMutex.Unlock()
+	eva.send <- NewUserMessage("luis", "ocupando la cola")
+
+	message := NewUserMessage("ana", "@eva mira esto")
+	message.Mentions = []string{"eva"}
+	hub.entregarFragmento(eva.fragmento, &difusion{message: message, aviso: NewMentionMessage(message), secuencia: 1})
+	if n := hub.Pendientes("eva"); n != 1 {
+		t.Errorf("El aviso perdido debería estar en el buzón, hay %d mensajes", n)
+	}
+}
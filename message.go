@@ -1,48 +1,230 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// Tipos de mensaje que viajan por el WebSocket
+const (
+	tipoUsuario = "user"
+	tipoSistema = "system"
+	tipoAccion  = "action" // generado por /me
+	tipoNick    = "nick"   // solicitud de cambio de nombre y su confirmación
+	// Presencia: eventos estructurados de entrada, salida y estado, y la foto inicial
+	tipoPresencia = "presence"
+	tipoRoster    = "roster"
+	// Indicadores efímeros de escritura
+	tipoEscribiendo  = "typing_start"
+	tipoDejaEscribir = "typing_stop"
+	// Historial al conectarse, marcas de lectura ("read" del cliente) y confirmaciones
+	tipoHistorial = "history"
+	tipoLeido     = "read"
+	tipoRecibo    = "receipt"
+	// Edición y borrado de un mensaje ya enviado (operación del cliente y evento difundido)
+	tipoEditar = "edit"
+	tipoBorrar = "delete"
+	// Consulta de un hilo de respuestas y su resultado
+	tipoHilo = "thread"
+	// Reacciones a un mensaje (operación del cliente y evento difundido)
+	tipoReaccionAgregar = "reaction_add"
+	tipoReaccionQuitar  = "reaction_remove"
+	// Aviso a un usuario mencionado con "@nombre"
+	tipoMencion = "mention"
+	// Mensaje privado y confirmación de los mensajes del buzón ya recibidos
+	tipoDirecto   = "direct"
+	tipoConfirmar = "ack"
+	// Fijar y desfijar un mensaje (operación y evento) y consulta de los fijados
+	tipoFijar    = "pin"
+	tipoDesfijar = "unpin"
+	tipoFijados  = "pins"
+	// Búsqueda en el historial (consulta del cliente y resultados)
+	tipoBusqueda = "search"
+	// Clave con la que un usuario vuelve a conectarse con su nombre (?token=)
+	tipoCredencial = "credential"
+)
+
+// Longitud máxima de un nombre de usuario, igual que el maxlength del frontend
+const maxLongitudNombre = 25
+
+// Mismos caracteres que admite el formulario de acceso de index.html. El espacio es
+// literal: \s dejaría pasar saltos de línea y tabuladores
+var patronNombreUsuario = regexp.MustCompile(`(?i)^[a-z0-9_\-áéíóúñü ]+$`)
+
+// Nombre con el que firma el servidor sus avisos; ningún usuario puede tomarlo
+const nombreSistema = "Sistema"
+
 type Message struct {
+	// Identificador único, asignado al crear el mensaje
+	ID             string    `json:"id,omitempty"`
 	Username       string    `json:"username"`
 	MessageContent string    `json:"message_content"`
 	Timestamp      time.Time `json:"timestamp"`
-	Type           string    `json:"type"` // "user" o "system"
+	Type           string    `json:"type"` // "user", "system" o "action"
 	ImagenData     string    `json:"imagen_data,omitempty"` 
 	ImagenType     string    `json:"imagen_type,omitempty"`
+	// Presencia: evento (joined, left, renamed, active, idle, away) y lista de conectados
+	Presence         string            `json:"presence,omitempty"`
+	PreviousUsername string            `json:"previous_username,omitempty"`
+	Roster           []EstadoPresencia `json:"roster,omitempty"`
+	// Mensaje al que se refiere una operación o evento (por ejemplo la marca de lectura)
+	MessageID string `json:"message_id,omitempty"`
+	// Historial: mensajes recientes, marca de lectura propia, no leídos y marcas de la sala
+	Messages    []*Message        `json:"messages,omitempty"`
+	LastRead    string            `json:"last_read,omitempty"`
+	Unread      int               `json:"unread,omitempty"`
+	ReadMarkers map[string]string `json:"read_markers,omitempty"`
+	// Fecha de la última edición y marca de mensaje eliminado
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	Deleted  bool       `json:"deleted,omitempty"`
+	// Hilos: mensaje raíz al que responde, extracto del mensaje citado y respuestas recibidas
+	ReplyTo    string `json:"reply_to,omitempty"`
+	Quote      *Cita  `json:"quote,omitempty"`
+	ReplyCount int    `json:"reply_count,omitempty"`
+	// Reacciones: emoji -> usuarios que la pusieron; Emoji es el de un evento de reacción
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	Emoji     string              `json:"emoji,omitempty"`
+	// Usuarios mencionados con "@nombre" en el mensaje
+	Mentions []string `json:"mentions,omitempty"`
+	// Destinatario de un mensaje privado
+	To string `json:"to,omitempty"`
+	// Mensaje fijado en la sala y quién lo fijó; Pins lleva los fijados en el historial inicial
+	Pinned   bool       `json:"pinned,omitempty"`
+	PinnedBy string     `json:"pinned_by,omitempty"`
+	Pins     []*Message `json:"pins,omitempty"`
+	// Sala en la que se escribió el mensaje
+	Room string `json:"room,omitempty"`
+	// Clave del nombre de usuario; solo viaja en el mensaje de credencial a sus sesiones
+	Token string `json:"token,omitempty"`
+
+	// remoto marca los mensajes que llegaron de otro nodo por el broker
+	remoto bool
+	// Serialización compartida por todos los destinatarios de una difusión (ver preparar)
+	codificado *mensajeCodificado
+}
+
+// nuevoIDMensaje genera un identificador aleatorio para un mensaje
+func nuevoIDMensaje() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Sin fuente aleatoria seguimos con algo único en este proceso
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// copia devuelve una copia del mensaje que se puede modificar sin afectar al original
+func (m *Message) copia() *Message {
+	copia := *m
+	// La copia se puede modificar, así que no comparte la serialización del original
+	copia.codificado = nil
+	if m.Reactions != nil {
+		copia.Reactions = make(map[string][]string, len(m.Reactions))
+		for emoji, usuarios := range m.Reactions {
+			copia.Reactions[emoji] = append([]string(nil), usuarios...)
+		}
+	}
+	copia.Mentions = append([]string(nil), m.Mentions...)
+	return &copia
 }
 
 func NewUserMessage(username, content string) *Message {
 	return &Message{
+		ID:             nuevoIDMensaje(),
 		Username:       username,
 		MessageContent: content,
 		Timestamp:      time.Now(),
-		Type:           "user",
+		Type:           tipoUsuario,
+	}
+}
+
+// NewActionMessage crea un mensaje de acción en tercera persona ("/me saluda")
+func NewActionMessage(username, accion string) *Message {
+	return &Message{
+		ID:             nuevoIDMensaje(),
+		Username:       username,
+		MessageContent: accion,
+		Timestamp:      time.Now(),
+		Type:           tipoAccion,
+	}
+}
+
+// NewNickMessage confirma a un cliente el nombre con el que ahora aparece en el chat
+func NewNickMessage(username string) *Message {
+	return &Message{
+		Username:  username,
+		Timestamp: time.Now(),
+		Type:      tipoNick,
+	}
+}
+
+// NewCredencialMessage entrega a las sesiones de un usuario la clave de su nombre
+func NewCredencialMessage(username, clave string) *Message {
+	return &Message{
+		Username:  username,
+		Timestamp: time.Now(),
+		Type:      tipoCredencial,
+		Token:     clave,
 	}
 }
 
 func NewSystemMessage(content string) *Message {
 	return &Message{
-		Username:       "Sistema",
+		ID:             nuevoIDMensaje(),
+		Username:       nombreSistema,
 		MessageContent: content,
 		Timestamp:      time.Now(),
-		Type:           "system",
+		Type:           tipoSistema,
 	}
 }
 
 func envioImagen(username, content, imagenData, imagenType string) *Message {
 	return &Message{
+		ID:             nuevoIDMensaje(),
 		Username:       username,
 		MessageContent: content,
 		Timestamp:      time.Now(),
-		Type:           "user",
+		Type:           tipoUsuario,
 		ImagenData:     imagenData,
 		ImagenType:     imagenType,
 	}
 }
 
+// normalizarNombre quita los espacios de los extremos y junta los repetidos, para que
+// "ana  maría" y "ana maría" sean el mismo usuario
+func normalizarNombre(nombre string) string {
+	return strings.Join(strings.FieldsFunc(nombre, func(r rune) bool { return r == ' ' }), " ")
+}
+
+// esNombreDelSistema indica si el nombre se confundiría con los avisos del servidor
+func esNombreDelSistema(nombre string) bool {
+	return strings.EqualFold(nombre, nombreSistema)
+}
+
+// validarNombreUsuario aplica al registro y al cambio de nombre las mismas reglas que el
+// formulario de acceso. Espera el nombre ya normalizado
+func validarNombreUsuario(nombre string) error {
+	if nombre == "" {
+		return errors.New("El nombre de usuario no puede estar vacío.")
+	}
+	if utf8.RuneCountInString(nombre) > maxLongitudNombre {
+		return fmt.Errorf("El nombre de usuario admite como máximo %d caracteres.", maxLongitudNombre)
+	}
+	if !patronNombreUsuario.MatchString(nombre) {
+		return errors.New("El nombre solo admite letras, números, espacios, guiones y guiones bajos.")
+	}
+	if esNombreDelSistema(nombre) {
+		return errRenombrarReservado
+	}
+	return nil
+}
+
 // validarTipoImagen verifica si el tipo de imagen es soportado
 func validarTipoImagen(tipoImagen string) bool {
 	tiposSoportados := []string{"image/jpeg", "image/jpg", "image/png"}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Codificación MessagePack (https://msgpack.org) del árbol de encoding/json. Se escribe
+// siempre con el formato más corto; al leer se admite cualquiera
+
+// anexarMsgpack añade v codificado en MessagePack
+func anexarMsgpack(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		entero, decimal, ok := numeroJSON(v)
+		if ok {
+			return anexarEnteroMsgpack(b, entero)
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(decimal))
+	case string:
+		return append(anexarLongitudTextoMsgpack(b, len(v)), v...)
+	case []interface{}:
+		b = cabeceraLongitudMsgpack(b, len(v), 0x90, 0xdc, 0xdd)
+		for _, elemento := range v {
+			b = anexarMsgpack(b, elemento)
+		}
+		return b
+	case map[string]interface{}:
+		b = cabeceraLongitudMsgpack(b, len(v), 0x80, 0xde, 0xdf)
+		for _, clave := range clavesOrdenadas(v) {
+			b = anexarMsgpack(b, clave)
+			b = anexarMsgpack(b, v[clave])
+		}
+		return b
+	}
+	// El árbol de encoding/json no tiene otros tipos
+	panic(fmt.Sprintf("msgpack: tipo no admitido %T", v))
+}
+
+// anexarEnteroMsgpack usa el formato de entero más corto
+func anexarEnteroMsgpack(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+// anexarLongitudTextoMsgpack escribe la cabecera de un texto de n bytes
+func anexarLongitudTextoMsgpack(b []byte, n int) []byte {
+	switch {
+	case n < 32:
+		return append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+}
+
+// cabeceraLongitudMsgpack escribe la cabecera de un array o mapa: fix (hasta 15), 16 o 32 bits
+func cabeceraLongitudMsgpack(b []byte, n int, fix, c16, c32 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, c16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, c32), uint32(n))
+}
+
+// cabeceraArrayMsgpack empieza un array de n elementos
+func cabeceraArrayMsgpack(n int) []byte {
+	return cabeceraLongitudMsgpack(nil, n, 0x90, 0xdc, 0xdd)
+}
+
+// leerMsgpack decodifica un valor. Los números salen como float64 y los binarios como
+// texto, igual que los daría json.Unmarshal
+func leerMsgpack(l *lectorBinario) (interface{}, error) {
+	tipo, err := l.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tipo <= 0x7f:
+		return float64(tipo), nil
+	case tipo >= 0xe0:
+		return float64(int8(tipo)), nil
+	case tipo&0xf0 == 0x80:
+		return l.mapa(uint64(tipo&0x0f), leerMsgpack)
+	case tipo&0xf0 == 0x90:
+		return l.lista(uint64(tipo&0x0f), leerMsgpack)
+	case tipo&0xe0 == 0xa0:
+		return leerTextoMsgpack(l, uint64(tipo&0x1f))
+	}
+	switch tipo {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		return leerTextoConLongitudMsgpack(l, 1)
+	case 0xc5, 0xda:
+		return leerTextoConLongitudMsgpack(l, 2)
+	case 0xc6, 0xdb:
+		return leerTextoConLongitudMsgpack(l, 4)
+	case 0xca:
+		v, err := l.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := l.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := l.uint(1 << (tipo - 0xcc))
+		return float64(v), err
+	case 0xd0:
+		v, err := l.uint(1)
+		return float64(int8(v)), err
+	case 0xd1:
+		v, err := l.uint(2)
+		return float64(int16(v)), err
+	case 0xd2:
+		v, err := l.uint(4)
+		return float64(int32(v)), err
+	case 0xd3:
+		v, err := l.uint(8)
+		return float64(int64(v)), err
+	case 0xdc, 0xdd:
+		n, err := l.uint(2 << (tipo - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return l.lista(n, leerMsgpack)
+	case 0xde, 0xdf:
+		n, err := l.uint(2 << (tipo - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return l.mapa(n, leerMsgpack)
+	}
+	return nil, fmt.Errorf("msgpack: tipo 0x%02x no admitido", tipo)
+}
+
+// leerTextoConLongitudMsgpack lee un texto cuya longitud ocupa bytes bytes
+func leerTextoConLongitudMsgpack(l *lectorBinario, bytes int) (interface{}, error) {
+	n, err := l.uint(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return leerTextoMsgpack(l, n)
+}
+
+// leerTextoMsgpack lee un texto de n bytes
+func leerTextoMsgpack(l *lectorBinario, n uint64) (interface{}, error) {
+	b, err := l.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Políticas para fijar mensajes
+const (
+	// FijadoAdmins reserva fijar y desfijar a los administradores
+	FijadoAdmins = "admins"
+	// FijadoTodos permite a cualquier usuario fijar y desfijar mensajes
+	FijadoTodos = "todos"
+)
+
+// Mensajes fijados a la vez como máximo en la sala
+const maxFijados = 50
+
+var (
+	errFijadoSoloAdmins  = errors.New("Solo los administradores pueden fijar mensajes.")
+	errYaFijado          = errors.New("Ese mensaje ya está fijado.")
+	errNoFijado          = errors.New("Ese mensaje no está fijado.")
+	errDemasiadosFijados = fmt.Errorf("Ya hay %d mensajes fijados; desfija alguno antes.", maxFijados)
+)
+
+// NewPinMessage crea el evento que fija o desfija un mensaje
+func NewPinMessage(username, tipo, messageID string) *Message {
+	return &Message{
+		ID:        nuevoIDMensaje(),
+		Username:  username,
+		Timestamp: time.Now(),
+		Type:      tipo,
+		MessageID: messageID,
+	}
+}
+
+// NewPinsMessage crea la respuesta a la consulta de mensajes fijados
+func NewPinsMessage(fijados []*Message) *Message {
+	return &Message{
+		Username:  nombreSistema,
+		Timestamp: time.Now(),
+		Type:      tipoFijados,
+		Pins:      fijados,
+	}
+}
+
+// SetPoliticaFijado elige quién puede fijar mensajes: FijadoAdmins o FijadoTodos
+func (h *Hub) SetPoliticaFijado(politica string) error {
+	if politica != FijadoAdmins && politica != FijadoTodos {
+		return fmt.Errorf("política de mensajes fijados desconocida: %q", politica)
+	}
+	h.clientsMutex.Lock()
+	h.politicaFijado = politica
+	h.clientsMutex.Unlock()
+	return nil
+}
+
+// puedeFijar indica si la sesión puede fijar y desfijar según la política del hub
+func (h *Hub) puedeFijar(client *Client) bool {
+	h.clientsMutex.RLock()
+	politica := h.politicaFijado
+	h.clientsMutex.RUnlock()
+	return politica == FijadoTodos || h.esAdmin(client)
+}
+
+// fijarMensaje valida que el usuario puede fijar (o desfijar) el mensaje y difunde el
+// evento. Como en las reacciones, Historial.Fijar repite las comprobaciones bajo su lock
+// y el evento no se difunde si ya no cambia nada
+func (h *Hub) fijarMensaje(client *Client, tipo, messageID string) error {
+	if !h.puedeFijar(client) {
+		return errFijadoSoloAdmins
+	}
+	original, ok := h.historial.Buscar(messageID)
+	if !ok || (original.Type != tipoUsuario && original.Type != tipoAccion) {
+		return errMensajeNoEncontrado
+	}
+	if original.Deleted {
+		return errMensajeBorrado
+	}
+	if tipo == tipoFijar {
+		if original.Pinned {
+			return errYaFijado
+		}
+		if h.historial.NumFijados() >= maxFijados {
+			return errDemasiadosFijados
+		}
+	} else if !original.Pinned {
+		return errNoFijado
+	}
+	h.broadcast <- NewPinMessage(client.nombre(), tipo, messageID)
+	return nil
+}
+
+// enviarFijados responde al cliente con los mensajes fijados de la sala
+func (h *Hub) enviarFijados(client *Client) {
+	h.enviarACliente(client, NewPinsMessage(h.historial.Fijados()))
+}
@@ -0,0 +1,111 @@
+package main
+
+import "testing"
+
+// TestHistorialFijados prueba que los fijados sobreviven al recorte y que borrar desfija
+func TestHistorialFijados(t *testing.T) {
+	hist := NewHistorial(2)
+	decision := NewUserMessage("ana", "Decidido: desplegamos los martes")
+	hist.Agregar(decision)
+	if !hist.Fijar(decision.ID, "admin", true) || hist.Fijar(decision.ID, "admin", true) {
+		t.Fatal("Fijar debería cambiar el mensaje solo la primera vez")
+	}
+	for i := 0; i < 3; i++ {
+		hist.Agregar(NewUserMessage("luis", "relleno"))
+	}
+
+	fijados := hist.Fijados()
+	if len(fijados) != 1 || fijados[0].ID != decision.ID || !fijados[0].Pinned || fijados[0].PinnedBy != "admin" {
+		t.Fatalf("El fijado debería seguir disponible tras el recorte: %+v", fijados)
+	}
+	// Sigue siendo editable aunque ya no esté entre los recientes
+	if !hist.Editar(decision.ID, "Decidido: desplegamos los miércoles", decision.Timestamp) {
+		t.Error("Se esperaba poder editar un mensaje fijado fuera de la ventana")
+	}
+
+	hist.Borrar(decision.ID)
+	if hist.NumFijados() != 0 {
+		t.Error("Un mensaje borrado no debería seguir fijado")
+	}
+}
+
+// TestHistorialLimiteFijados prueba que Historial.Fijar no pasa de maxFijados
+func TestHistorialLimiteFijados(t *testing.T) {
+	hist := NewHistorial(maxFijados + 1)
+	mensajes := make([]*Message, maxFijados+1)
+	for i := range mensajes {
+		mensajes[i] = NewUserMessage("ana", "importante")
+		hist.Agregar(mensajes[i])
+	}
+	for _, message := range mensajes[:maxFijados] {
+		hist.Fijar(message.ID, "admin", true)
+	}
+	if hist.Fijar(mensajes[maxFijados].ID, "admin", true) || hist.NumFijados() != maxFijados {
+		t.Errorf("Se superó el límite de fijados: %d", hist.NumFijados())
+	}
+}
+
+// TestFijadosRepetidosNoSeDifunden prueba que dos eventos de fijar el mismo mensaje que
+// pasaron las comprobaciones a la vez solo se difunden una vez
+func TestFijadosRepetidosNoSeDifunden(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	enviarTexto(t, ana, "Reunión el lunes")
+	original := esperarMensaje(t, ana, contiene("Reunión el lunes"))
+
+	hub.broadcast <- NewPinMessage("ana", tipoFijar, original.ID)
+	hub.broadcast <- NewPinMessage("ana", tipoFijar, original.ID)
+	enviarTexto(t, ana, "fin")
+	eventos := 0
+	for _, m := range mensajesHasta(t, ana, "fin") {
+		if m.Type == tipoFijar {
+			eventos++
+		}
+	}
+	if eventos != 1 {
+		t.Errorf("Se esperaba 1 evento de fijado, obtuvimos %d", eventos)
+	}
+}
+
+// TestFijarMensajes prueba los permisos, los eventos y los fijados en el historial inicial
+func TestFijarMensajes(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	hub.SetAdmins([]string{"admin"})
+	hub.SetClaveAdmin("secreta")
+	ana := conectarEnMemoria(t, hub, "ana")
+	admin := conectarEnMemoria(t, hub, "admin&token=secreta")
+
+	enviarTexto(t, ana, "Enlace al documento de diseño")
+	original := esperarMensaje(t, admin, contiene("documento de diseño"))
+
+	enviarJSON(t, ana, map[string]interface{}{"type": "pin", "message_id": original.ID})
+	esperarMensaje(t, ana, contiene("Solo los administradores"))
+
+	enviarJSON(t, admin, map[string]interface{}{"type": "pin", "message_id": original.ID})
+	evento := esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoFijar })
+	if evento.MessageID != original.ID || evento.Username != "admin" {
+		t.Errorf("Evento de fijado inesperado: %+v", evento)
+	}
+
+	nuevo := conectarEnMemoria(t, hub, "nuevo")
+	historial := esperarMensaje(t, nuevo, func(m *Message) bool { return m.Type == tipoHistorial })
+	if len(historial.Pins) != 1 || historial.Pins[0].ID != original.ID {
+		t.Errorf("El historial inicial debería incluir el fijado: %+v", historial.Pins)
+	}
+
+	// Con la política abierta cualquiera puede desfijar
+	if err := hub.SetPoliticaFijado(FijadoTodos); err != nil {
+		t.Fatal(err)
+	}
+	enviarJSON(t, ana, map[string]interface{}{"type": "unpin", "message_id": original.ID})
+	esperarMensaje(t, nuevo, func(m *Message) bool { return m.Type == tipoDesfijar })
+	enviarJSON(t, nuevo, map[string]interface{}{"type": "pins"})
+	if fijados := esperarMensaje(t, nuevo, func(m *Message) bool { return m.Type == tipoFijados }); len(fijados.Pins) != 0 {
+		t.Errorf("No debería quedar ningún fijado: %+v", fijados.Pins)
+	}
+	if err := hub.SetPoliticaFijado("nadie"); err == nil {
+		t.Error("Se esperaba error con una política desconocida")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Estados de presencia de un usuario conectado
+const (
+	presenciaActivo   = "active"
+	presenciaInactivo = "idle" // sin actividad durante umbralInactividad
+	presenciaAusente  = "away" // el cliente avisó de que no está (pestaña oculta, etc.)
+)
+
+// Eventos de presencia que no son un estado
+const (
+	presenciaEntra      = "joined"
+	presenciaSale       = "left"
+	presenciaRenombrado = "renamed"
+)
+
+// Valores por defecto de la detección de inactividad
+const (
+	umbralInactividadPorDefecto  = 5 * time.Minute
+	intervaloPresenciaPorDefecto = 15 * time.Second
+)
+
+// EstadoPresencia es la entrada de un usuario en la lista de conectados
+type EstadoPresencia struct {
+	Username string    `json:"username"`
+	Status   string    `json:"status"`
+	Since    time.Time `json:"since"`
+}
+
+// NewPresenceMessage crea un evento de presencia (entrada, salida o cambio de estado)
+func NewPresenceMessage(username, presencia string) *Message {
+	return &Message{
+		Username:  username,
+		Timestamp: time.Now(),
+		Type:      tipoPresencia,
+		Presence:  presencia,
+	}
+}
+
+// NewRosterMessage crea la foto completa de usuarios conectados que recibe un cliente al entrar
+func NewRosterMessage(roster []EstadoPresencia) *Message {
+	return &Message{
+		Username:  nombreSistema,
+		Timestamp: time.Now(),
+		Type:      tipoRoster,
+		Roster:    roster,
+	}
+}
+
+// registrarActividad anota que el usuario ha hecho algo en esta sesión
+func (c *Client) registrarActividad() {
+	c.ultimaActividad.Store(time.Now().UnixNano())
+}
+
+// estadoCalculadoLocked deduce el estado de un usuario a partir de todas sus sesiones:
+// activo si alguna sesión tuvo actividad reciente y no está ausente, ausente si todas
+// avisaron de ausencia e inactivo en otro caso. Requiere clientsMutex tomado
+func (h *Hub) estadoCalculadoLocked(nombre string, ahora time.Time) string {
+	todasAusentes := true
+	for client := range h.sesiones[nombre] {
+		if client.ausente.Load() {
+			continue
+		}
+		todasAusentes = false
+		ultima := time.Unix(0, client.ultimaActividad.Load())
+		if ahora.Sub(ultima) < h.umbralInactividad {
+			return presenciaActivo
+		}
+	}
+	if todasAusentes {
+		return presenciaAusente
+	}
+	return presenciaInactivo
+}
+
+// actualizarPresenciaLocked recalcula el estado de un usuario y devuelve el evento a
+// difundir si cambió, o nil. Requiere clientsMutex tomado en escritura
+func (h *Hub) actualizarPresenciaLocked(nombre string, ahora time.Time) *Message {
+	estado, ok := h.presencia[nombre]
+	if !ok {
+		return nil
+	}
+	nuevo := h.estadoCalculadoLocked(nombre, ahora)
+	if nuevo == estado.Status {
+		return nil
+	}
+	estado.Status, estado.Since = nuevo, ahora
+	return NewPresenceMessage(nombre, nuevo)
+}
+
+// revisarPresencia recorre los usuarios conectados buscando cambios de estado.
+// Se ejecuta periódicamente desde Run
+func (h *Hub) revisarPresencia() {
+	ahora := time.Now()
+	var eventos []*Message
+	h.clientsMutex.Lock()
+	for nombre := range h.presencia {
+		if evento := h.actualizarPresenciaLocked(nombre, ahora); evento != nil {
+			eventos = append(eventos, evento)
+		}
+	}
+	h.clientsMutex.Unlock()
+
+	for _, evento := range eventos {
+		h.broadcastMessage(evento)
+	}
+}
+
+// notificarActividad avisa al hub de que una sesión cambió de actividad o de ausencia,
+// solo si eso puede cambiar el estado publicado. Se llama desde goroutineLectura
+func (h *Hub) notificarActividad(client *Client) {
+	h.clientsMutex.RLock()
+	estado, ok := h.presencia[client.nombre()]
+	pendiente := ok && estado.Status != h.estadoCalculadoLocked(client.nombre(), time.Now())
+	h.clientsMutex.RUnlock()
+	if !pendiente {
+		return
+	}
+	select {
+	case h.cambiosPresencia <- client:
+	default:
+		// El siguiente repaso periódico recogerá el cambio
+	}
+}
+
+// rosterLocked devuelve la lista de presencia ordenada por nombre. Requiere clientsMutex tomado
+func (h *Hub) rosterLocked() []EstadoPresencia {
+	// Incluye a los usuarios conectados a otros nodos de la sala
+	estados := h.estadosLocked()
+	roster := make([]EstadoPresencia, 0, len(estados))
+	for _, estado := range estados {
+		roster = append(roster, estado)
+	}
+	sort.Slice(roster, func(i, j int) bool { return roster[i].Username < roster[j].Username })
+	return roster
+}
+
+// GetRoster devuelve los usuarios conectados con su estado de presencia
+func (h *Hub) GetRoster() []EstadoPresencia {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	return h.rosterLocked()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestRosterAlRegistrarse prueba que lo primero que recibe un cliente es la lista de conectados
+func TestRosterAlRegistrarse(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := abrirEnMemoria(t, hub, "luis")
+
+	var primero Message
+	luis.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, datos, err := luis.ReadMessage(); err != nil {
+		t.Fatalf("Error al leer la lista de conectados: %v", err)
+	} else if err := json.Unmarshal(datos, &primero); err != nil {
+		t.Fatalf("Error al deserializar la lista de conectados: %v", err)
+	}
+	if primero.Type != tipoRoster || len(primero.Roster) != 2 {
+		t.Fatalf("Se esperaba una lista con 2 usuarios, obtuvimos %+v", primero)
+	}
+	if primero.Roster[0].Username != "ana" || primero.Roster[1].Username != "luis" {
+		t.Errorf("Lista inesperada: %+v", primero.Roster)
+	}
+	for _, estado := range primero.Roster {
+		if estado.Status != presenciaActivo {
+			t.Errorf("Se esperaba %s activo, obtuvimos %s", estado.Username, estado.Status)
+		}
+	}
+
+	// Los demás reciben un evento estructurado, no un texto
+	esperarMensaje(t, ana, esPresencia("luis", presenciaEntra))
+}
+
+// TestPresenciaInactividad prueba el paso a inactivo y la vuelta a activo al escribir
+func TestPresenciaInactividad(t *testing.T) {
+	hub := NewHub()
+	hub.umbralInactividad = 150 * time.Millisecond
+	hub.intervaloPresencia = 50 * time.Millisecond
+	go hub.Run()
+
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	esperarMensaje(t, luis, esPresencia("ana", presenciaInactivo))
+
+	enviarTexto(t, ana, "sigo aquí")
+	esperarMensaje(t, luis, esPresencia("ana", presenciaActivo))
+}
+
+// TestPresenciaAusente prueba el aviso explícito de ausencia del cliente
+func TestPresenciaAusente(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarJSON(t, ana, map[string]interface{}{"type": "presence", "presence": "away"})
+	esperarMensaje(t, luis, esPresencia("ana", presenciaAusente))
+
+	for _, estado := range hub.GetRoster() {
+		if estado.Username == "ana" && estado.Status != presenciaAusente {
+			t.Errorf("Se esperaba ana ausente en la lista, obtuvimos %s", estado.Status)
+		}
+	}
+
+	enviarJSON(t, ana, map[string]interface{}{"type": "presence", "presence": "active"})
+	esperarMensaje(t, luis, esPresencia("ana", presenciaActivo))
+}
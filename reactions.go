@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Límites de las reacciones
+const (
+	maxReaccionesPorMensaje = 20 // emojis distintos en un mismo mensaje
+	maxLongitudReaccion     = 10 // en runas: cubre secuencias con ZWJ, tonos de piel y banderas
+)
+
+var (
+	errReaccionInvalida     = errors.New("Esa reacción no es válida.")
+	errDemasiadasReacciones = errors.New("Ese mensaje ya tiene demasiadas reacciones distintas.")
+)
+
+// NewReactionMessage crea el evento que añade o quita la reacción de un usuario a un mensaje.
+// Solo lleva el cambio, no el recuento: cada cliente lo aplica sobre lo que ya tiene
+func NewReactionMessage(username, tipo, messageID, emoji string) *Message {
+	return &Message{
+		ID:        nuevoIDMensaje(),
+		Username:  username,
+		Timestamp: time.Now(),
+		Type:      tipo,
+		MessageID: messageID,
+		Emoji:     emoji,
+	}
+}
+
+// reaccionValida comprueba que la reacción es un texto corto sin espacios
+func reaccionValida(emoji string) bool {
+	return emoji != "" && utf8.ValidString(emoji) &&
+		utf8.RuneCountInString(emoji) <= maxLongitudReaccion &&
+		!strings.ContainsAny(emoji, " \t\r\n")
+}
+
+// reaccionar valida una reacción y difunde el cambio. Repetir una reacción ya puesta
+// (o quitar una que no está) no hace nada. Las comprobaciones de aquí sirven para
+// responder con un error; la que cuenta es la de Historial.Reaccionar al difundir
+func (h *Hub) reaccionar(client *Client, tipo, messageID, emoji string) error {
+	emoji = strings.TrimSpace(emoji)
+	if !reaccionValida(emoji) {
+		return errReaccionInvalida
+	}
+	original, ok := h.historial.Buscar(messageID)
+	if !ok || (original.Type != tipoUsuario && original.Type != tipoAccion) {
+		return errMensajeNoEncontrado
+	}
+	if original.Deleted {
+		return errMensajeBorrado
+	}
+	usuarios, existe := original.Reactions[emoji]
+	yaPuesta := contieneUsuario(usuarios, client.nombre())
+	if tipo == tipoReaccionAgregar {
+		if yaPuesta {
+			return nil
+		}
+		if !existe && len(original.Reactions) >= maxReaccionesPorMensaje {
+			return errDemasiadasReacciones
+		}
+	} else if !yaPuesta {
+		return nil
+	}
+	h.broadcast <- NewReactionMessage(client.nombre(), tipo, messageID, emoji)
+	return nil
+}
+
+// Reaccionar añade o quita la reacción de un usuario a un mensaje guardado, respetando
+// el límite de emojis distintos. Devuelve false si no cambió nada
+func (hist *Historial) Reaccionar(id, usuario, emoji string, agregar bool) bool {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	message := hist.buscarLocked(id)
+	if message == nil || message.Deleted {
+		return false
+	}
+	usuarios, existe := message.Reactions[emoji]
+	if contieneUsuario(usuarios, usuario) == agregar {
+		return false
+	}
+	// reaccionar ya lo comprobó, pero otras reacciones pueden haberse aplicado entre medias
+	if agregar && !existe && len(message.Reactions) >= maxReaccionesPorMensaje {
+		return false
+	}
+	if agregar {
+		if message.Reactions == nil {
+			message.Reactions = make(map[string][]string)
+		}
+		usuarios = append(usuarios, usuario)
+		sort.Strings(usuarios)
+		message.Reactions[emoji] = usuarios
+		return true
+	}
+	restantes := make([]string, 0, len(usuarios)-1)
+	for _, u := range usuarios {
+		if u != usuario {
+			restantes = append(restantes, u)
+		}
+	}
+	if len(restantes) == 0 {
+		delete(message.Reactions, emoji)
+	} else {
+		message.Reactions[emoji] = restantes
+	}
+	return true
+}
+
+// contieneUsuario indica si el usuario está en la lista
+func contieneUsuario(usuarios []string, usuario string) bool {
+	for _, u := range usuarios {
+		if u == usuario {
+			return true
+		}
+	}
+	return false
+}
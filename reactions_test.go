@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// TestHistorialReacciones prueba el agregado de reacciones por mensaje
+func TestHistorialReacciones(t *testing.T) {
+	hist := NewHistorial(10)
+	message := NewUserMessage("ana", "¿Pizza el viernes?")
+	hist.Agregar(message)
+
+	hist.Reaccionar(message.ID, "luis", "👍", true)
+	hist.Reaccionar(message.ID, "eva", "👍", true)
+	if hist.Reaccionar(message.ID, "eva", "👍", true) {
+		t.Error("Repetir una reacción no debería cambiar nada")
+	}
+	hist.Reaccionar(message.ID, "luis", "🍕", true)
+	hist.Reaccionar(message.ID, "luis", "🍕", false)
+
+	guardado, _ := hist.Buscar(message.ID)
+	esperado := map[string][]string{"👍": {"eva", "luis"}}
+	if !reflect.DeepEqual(guardado.Reactions, esperado) {
+		t.Errorf("Se esperaba %v, obtuvimos %v", esperado, guardado.Reactions)
+	}
+
+	// Las copias no comparten el mapa con el historial
+	guardado.Reactions["👍"][0] = "intruso"
+	if otra, _ := hist.Buscar(message.ID); otra.Reactions["👍"][0] != "eva" {
+		t.Error("Modificar una copia no debería afectar al historial")
+	}
+
+	hist.RenombrarUsuario("luis", "luisito")
+	if otra, _ := hist.Buscar(message.ID); !reflect.DeepEqual(otra.Reactions["👍"], []string{"eva", "luisito"}) {
+		t.Errorf("La reacción debería seguir al nuevo nombre: %v", otra.Reactions)
+	}
+}
+
+// TestHistorialLimiteReacciones prueba que el límite de emojis distintos se aplica bajo
+// el lock del historial, aunque el evento haya pasado las comprobaciones previas
+func TestHistorialLimiteReacciones(t *testing.T) {
+	hist := NewHistorial(10)
+	message := NewUserMessage("ana", "Vota con un emoji")
+	hist.Agregar(message)
+	for i := 0; i < maxReaccionesPorMensaje; i++ {
+		if !hist.Reaccionar(message.ID, "luis", fmt.Sprintf("e%d", i), true) {
+			t.Fatalf("La reacción %d debería caber", i)
+		}
+	}
+	if hist.Reaccionar(message.ID, "eva", "sobra", true) {
+		t.Error("Se superó el límite de reacciones distintas")
+	}
+	if !hist.Reaccionar(message.ID, "eva", "e0", true) {
+		t.Error("Sumarse a una reacción existente no debería contar para el límite")
+	}
+}
+
+// TestReaccionesRepetidasNoSeDifunden prueba que dos eventos iguales que pasaron las
+// comprobaciones a la vez solo se difunden una vez
+func TestReaccionesRepetidasNoSeDifunden(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	enviarTexto(t, ana, "¿Café?")
+	original := esperarMensaje(t, ana, contiene("¿Café?"))
+
+	hub.broadcast <- NewReactionMessage("ana", tipoReaccionAgregar, original.ID, "☕")
+	hub.broadcast <- NewReactionMessage("ana", tipoReaccionAgregar, original.ID, "☕")
+	enviarTexto(t, ana, "fin")
+	eventos := 0
+	for _, m := range mensajesHasta(t, ana, "fin") {
+		if m.Type == tipoReaccionAgregar {
+			eventos++
+		}
+	}
+	if eventos != 1 {
+		t.Errorf("Se esperaba 1 evento de reacción, obtuvimos %d", eventos)
+	}
+}
+
+// TestReaccionesDifundidas prueba los eventos de reacción y su inclusión en el historial inicial
+func TestReaccionesDifundidas(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarTexto(t, ana, "Nueva versión publicada")
+	original := esperarMensaje(t, luis, contiene("Nueva versión publicada"))
+
+	enviarJSON(t, luis, map[string]interface{}{"type": "reaction_add", "message_id": original.ID, "emoji": "🎉"})
+	evento := esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoReaccionAgregar })
+	if evento.MessageID != original.ID || evento.Emoji != "🎉" || evento.Username != "luis" {
+		t.Errorf("Evento de reacción inesperado: %+v", evento)
+	}
+
+	enviarJSON(t, luis, map[string]interface{}{"type": "reaction_add", "message_id": original.ID, "emoji": "no vale"})
+	esperarMensaje(t, luis, contiene("no es válida"))
+
+	nuevo := conectarEnMemoria(t, hub, "nuevo")
+	historial := esperarMensaje(t, nuevo, func(m *Message) bool { return m.Type == tipoHistorial })
+	if len(historial.Messages) == 0 || !reflect.DeepEqual(historial.Messages[len(historial.Messages)-1].Reactions, map[string][]string{"🎉": {"luis"}}) {
+		t.Errorf("El historial debería incluir la reacción: %+v", historial.Messages)
+	}
+
+	enviarJSON(t, luis, map[string]interface{}{"type": "reaction_remove", "message_id": original.ID, "emoji": "🎉"})
+	quitada := esperarMensaje(t, nuevo, func(m *Message) bool { return m.Type == tipoReaccionQuitar })
+	if quitada.MessageID != original.ID || quitada.Emoji != "🎉" {
+		t.Errorf("Evento de reacción inesperado: %+v", quitada)
+	}
+}
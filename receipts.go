@@ -0,0 +1,41 @@
+package main
+
+import "time"
+
+// NewReceiptMessage crea el aviso de que un usuario leyó la sala hasta un mensaje
+func NewReceiptMessage(username, messageID string) *Message {
+	return &Message{
+		Username:  username,
+		Timestamp: time.Now(),
+		Type:      tipoRecibo,
+		MessageID: messageID,
+	}
+}
+
+// instantaneaHistorial prepara lo que recibe un usuario al conectarse: los mensajes
+// recientes, dónde se quedó leyendo, cuántos tiene sin leer, las marcas de los demás
+// y los mensajes fijados
+func (h *Hub) instantaneaHistorial(usuario string) *Message {
+	return &Message{
+		Username:    nombreSistema,
+		Timestamp:   time.Now(),
+		Type:        tipoHistorial,
+		Messages:    h.historial.Recientes(h.tamanoReplay),
+		LastRead:    h.historial.Marcador(usuario),
+		Unread:      h.historial.NoLeidos(usuario),
+		ReadMarkers: h.historial.Marcadores(),
+		Pins:        h.historial.Fijados(),
+	}
+}
+
+// marcarLeido guarda la marca de lectura de un usuario y avisa a la sala, incluidas sus
+// otras sesiones y los otros nodos, para que actualicen los "visto por" y los contadores
+// de no leídos
+func (h *Hub) marcarLeido(client *Client, messageID string) {
+	if !h.historial.MarcarLeido(client.nombre(), messageID) {
+		return
+	}
+	recibo := NewReceiptMessage(client.nombre(), messageID)
+	h.difundirEfimero(recibo, false)
+	h.publicarEfimero(recibo)
+}
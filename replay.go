@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Importar carga en el historial los mensajes de una transcripción exportada, conservando
+// sus IDs, fechas y estado (editado, borrado, fijado, reacciones). Los que no traen sala
+// pasan a la del hub. Devuelve cuántos mensajes se guardaron, sin contar los repetidos. Debe llamarse antes de Run
+func (h *Hub) Importar(mensajes []*Message) int {
+	importados := 0
+	for _, message := range mensajes {
+		if message.ID == "" {
+			message.ID = nuevoIDMensaje()
+		}
+		if !esPersistente(message) {
+			continue
+		}
+		if message.Room == "" {
+			message.Room = h.sala
+		}
+		// Las respuestas importadas vuelven a sumar en su raíz
+		message.ReplyCount = 0
+		// Una transcripción puede repetir IDs; solo cuentan los que se guardan
+		if h.historial.Agregar(message) {
+			importados++
+		}
+	}
+	return importados
+}
+
+// ImportarArchivo carga una transcripción JSON Lines en el historial
+func (h *Hub) ImportarArchivo(ruta string) (int, error) {
+	f, err := os.Open(ruta)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	mensajes, err := leerTranscripcion(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", ruta, err)
+	}
+	return h.Importar(mensajes), nil
+}
+
+// Reproductor vuelve a enviar una transcripción a un servidor en marcha como lo harían
+// sus autores: una conexión WebSocket por usuario, así los mensajes recorren el mismo
+// camino que en producción (ServeWS, goroutineLectura, Hub)
+type Reproductor struct {
+	// URL base del servidor (http://, https://, ws:// o wss://)
+	Servidor string
+	// Velocidad respecto al ritmo original: 1 reproduce los tiempos reales, 10 diez veces
+	// más rápido y 0 sin esperas
+	Velocidad float64
+	// Espera máxima entre dos mensajes (0 sin límite), para saltarse las pausas largas
+	MaxEspera time.Duration
+	// Clave de administración del servidor (ADMIN_SECRET). Con ella se puede conectar con
+	// nombres que ya tienen clave en el servidor; sin ella esos autores se rechazan
+	Token string
+
+	conexiones map[string]*websocket.Conn
+}
+
+// Tiempo máximo para que el servidor acepte o rechace una conexión del reproductor
+const timeoutAceptacionReproduccion = 10 * time.Second
+
+// urlWebSocket convierte la dirección del servidor en la URL de /ws para un usuario,
+// con su clave si la tiene
+func urlWebSocket(servidor, usuario, token string) (string, error) {
+	u, err := url.Parse(strings.TrimRight(servidor, "/"))
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("dirección de servidor no válida: %q", servidor)
+	}
+	u.Path += "/ws"
+	consulta := url.Values{"username": {usuario}}
+	if token != "" {
+		consulta.Set("token", token)
+	}
+	u.RawQuery = consulta.Encode()
+	return u.String(), nil
+}
+
+// conexion devuelve la conexión del usuario, abriéndola la primera vez. El primer frame
+// dice si el servidor aceptó la sesión: la foto de conectados si la registró, un aviso
+// del sistema y el cierre si la rechazó. Lo que envía después se lee y se descarta: un
+// cliente que no lee acabaría desconectado por lento
+func (r *Reproductor) conexion(usuario string) (*websocket.Conn, error) {
+	if conn, ok := r.conexiones[usuario]; ok {
+		return conn, nil
+	}
+	direccion, err := urlWebSocket(r.Servidor, usuario, r.Token)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(direccion, nil)
+	if err != nil {
+		return nil, fmt.Errorf("conectando como %s: %v", usuario, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeoutAceptacionReproduccion))
+	var primero Message
+	if err := conn.ReadJSON(&primero); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("conectando como %s: el servidor cerró la sesión: %v", usuario, err)
+	}
+	if primero.Type != tipoRoster {
+		conn.Close()
+		return nil, fmt.Errorf("conectando como %s: el servidor rechazó la sesión: %s", usuario, primero.MessageContent)
+	}
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	r.conexiones[usuario] = conn
+	return conn, nil
+}
+
+// solicitudReproduccion traduce un mensaje archivado a lo que enviaría el frontend.
+// Devuelve nil para lo que no se puede reproducir (avisos del sistema, mensajes borrados)
+func solicitudReproduccion(message *Message) map[string]interface{} {
+	if message.Deleted {
+		return nil
+	}
+	switch message.Type {
+	case tipoAccion:
+		return map[string]interface{}{"message_content": "/me " + message.MessageContent}
+	case tipoUsuario:
+		if message.ImagenData != "" {
+			return map[string]interface{}{
+				"message_content": message.MessageContent,
+				"imagen_data":     message.ImagenData,
+				"imagen_type":     message.ImagenType,
+			}
+		}
+		contenido := message.MessageContent
+		if strings.HasPrefix(contenido, "/") {
+			// Se escapa como lo escribió su autor ("//texto") para que no se tome por un comando
+			contenido = "/" + contenido
+		}
+		return map[string]interface{}{"message_content": contenido}
+	}
+	return nil
+}
+
+// espera calcula la pausa antes de un mensaje según el ritmo original
+func (r *Reproductor) espera(anterior, siguiente time.Time) time.Duration {
+	if r.Velocidad <= 0 || anterior.IsZero() || !siguiente.After(anterior) {
+		return 0
+	}
+	pausa := time.Duration(float64(siguiente.Sub(anterior)) / r.Velocidad)
+	if r.MaxEspera > 0 && pausa > r.MaxEspera {
+		pausa = r.MaxEspera
+	}
+	return pausa
+}
+
+// Reproducir envía los mensajes en orden respetando el ritmo y devuelve cuántos envió
+func (r *Reproductor) Reproducir(mensajes []*Message) (int, error) {
+	r.conexiones = make(map[string]*websocket.Conn)
+	defer func() {
+		for _, conn := range r.conexiones {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			conn.Close()
+		}
+	}()
+
+	enviados := 0
+	var anterior time.Time
+	for _, message := range mensajes {
+		solicitud := solicitudReproduccion(message)
+		if solicitud == nil {
+			continue
+		}
+		time.Sleep(r.espera(anterior, message.Timestamp))
+		anterior = message.Timestamp
+		conn, err := r.conexion(message.Username)
+		if err != nil {
+			return enviados, err
+		}
+		if err := conn.WriteJSON(solicitud); err != nil {
+			return enviados, fmt.Errorf("enviando como %s: %v", message.Username, err)
+		}
+		enviados++
+	}
+	return enviados, nil
+}
+
+// comandoReproducir implementa "chat-app replay archivo.jsonl"
+func comandoReproducir(args []string, salida io.Writer) error {
+	banderas := flag.NewFlagSet("replay", flag.ContinueOnError)
+	servidor := banderas.String("servidor", "http://localhost:8080", "Servidor en el que reproducir la transcripción")
+	velocidad := banderas.Float64("velocidad", 1, "Ritmo respecto al original (1 real, 10 diez veces más rápido, 0 sin esperas)")
+	maxEspera := banderas.Duration("max-espera", 0, "Pausa máxima entre mensajes (0 sin límite)")
+	token := banderas.String("token", "", "Clave de administración del servidor (ADMIN_SECRET), para autores que ya tienen clave en él")
+	if err := banderas.Parse(args); err != nil {
+		return err
+	}
+	if banderas.NArg() != 1 {
+		return errors.New("uso: chat-app replay [opciones] transcripcion.jsonl")
+	}
+	f, err := os.Open(banderas.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	mensajes, err := leerTranscripcion(f)
+	if err != nil {
+		return err
+	}
+
+	reproductor := &Reproductor{Servidor: *servidor, Velocidad: *velocidad, MaxEspera: *maxEspera, Token: *token}
+	inicio := time.Now()
+	enviados, err := reproductor.Reproducir(mensajes)
+	fmt.Fprintf(salida, "Reproducidos %d de %d mensajes en %s\n", enviados, len(mensajes), time.Since(inicio).Round(time.Millisecond))
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestImportarTranscripcion prueba que exportar e importar conserva el estado del historial
+func TestImportarTranscripcion(t *testing.T) {
+	origen := NewHub()
+	raiz := NewUserMessage("ana", "¿Quién lleva el acta?")
+	respuesta := NewUserMessage("luis", "Yo misma no, tú")
+	respuesta.ReplyTo = raiz.ID
+	for _, message := range []*Message{NewSystemMessage("ana se ha unido al chat"), raiz, respuesta} {
+		message.Room = salaPorDefecto
+		origen.historial.Agregar(message)
+	}
+	origen.historial.Fijar(raiz.ID, "admin", true)
+	origen.historial.Reaccionar(raiz.ID, "luis", "👍", true)
+
+	var transcripcion bytes.Buffer
+	if err := exportarJSONL(&transcripcion, origen.historial.Exportables(FiltroExportacion{})); err != nil {
+		t.Fatal(err)
+	}
+	mensajes, err := leerTranscripcion(&transcripcion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destino := NewHub()
+	if importados := destino.Importar(mensajes); importados != 3 {
+		t.Errorf("Se esperaban 3 mensajes importados, obtuvimos %d", importados)
+	}
+	if repetidos := destino.Importar(mensajes); repetidos != 0 {
+		t.Errorf("Volver a importar no debería guardar nada, obtuvimos %d", repetidos)
+	}
+	importada, _ := destino.historial.Buscar(raiz.ID)
+	if importada.ReplyCount != 1 || !importada.Pinned || !reflect.DeepEqual(importada.Reactions, map[string][]string{"👍": {"luis"}}) {
+		t.Errorf("El estado del mensaje no se conservó: %+v", importada)
+	}
+	if destino.historial.NumFijados() != 1 || len(destino.historial.BuscarTexto(Consulta{Texto: "acta"})) != 1 {
+		t.Error("Los fijados y el índice de búsqueda deberían incluir lo importado")
+	}
+}
+
+// TestSolicitudReproduccion prueba cómo se reenvía cada tipo de mensaje archivado
+func TestSolicitudReproduccion(t *testing.T) {
+	borrado := NewUserMessage("ana", "")
+	borrado.Deleted = true
+	casos := []struct {
+		message  *Message
+		esperado map[string]interface{}
+	}{
+		{NewUserMessage("ana", "hola"), map[string]interface{}{"message_content": "hola"}},
+		{NewUserMessage("ana", "/etc/hosts está mal"), map[string]interface{}{"message_content": "//etc/hosts está mal"}},
+		{NewActionMessage("ana", "saluda"), map[string]interface{}{"message_content": "/me saluda"}},
+		{envioImagen("ana", "foto", "aW1n", "image/png"), map[string]interface{}{"message_content": "foto", "imagen_data": "aW1n", "imagen_type": "image/png"}},
+		{NewSystemMessage("ana se ha unido al chat"), nil},
+		{borrado, nil},
+	}
+	for _, caso := range casos {
+		if obtenido := solicitudReproduccion(caso.message); !reflect.DeepEqual(obtenido, caso.esperado) {
+			t.Errorf("%+v: se esperaba %v, obtuvimos %v", caso.message, caso.esperado, obtenido)
+		}
+	}
+}
+
+// TestEsperaReproduccion prueba el ritmo acelerado y el límite de las pausas
+func TestEsperaReproduccion(t *testing.T) {
+	inicio := time.Now()
+	r := &Reproductor{Velocidad: 10, MaxEspera: 2 * time.Second}
+	if pausa := r.espera(inicio, inicio.Add(10*time.Second)); pausa != time.Second {
+		t.Errorf("Se esperaba 1s, obtuvimos %s", pausa)
+	}
+	if pausa := r.espera(inicio, inicio.Add(time.Hour)); pausa != 2*time.Second {
+		t.Errorf("La pausa debería limitarse a 2s, obtuvimos %s", pausa)
+	}
+	if pausa := (&Reproductor{}).espera(inicio, inicio.Add(time.Hour)); pausa != 0 {
+		t.Errorf("Sin velocidad no debería haber pausas, obtuvimos %s", pausa)
+	}
+}
+
+// TestReproducirEnServidor prueba la reproducción a través del hub real
+func TestReproducirEnServidor(t *testing.T) {
+	// El reproductor se conecta por WebSocket como cualquier cliente externo
+	hub := NewHub()
+	wsURL := servirHubPrueba(t, hub)
+	observador := conectarEnMemoria(t, hub, "observador")
+
+	inicio := time.Now().Add(-time.Hour)
+	transcripcion := []*Message{
+		NewUserMessage("ana", "Empieza la incidencia"),
+		NewActionMessage("luis", "reinicia el balanceador"),
+		NewSystemMessage("luis se ha ido del chat"),
+		NewUserMessage("ana", "Resuelto"),
+	}
+	for i, message := range transcripcion {
+		message.Timestamp = inicio.Add(time.Duration(i) * time.Second)
+	}
+
+	reproductor := &Reproductor{Servidor: "http" + strings.TrimPrefix(wsURL, "ws"), Velocidad: 100}
+	enviados, err := reproductor.Reproducir(transcripcion)
+	if err != nil || enviados != 3 {
+		t.Fatalf("Se esperaban 3 mensajes reproducidos: %d %v", enviados, err)
+	}
+	pendientes := map[string]bool{"Empieza la incidencia": true, "reinicia el balanceador": true, "Resuelto": true}
+	for len(pendientes) > 0 {
+		recibido := esperarMensaje(t, observador, func(m *Message) bool { return pendientes[m.MessageContent] })
+		delete(pendientes, recibido.MessageContent)
+	}
+}
+
+// TestReproducirRechazado prueba que una sesión rechazada por el servidor es un error y
+// no cuenta como enviada, y que con la clave de administración se puede reproducir con
+// nombres que ya tienen clave
+func TestReproducirRechazado(t *testing.T) {
+	hub := NewHub()
+	hub.SetClaveAdmin("secreta")
+	wsURL := servirHubPrueba(t, hub)
+	ana := conectarEnMemoria(t, hub, "ana")
+	transcripcion := []*Message{NewUserMessage("ana", "repetido")}
+
+	reproductor := &Reproductor{Servidor: "http" + strings.TrimPrefix(wsURL, "ws")}
+	enviados, err := reproductor.Reproducir(transcripcion)
+	if err == nil || enviados != 0 || !strings.Contains(err.Error(), "pertenece a otra persona") {
+		t.Errorf("Se esperaba el rechazo de ana: %d %v", enviados, err)
+	}
+
+	reproductor.Token = "secreta"
+	if enviados, err := reproductor.Reproducir(transcripcion); err != nil || enviados != 1 {
+		t.Fatalf("Con la clave de administración se esperaba 1 mensaje: %d %v", enviados, err)
+	}
+	esperarMensaje(t, ana, contiene("repetido"))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Espera máxima de las respuestas de los demás nodos al reservar un nombre. Un nodo que
+// no contesta a tiempo no bloquea la entrada: se prefiere la disponibilidad
+const timeoutReservaNombre = time.Second
+
+// reserva es un nombre apartado mientras se conecta o se renombra un usuario, antes de
+// que aparezca en la presencia publicada
+type reserva struct {
+	nodo string
+	// concedida indica que los demás nodos ya respondieron; mientras no lo está, dos
+	// reservas del mismo nombre se desempatan por el nombre del nodo
+	concedida bool
+	caduca    time.Time
+}
+
+// duracionReserva es lo que dura una reserva: lo bastante para que la presencia del nodo
+// que la hizo llegue a los demás
+func (h *Hub) duracionReserva() time.Duration {
+	return latidosPerdidos * h.intervaloLatido
+}
+
+// reservarNombre aparta un nombre en todo el cluster antes de usarlo. Pregunta a los
+// demás nodos conocidos y falla si alguno lo tiene en uso o reservado. Sin broker no
+// hace nada. No se debe llamar desde Run, que es quien procesa las respuestas
+func (h *Hub) reservarNombre(nombre string) error {
+	if h.broker == nil {
+		return nil
+	}
+	// Se espera a todos los nodos enlazados, aunque aún no hayan publicado su presencia:
+	// un nodo recién arrancado no ha oído a nadie y, contando solo esos, no esperaría a ninguno
+	esperadas := -1
+	if contador, ok := h.broker.(ContadorNodos); ok {
+		n, err := contador.NodosConectados()
+		if err != nil {
+			log.Printf("Reserva de %s: no se sabe cuántos nodos hay (%v)", nombre, err)
+		} else {
+			esperadas = n
+		}
+	}
+	ahora := time.Now()
+	h.clientsMutex.Lock()
+	if h.ocupadoEnOtroNodoLocked(nombre, ahora) {
+		h.clientsMutex.Unlock()
+		return errNombreEnUso
+	}
+	if esperadas < 0 {
+		esperadas = len(h.presenciaRemota)
+	}
+	id := nuevoIDMensaje()
+	respuestas := make(chan bool, esperadas)
+	h.consultasNombre[id] = respuestas
+	h.reservasPropias[nombre] = &reserva{nodo: h.nodo, caduca: ahora.Add(h.duracionReserva())}
+	h.clientsMutex.Unlock()
+
+	h.publicarSobre(&Sobre{Tipo: sobreReserva, ID: id, Nombre: nombre})
+	enUso := false
+	limite := time.After(timeoutReservaNombre)
+esperar:
+	for recibidas := 0; recibidas < esperadas && !enUso; recibidas++ {
+		select {
+		case ocupado := <-respuestas:
+			enUso = ocupado
+		case <-limite:
+			log.Printf("Reserva de %s: %d de %d nodos no respondieron a tiempo", nombre, esperadas-recibidas, esperadas)
+			break esperar
+		}
+	}
+
+	h.clientsMutex.Lock()
+	delete(h.consultasNombre, id)
+	// Mientras esperábamos pudimos ceder el nombre a otro nodo con prioridad
+	if enUso || h.ocupadoEnOtroNodoLocked(nombre, time.Now()) {
+		h.clientsMutex.Unlock()
+		h.soltarNombre(nombre)
+		return errNombreEnUso
+	}
+	// Queda apartado hasta que la presencia de este nodo lo muestre conectado
+	h.reservasPropias[nombre] = &reserva{nodo: h.nodo, concedida: true, caduca: time.Now().Add(h.duracionReserva())}
+	h.clientsMutex.Unlock()
+	return nil
+}
+
+// soltarNombre deshace una reserva de reservarNombre que no se va a usar y avisa a los
+// demás nodos. Sin broker no hace nada
+func (h *Hub) soltarNombre(nombre string) {
+	if h.broker == nil {
+		return
+	}
+	h.clientsMutex.Lock()
+	delete(h.reservasPropias, nombre)
+	h.clientsMutex.Unlock()
+	h.publicarSobre(&Sobre{Tipo: sobreLiberar, Nombre: nombre})
+}
+
+// comprobarNombreEnCluster reserva el nombre de quien se conecta, con cualquier política.
+// Con SesionesMultiples las sesiones de un nombre tienen que ir todas al mismo nodo: la
+// clave del nombre solo la conoce ese nodo, así que otro no podría distinguir al dueño
+// de quien se hace pasar por él
+func (h *Hub) comprobarNombreEnCluster(nombre string) error {
+	return h.reservarNombre(nombre)
+}
+
+// ocupadoEnOtroNodoLocked indica si otro nodo tiene el nombre conectado o reservado.
+// Requiere clientsMutex tomado
+func (h *Hub) ocupadoEnOtroNodoLocked(nombre string, ahora time.Time) bool {
+	if r, ok := h.reservasRemotas[nombre]; ok && ahora.Before(r.caduca) {
+		return true
+	}
+	return h.presenteEnOtroNodoLocked(nombre)
+}
+
+// responderReserva contesta a otro nodo que quiere un nombre. Se ejecuta desde Run
+func (h *Hub) responderReserva(sobre *Sobre) {
+	ahora := time.Now()
+	h.clientsMutex.Lock()
+	enUso := len(h.sesiones[sobre.Nombre]) > 0
+	if propia, ok := h.reservasPropias[sobre.Nombre]; ok && ahora.Before(propia.caduca) {
+		// Dos nodos piden el mismo nombre a la vez: gana el de nombre menor
+		enUso = enUso || propia.concedida || h.nodo < sobre.Nodo
+	}
+	if !enUso {
+		h.reservasRemotas[sobre.Nombre] = &reserva{nodo: sobre.Nodo, caduca: ahora.Add(h.duracionReserva())}
+	}
+	h.clientsMutex.Unlock()
+	h.publicarSobre(&Sobre{Tipo: sobreRespuestaReserva, ID: sobre.ID, Para: sobre.Nodo, EnUso: enUso})
+}
+
+// recibirRespuestaReserva entrega la respuesta de otro nodo a la reserva que la espera
+func (h *Hub) recibirRespuestaReserva(sobre *Sobre) {
+	if sobre.Para != h.nodo {
+		return
+	}
+	h.clientsMutex.RLock()
+	respuestas, ok := h.consultasNombre[sobre.ID]
+	h.clientsMutex.RUnlock()
+	if ok {
+		select {
+		case respuestas <- sobre.EnUso:
+		default:
+		}
+	}
+}
+
+// liberarReserva olvida el nombre que otro nodo reservó y al final no usó
+func (h *Hub) liberarReserva(sobre *Sobre) {
+	h.clientsMutex.Lock()
+	defer h.clientsMutex.Unlock()
+	if r, ok := h.reservasRemotas[sobre.Nombre]; ok && r.nodo == sobre.Nodo {
+		delete(h.reservasRemotas, sobre.Nombre)
+	}
+}
+
+// caducarReservasLocked borra las reservas vencidas. Requiere clientsMutex tomado en escritura
+func (h *Hub) caducarReservasLocked(ahora time.Time) {
+	for nombre, r := range h.reservasRemotas {
+		if !ahora.Before(r.caduca) {
+			delete(h.reservasRemotas, nombre)
+		}
+	}
+	for nombre, r := range h.reservasPropias {
+		if !ahora.Before(r.caduca) {
+			delete(h.reservasPropias, nombre)
+		}
+	}
+}
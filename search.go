@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Límites de resultados de una búsqueda
+const (
+	limiteBusquedaPorDefecto = 50
+	limiteBusquedaMaximo     = 200
+)
+
+var errConsultaVacia = errors.New("Indica qué buscar: texto, autor o fechas.")
+
+// Consulta describe una búsqueda en el historial. Texto admite palabras sueltas y frases
+// entre comillas; todas tienen que aparecer. Los filtros vacíos no se aplican
+type Consulta struct {
+	Texto  string
+	Autor  string
+	Sala   string
+	Desde  time.Time
+	Hasta  time.Time
+	Limite int
+}
+
+// Indice es un índice invertido de los mensajes: para cada palabra del texto, en qué
+// mensajes aparece y en qué posiciones, lo que permite buscar frases; y para cada
+// autor, sala y día, qué mensajes tienen ese valor. No tiene lock propio: lo protege el
+// mutex del Historial que lo contiene
+type Indice struct {
+	posiciones map[string]map[string][]int
+	autores    map[string]map[string]bool
+	salas      map[string]map[string]bool
+	// Día (AAAA-MM-DD en UTC) en que se envió cada mensaje
+	dias map[string]map[string]bool
+	// Lo indexado de cada mensaje, para poder quitarlo
+	entradas map[string]*entradaIndice
+}
+
+// entradaIndice es lo que el índice guarda de un mensaje
+type entradaIndice struct {
+	palabras         []string
+	autor, sala, dia string
+}
+
+// NewIndice crea un índice vacío
+func NewIndice() *Indice {
+	return &Indice{
+		posiciones: make(map[string]map[string][]int),
+		autores:    make(map[string]map[string]bool),
+		salas:      make(map[string]map[string]bool),
+		dias:       make(map[string]map[string]bool),
+		entradas:   make(map[string]*entradaIndice),
+	}
+}
+
+// claveDia es la clave del índice de fechas: el día UTC del instante
+func claveDia(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// anotar añade id al conjunto de mensajes con ese valor
+func anotar(conjuntos map[string]map[string]bool, valor, id string) {
+	if conjuntos[valor] == nil {
+		conjuntos[valor] = make(map[string]bool)
+	}
+	conjuntos[valor][id] = true
+}
+
+// desanotar quita id del conjunto de mensajes con ese valor
+func desanotar(conjuntos map[string]map[string]bool, valor, id string) {
+	delete(conjuntos[valor], id)
+	if len(conjuntos[valor]) == 0 {
+		delete(conjuntos, valor)
+	}
+}
+
+// normalizar pasa a minúsculas y quita tildes y eñes para que "decision" encuentre
+// "decisión" y "diseno" encuentre "diseño"
+func normalizar(r rune) rune {
+	switch r = unicode.ToLower(r); r {
+	case 'á', 'à', 'ä':
+		return 'a'
+	case 'é', 'è', 'ë':
+		return 'e'
+	case 'í', 'ì', 'ï':
+		return 'i'
+	case 'ó', 'ò', 'ö':
+		return 'o'
+	case 'ú', 'ù', 'ü':
+		return 'u'
+	case 'ñ':
+		return 'n'
+	}
+	return r
+}
+
+// tokenizar divide un texto en palabras normalizadas. Los enlaces quedan partidos en sus
+// trozos ("ejemplo.com/doc" da ejemplo, com, doc), que se pueden buscar como frase
+func tokenizar(texto string) []string {
+	campos := strings.FieldsFunc(texto, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, campo := range campos {
+		campos[i] = strings.Map(normalizar, campo)
+	}
+	return campos
+}
+
+// Agregar indexa el texto, el autor, la sala y el día de un mensaje
+func (ind *Indice) Agregar(message *Message) {
+	entrada := &entradaIndice{
+		palabras: tokenizar(message.MessageContent),
+		autor:    strings.ToLower(message.Username),
+		sala:     message.Room,
+		dia:      claveDia(message.Timestamp),
+	}
+	ind.entradas[message.ID] = entrada
+	for posicion, palabra := range entrada.palabras {
+		if ind.posiciones[palabra] == nil {
+			ind.posiciones[palabra] = make(map[string][]int)
+		}
+		ind.posiciones[palabra][message.ID] = append(ind.posiciones[palabra][message.ID], posicion)
+	}
+	anotar(ind.autores, entrada.autor, message.ID)
+	anotar(ind.salas, entrada.sala, message.ID)
+	anotar(ind.dias, entrada.dia, message.ID)
+}
+
+// Quitar elimina un mensaje del índice
+func (ind *Indice) Quitar(id string) {
+	entrada, ok := ind.entradas[id]
+	if !ok {
+		return
+	}
+	for _, palabra := range entrada.palabras {
+		delete(ind.posiciones[palabra], id)
+		if len(ind.posiciones[palabra]) == 0 {
+			delete(ind.posiciones, palabra)
+		}
+	}
+	desanotar(ind.autores, entrada.autor, id)
+	desanotar(ind.salas, entrada.sala, id)
+	desanotar(ind.dias, entrada.dia, id)
+	delete(ind.entradas, id)
+}
+
+// frasesConsulta separa el texto de una consulta en frases: lo que va entre comillas es
+// una frase y cada palabra suelta es una frase de una palabra
+func frasesConsulta(texto string) [][]string {
+	var frases [][]string
+	for i, trozo := range strings.Split(texto, `"`) {
+		if i%2 == 1 {
+			if frase := tokenizar(trozo); len(frase) > 0 {
+				frases = append(frases, frase)
+			}
+			continue
+		}
+		for _, palabra := range tokenizar(trozo) {
+			frases = append(frases, []string{palabra})
+		}
+	}
+	return frases
+}
+
+// Coincidencias devuelve los mensajes que contienen todas las frases
+func (ind *Indice) Coincidencias(frases [][]string) map[string]bool {
+	var resultado map[string]bool
+	for _, frase := range frases {
+		encontrados := make(map[string]bool)
+		for id, inicios := range ind.posiciones[frase[0]] {
+			if resultado != nil && !resultado[id] {
+				continue
+			}
+			if ind.contieneFrase(id, inicios, frase) {
+				encontrados[id] = true
+			}
+		}
+		resultado = encontrados
+		if len(resultado) == 0 {
+			break
+		}
+	}
+	return resultado
+}
+
+// contieneFrase comprueba si la frase aparece seguida en el mensaje a partir de alguno de los inicios
+func (ind *Indice) contieneFrase(id string, inicios []int, frase []string) bool {
+	palabras := ind.entradas[id].palabras
+	for _, inicio := range inicios {
+		if inicio+len(frase) > len(palabras) {
+			continue
+		}
+		coincide := true
+		for i, palabra := range frase[1:] {
+			if palabras[inicio+1+i] != palabra {
+				coincide = false
+				break
+			}
+		}
+		if coincide {
+			return true
+		}
+	}
+	return false
+}
+
+// esBuscable indica si un mensaje guardado entra en el índice: solo la conversación
+func esBuscable(message *Message) bool {
+	return (message.Type == tipoUsuario || message.Type == tipoAccion) && !message.Deleted
+}
+
+// intersecar deja en candidatos solo los que también están en otros. Con candidatos nil
+// (aún sin filtrar) empieza por una copia de otros
+func intersecar(candidatos, otros map[string]bool) map[string]bool {
+	if candidatos == nil {
+		candidatos = make(map[string]bool, len(otros))
+		for id := range otros {
+			candidatos[id] = true
+		}
+		return candidatos
+	}
+	for id := range candidatos {
+		if !otros[id] {
+			delete(candidatos, id)
+		}
+	}
+	return candidatos
+}
+
+// Candidatos devuelve los mensajes que cumplen todos los filtros de la consulta según el
+// índice, o nil si la consulta no filtra por nada. Las fechas se buscan por día: el
+// límite exacto lo comprueba quien llama
+func (ind *Indice) Candidatos(consulta Consulta, frases [][]string) map[string]bool {
+	var candidatos map[string]bool
+	if len(frases) > 0 {
+		candidatos = ind.Coincidencias(frases)
+	}
+	if consulta.Autor != "" {
+		candidatos = intersecar(candidatos, ind.autores[strings.ToLower(consulta.Autor)])
+	}
+	if consulta.Sala != "" {
+		candidatos = intersecar(candidatos, ind.salas[consulta.Sala])
+	}
+	if !consulta.Desde.IsZero() || !consulta.Hasta.IsZero() {
+		// Se recorren los días con mensajes, no los mensajes
+		enFechas := make(map[string]bool)
+		for dia, ids := range ind.dias {
+			if (!consulta.Desde.IsZero() && dia < claveDia(consulta.Desde)) ||
+				(!consulta.Hasta.IsZero() && dia > claveDia(consulta.Hasta)) {
+				continue
+			}
+			for id := range ids {
+				enFechas[id] = true
+			}
+		}
+		candidatos = intersecar(candidatos, enFechas)
+	}
+	return candidatos
+}
+
+// BuscarTexto devuelve copias de los mensajes del historial que cumplen la consulta, del
+// más reciente al más antiguo. Los filtros se resuelven en el índice; solo los
+// candidatos se comprueban uno a uno
+func (hist *Historial) BuscarTexto(consulta Consulta) []*Message {
+	limite := consulta.Limite
+	if limite <= 0 {
+		limite = limiteBusquedaPorDefecto
+	}
+	if limite > limiteBusquedaMaximo {
+		limite = limiteBusquedaMaximo
+	}
+	frases := frasesConsulta(consulta.Texto)
+	if consulta.Texto != "" && len(frases) == 0 {
+		// Solo signos de puntuación: no hay nada que pueda coincidir
+		return nil
+	}
+
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	var orden []*Message
+	if candidatos := hist.indice.Candidatos(consulta, frases); candidatos != nil {
+		posiciones := make([]int, 0, len(candidatos))
+		for id := range candidatos {
+			if posicion, ok := hist.posiciones[id]; ok {
+				posiciones = append(posiciones, posicion-hist.descartados)
+			}
+		}
+		sort.Ints(posiciones)
+		for _, posicion := range posiciones {
+			orden = append(orden, hist.mensajes[posicion])
+		}
+	} else {
+		orden = hist.mensajes
+	}
+	var resultados []*Message
+	for i := len(orden) - 1; i >= 0 && len(resultados) < limite; i-- {
+		message := orden[i]
+		if !esBuscable(message) {
+			continue
+		}
+		if (!consulta.Desde.IsZero() && message.Timestamp.Before(consulta.Desde)) ||
+			(!consulta.Hasta.IsZero() && message.Timestamp.After(consulta.Hasta)) {
+			continue
+		}
+		resultados = append(resultados, message.copia())
+	}
+	return resultados
+}
+
+// NewSearchMessage crea la respuesta a una búsqueda hecha por el WebSocket
+func NewSearchMessage(texto string, resultados []*Message) *Message {
+	return &Message{
+		Username:       nombreSistema,
+		MessageContent: texto,
+		Timestamp:      time.Now(),
+		Type:           tipoBusqueda,
+		Messages:       resultados,
+	}
+}
+
+// leerFecha acepta una fecha RFC 3339 o un día (AAAA-MM-DD). Con finDelDia, un día
+// se interpreta como su último instante, para que "hasta el martes" incluya el martes
+func leerFecha(valor string, finDelDia bool) (time.Time, error) {
+	if valor == "" {
+		return time.Time{}, nil
+	}
+	if fecha, err := time.Parse(time.RFC3339, valor); err == nil {
+		return fecha, nil
+	}
+	dia, err := time.ParseInLocation("2006-01-02", valor, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("Fecha no válida: usa AAAA-MM-DD o RFC 3339.")
+	}
+	if finDelDia {
+		dia = dia.Add(24*time.Hour - time.Nanosecond)
+	}
+	return dia, nil
+}
+
+// nuevaConsulta arma una consulta a partir de los campos que llegan del cliente
+func nuevaConsulta(texto, autor, sala, desde, hasta string, limite int) (Consulta, error) {
+	consulta := Consulta{
+		Texto:  strings.TrimSpace(texto),
+		Autor:  strings.TrimSpace(autor),
+		Sala:   strings.TrimSpace(sala),
+		Limite: limite,
+	}
+	var err error
+	if consulta.Desde, err = leerFecha(desde, false); err != nil {
+		return consulta, err
+	}
+	if consulta.Hasta, err = leerFecha(hasta, true); err != nil {
+		return consulta, err
+	}
+	if consulta.Texto == "" && consulta.Autor == "" && consulta.Desde.IsZero() && consulta.Hasta.IsZero() {
+		return consulta, errConsultaVacia
+	}
+	return consulta, nil
+}
+
+// buscar responde a una búsqueda hecha por el WebSocket solo a quien la pidió
+func (h *Hub) buscar(client *Client, consulta Consulta) {
+	h.enviarACliente(client, NewSearchMessage(consulta.Texto, h.historial.BuscarTexto(consulta)))
+}
+
+// ServeSearch atiende GET /search?q=...&author=...&room=...&from=...&to=...&limit=...
+// y devuelve los resultados en JSON, del más reciente al más antiguo. Pide una clave del
+// chat, como ServeExport
+func ServeSearch(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	if !hub.autorizarHistorial(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	limite, _ := strconv.Atoi(q.Get("limit"))
+	consulta, err := nuevaConsulta(q.Get("q"), q.Get("author"), q.Get("room"), q.Get("from"), q.Get("to"), limite)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resultados := hub.historial.BuscarTexto(consulta)
+	if resultados == nil {
+		resultados = []*Message{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": resultados})
+}
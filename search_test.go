@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestTokenizar prueba la normalización de palabras del índice
+func TestTokenizar(t *testing.T) {
+	obtenido := tokenizar("¿Decisión tomada? Ver https://Ejemplo.com/doc")
+	esperado := []string{"decision", "tomada", "ver", "https", "ejemplo", "com", "doc"}
+	if !reflect.DeepEqual(obtenido, esperado) {
+		t.Errorf("Se esperaba %v, obtuvimos %v", esperado, obtenido)
+	}
+}
+
+// mensajeEn crea un mensaje de usuario con una fecha concreta
+func mensajeEn(usuario, texto string, fecha time.Time) *Message {
+	message := NewUserMessage(usuario, texto)
+	message.Timestamp = fecha
+	message.Room = salaPorDefecto
+	return message
+}
+
+// TestBuscarTexto prueba frases, filtros y que el índice siga los cambios del historial
+func TestBuscarTexto(t *testing.T) {
+	martes := time.Date(2024, 5, 14, 10, 0, 0, 0, time.Local)
+	hist := NewHistorial(4)
+	enlace := mensajeEn("ana", "El enlace del diseño: https://docs.ejemplo.com/diseno", martes)
+	otro := mensajeEn("luis", "Diseño aprobado, el enlace lo paso luego", martes.Add(time.Hour))
+	viejo := mensajeEn("ana", "enlace antiguo", martes.Add(-48*time.Hour))
+	hist.Agregar(viejo)
+	hist.Agregar(enlace)
+	hist.Agregar(otro)
+
+	ids := func(mensajes []*Message) []string {
+		var lista []string
+		for _, m := range mensajes {
+			lista = append(lista, m.ID)
+		}
+		return lista
+	}
+	casos := []struct {
+		nombre   string
+		consulta Consulta
+		esperado []string
+	}{
+		{"palabras en cualquier orden", Consulta{Texto: "enlace diseno"}, []string{otro.ID, enlace.ID}},
+		{"frase exacta", Consulta{Texto: `"enlace del diseño"`}, []string{enlace.ID}},
+		{"frase de un enlace", Consulta{Texto: `"ejemplo.com"`}, []string{enlace.ID}},
+		{"autor", Consulta{Texto: "enlace", Autor: "ANA"}, []string{enlace.ID, viejo.ID}},
+		{"rango de fechas", Consulta{Texto: "enlace", Desde: martes.Add(-time.Hour), Hasta: martes.Add(30 * time.Minute)}, []string{enlace.ID}},
+		{"sala", Consulta{Texto: "enlace", Sala: "otra"}, nil},
+		{"solo autor", Consulta{Autor: "luis"}, []string{otro.ID}},
+		{"solo desde", Consulta{Desde: martes.Add(-time.Hour)}, []string{otro.ID, enlace.ID}},
+		{"autor y hasta", Consulta{Autor: "ana", Hasta: martes.Add(-time.Hour)}, []string{viejo.ID}},
+		{"sin coincidencias", Consulta{Texto: "pizza"}, nil},
+		{"solo puntuación", Consulta{Texto: "¿?"}, nil},
+	}
+	for _, caso := range casos {
+		if obtenido := ids(hist.BuscarTexto(caso.consulta)); !reflect.DeepEqual(obtenido, caso.esperado) {
+			t.Errorf("%s: se esperaba %v, obtuvimos %v", caso.nombre, caso.esperado, obtenido)
+		}
+	}
+
+	hist.Editar(otro.ID, "Aprobado", time.Now())
+	hist.Borrar(viejo.ID)
+	if obtenido := ids(hist.BuscarTexto(Consulta{Texto: "enlace"})); !reflect.DeepEqual(obtenido, []string{enlace.ID}) {
+		t.Errorf("Ediciones y borrados deberían reflejarse en el índice: %v", obtenido)
+	}
+
+	// Lo que sale del historial sale también del índice
+	for i := 0; i < 4; i++ {
+		hist.Agregar(NewUserMessage("eva", "relleno"))
+	}
+	if len(hist.BuscarTexto(Consulta{Texto: "enlace"})) != 0 || len(hist.indice.entradas) != 4 {
+		t.Errorf("El índice debería contener solo los mensajes guardados: %d", len(hist.indice.entradas))
+	}
+	if len(hist.indice.autores) != 1 || len(hist.BuscarTexto(Consulta{Autor: "ana"})) != 0 {
+		t.Errorf("Los autores que salen del historial deberían salir del índice: %v", hist.indice.autores)
+	}
+}
+
+// TestServeSearch prueba el endpoint GET /search
+func TestServeSearch(t *testing.T) {
+	hub := NewHub()
+	hub.historial.Agregar(mensajeEn("ana", "Acta de la reunión del martes", time.Date(2024, 5, 14, 10, 0, 0, 0, time.Local)))
+	hub.historial.Agregar(mensajeEn("luis", "Acta pendiente", time.Date(2024, 5, 16, 10, 0, 0, 0, time.Local)))
+	hub.SetClaveAdmin("secreta")
+	hub.claves["ana"] = "clave-ana"
+
+	// Sin una clave del chat no se lee el historial
+	for _, url := range []string{"/search?q=acta", "/search?q=acta&token=otra", "/search?q=acta&username=luis&token=clave-ana"} {
+		respuesta := httptest.NewRecorder()
+		ServeSearch(hub, respuesta, httptest.NewRequest(http.MethodGet, url, nil))
+		if respuesta.Code != http.StatusUnauthorized {
+			t.Errorf("%s: se esperaba 401, obtuvimos %d", url, respuesta.Code)
+		}
+	}
+
+	respuesta := httptest.NewRecorder()
+	ServeSearch(hub, respuesta, httptest.NewRequest(http.MethodGet, "/search?q=acta&from=2024-05-14&to=2024-05-14&username=ana&token=clave-ana", nil))
+	var cuerpo struct {
+		Results []*Message `json:"results"`
+	}
+	if err := json.NewDecoder(respuesta.Body).Decode(&cuerpo); err != nil {
+		t.Fatal(err)
+	}
+	if len(cuerpo.Results) != 1 || cuerpo.Results[0].Username != "ana" {
+		t.Errorf("Resultados inesperados: %+v", cuerpo.Results)
+	}
+
+	for _, url := range []string{"/search?token=secreta", "/search?q=acta&from=ayer&token=secreta"} {
+		respuesta = httptest.NewRecorder()
+		ServeSearch(hub, respuesta, httptest.NewRequest(http.MethodGet, url, nil))
+		if respuesta.Code != http.StatusBadRequest {
+			t.Errorf("%s: se esperaba 400, obtuvimos %d", url, respuesta.Code)
+		}
+	}
+}
+
+// TestBuscarPorWebSocket prueba la búsqueda desde el cliente
+func TestBuscarPorWebSocket(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	enviarTexto(t, ana, "La contraseña del wifi está en la nevera")
+	esperarMensaje(t, ana, contiene("nevera"))
+
+	enviarJSON(t, ana, map[string]interface{}{"type": "search", "query": "wifi"})
+	resultado := esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoBusqueda })
+	if len(resultado.Messages) != 1 || resultado.Messages[0].Room != salaPorDefecto {
+		t.Errorf("Resultados inesperados: %+v", resultado.Messages)
+	}
+}
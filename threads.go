@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoRespondible = errors.New("Solo se puede responder a mensajes de la conversación.")
+
+// Cita es el extracto del mensaje al que se responde. Viaja con la respuesta para que
+// el cliente pueda mostrarlo aunque el original ya no esté en pantalla
+type Cita struct {
+	MessageID      string `json:"message_id"`
+	Username       string `json:"username"`
+	MessageContent string `json:"message_content"`
+}
+
+// NewThreadMessage crea la respuesta a una consulta de hilo: el mensaje raíz seguido de sus respuestas
+func NewThreadMessage(raiz string, mensajes []*Message) *Message {
+	return &Message{
+		Username:  nombreSistema,
+		Timestamp: time.Now(),
+		Type:      tipoHilo,
+		MessageID: raiz,
+		Messages:  mensajes,
+	}
+}
+
+// prepararRespuesta enlaza un mensaje nuevo con el mensaje al que responde. Las respuestas
+// a una respuesta van al mismo hilo (un solo nivel), pero citan el mensaje concreto
+func (h *Hub) prepararRespuesta(message *Message, replyTo string) error {
+	padre, ok := h.historial.Buscar(replyTo)
+	if !ok {
+		return errMensajeNoEncontrado
+	}
+	if padre.Type != tipoUsuario && padre.Type != tipoAccion {
+		return errNoRespondible
+	}
+	if padre.Deleted {
+		return errMensajeBorrado
+	}
+	message.ReplyTo = padre.ID
+	if padre.ReplyTo != "" {
+		message.ReplyTo = padre.ReplyTo
+	}
+	message.Quote = &Cita{MessageID: padre.ID, Username: padre.Username, MessageContent: padre.MessageContent}
+	return nil
+}
+
+// enviarHilo responde al cliente con el hilo al que pertenece el mensaje indicado
+func (h *Hub) enviarHilo(client *Client, messageID string) error {
+	raiz, mensajes, ok := h.historial.Hilo(messageID)
+	if !ok {
+		return errMensajeNoEncontrado
+	}
+	h.enviarACliente(client, NewThreadMessage(raiz, mensajes))
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+// TestHistorialHilos prueba el recuento de respuestas y la consulta de un hilo
+func TestHistorialHilos(t *testing.T) {
+	hist := NewHistorial(10)
+	raiz := NewUserMessage("ana", "¿Quién revisa el PR?")
+	otro := NewUserMessage("luis", "Tema aparte")
+	respuesta := NewUserMessage("luis", "Yo")
+	respuesta.ReplyTo = raiz.ID
+	hist.Agregar(raiz)
+	hist.Agregar(otro)
+	hist.Agregar(respuesta)
+	hist.Agregar(respuesta) // repetido: no cuenta dos veces
+
+	guardada, _ := hist.Buscar(raiz.ID)
+	if guardada.ReplyCount != 1 {
+		t.Errorf("Se esperaba 1 respuesta, obtuvimos %d", guardada.ReplyCount)
+	}
+
+	// Consultar desde una respuesta devuelve el hilo completo
+	id, hilo, ok := hist.Hilo(respuesta.ID)
+	if !ok || id != raiz.ID || len(hilo) != 2 || hilo[0].ID != raiz.ID || hilo[1].ID != respuesta.ID {
+		t.Errorf("Hilo inesperado: %s %+v", id, hilo)
+	}
+	if _, _, ok := hist.Hilo("no-existe"); ok {
+		t.Error("No debería haber hilo para un mensaje desconocido")
+	}
+
+	// Borrar la respuesta la descuenta una sola vez
+	hist.Borrar(respuesta.ID)
+	hist.Borrar(respuesta.ID)
+	if guardada, _ := hist.Buscar(raiz.ID); guardada.ReplyCount != 0 {
+		t.Errorf("Se esperaban 0 respuestas tras borrar, obtuvimos %d", guardada.ReplyCount)
+	}
+}
+
+// TestResponderEnHilo prueba respuestas con cita, respuestas anidadas y la consulta del hilo
+func TestResponderEnHilo(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarTexto(t, ana, "¿Desplegamos hoy?")
+	raiz := esperarMensaje(t, luis, contiene("¿Desplegamos hoy?"))
+
+	enviarJSON(t, luis, map[string]interface{}{"message_content": "Mejor mañana", "reply_to": raiz.ID})
+	respuesta := esperarMensaje(t, ana, contiene("Mejor mañana"))
+	if respuesta.ReplyTo != raiz.ID || respuesta.Quote == nil || respuesta.Quote.MessageContent != "¿Desplegamos hoy?" {
+		t.Fatalf("Respuesta sin enlace al hilo: %+v", respuesta)
+	}
+
+	// Responder a una respuesta sigue en el mismo hilo pero cita el mensaje concreto
+	enviarJSON(t, ana, map[string]interface{}{"message_content": "Vale", "reply_to": respuesta.ID})
+	anidada := esperarMensaje(t, luis, contiene("Vale"))
+	if anidada.ReplyTo != raiz.ID || anidada.Quote.Username != "luis" {
+		t.Errorf("Respuesta anidada inesperada: %+v", anidada)
+	}
+
+	enviarJSON(t, luis, map[string]interface{}{"message_content": "¿Y esto?", "reply_to": "no-existe"})
+	esperarMensaje(t, luis, contiene("ya no está en el historial"))
+
+	enviarJSON(t, luis, map[string]interface{}{"type": "thread", "message_id": raiz.ID})
+	hilo := esperarMensaje(t, luis, func(m *Message) bool { return m.Type == tipoHilo })
+	if hilo.MessageID != raiz.ID || len(hilo.Messages) != 3 || hilo.Messages[0].ReplyCount != 2 {
+		t.Errorf("Hilo inesperado: %+v", hilo)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Tiempos y límites de los transportes HTTP
+const (
+	// Lo que espera una petición de long-polling a que haya algo que entregar
+	esperaSondeo = 25 * time.Second
+	// Sin sondeos durante este tiempo, la sesión de long-polling se da por abandonada
+	caducidadSondeo = 60 * time.Second
+	// Lo que espera un POST a que goroutineLectura recoja el mensaje anterior
+	esperaEnvio = 10 * time.Second
+	// Tamaño máximo de un mensaje enviado por POST (imágenes incluidas)
+	maxCuerpoEnvio = 16 << 20
+	// Mensajes que el navegador puede tener enviados y sin procesar
+	capacidadEntrantes = 16
+)
+
+var errConexionCerrada = errors.New("conexión cerrada")
+
+// TransportesHTTP atiende a los navegadores que no pueden abrir un WebSocket, por
+// ejemplo tras un proxy que rompe el upgrade. Reciben por Server-Sent Events (/sse) o
+// por long-polling (/poll) y envían por POST (/send). En el hub son Clients como los
+// demás: solo cambia su Conexion
+type TransportesHTTP struct {
+	hub *Hub
+	// Sesiones abiertas por su token
+	mu       sync.Mutex
+	sesiones map[string]sesionHTTP
+}
+
+// sesionHTTP es una Conexion que recibe por POST lo que envía el navegador
+type sesionHTTP interface {
+	Conexion
+	recibir(datos []byte) error
+}
+
+// NewTransportesHTTP crea los transportes HTTP de un hub
+func NewTransportesHTTP(hub *Hub) *TransportesHTTP {
+	return &TransportesHTTP{hub: hub, sesiones: make(map[string]sesionHTTP)}
+}
+
+// nuevoTokenSesion genera el token que identifica una sesión HTTP. Quien lo conoce puede
+// escribir en nombre del usuario, así que tiene que ser impredecible
+func nuevoTokenSesion() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// sesion devuelve la sesión de un token
+func (t *TransportesHTTP) sesion(token string) (sesionHTTP, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn, ok := t.sesiones[token]
+	return conn, ok
+}
+
+// olvidar borra una sesión cerrada. Se espera un poco para que el último sondeo todavía
+// encuentre el motivo del cierre
+func (t *TransportesHTTP) olvidar(token string) {
+	time.AfterFunc(esperaSondeo, func() {
+		t.mu.Lock()
+		delete(t.sesiones, token)
+		t.mu.Unlock()
+	})
+}
+
+// abrir registra en el hub el cliente de una sesión HTTP nueva y arranca su lectura.
+// Devuelve nil si el nombre no está disponible, tras responder con el error
+func (t *TransportesHTTP) abrir(w http.ResponseWriter, r *http.Request, conn sesionHTTP, token string) *Client {
+	client, err := clienteDesdeSolicitud(t.hub, conn, nombreSolicitado(r.URL.Query()), r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil
+	}
+	t.mu.Lock()
+	t.sesiones[token] = conn
+	t.mu.Unlock()
+
+	t.hub.register <- client
+	go client.goroutineLectura()
+	return client
+}
+
+// conexionHTTP es la parte común de SSE y long-polling: lo que el navegador envía por
+// POST llega por entrantes y fin se cierra con la sesión
+type conexionHTTP struct {
+	entrantes chan []byte
+	fin       chan struct{}
+	cerrarUna sync.Once
+	alCerrar  func()
+	// mu protege el plazo de escritura y el frame de cierre del servidor
+	mu     sync.Mutex
+	plazo  time.Time
+	cierre []byte
+}
+
+func newConexionHTTP(alCerrar func()) *conexionHTTP {
+	return &conexionHTTP{
+		entrantes: make(chan []byte, capacidadEntrantes),
+		fin:       make(chan struct{}),
+		alCerrar:  alCerrar,
+	}
+}
+
+// ReadMessage devuelve el siguiente mensaje enviado por POST
+func (c *conexionHTTP) ReadMessage() (int, []byte, error) {
+	select {
+	case datos := <-c.entrantes:
+		return websocket.TextMessage, datos, nil
+	case <-c.fin:
+		return 0, nil, errConexionCerrada
+	}
+}
+
+// SetReadDeadline no hace nada: el navegador no responde a los ping, y si se va lo
+// delata la propia petición HTTP (SSE) o la falta de sondeos (long-polling)
+func (c *conexionHTTP) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *conexionHTTP) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.plazo = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conexionHTTP) plazoEscritura() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.plazo
+}
+
+func (c *conexionHTTP) Close() error {
+	c.cerrarUna.Do(func() {
+		close(c.fin)
+		c.alCerrar()
+	})
+	return nil
+}
+
+// recibir entrega a goroutineLectura un mensaje enviado por POST
+func (c *conexionHTTP) recibir(datos []byte) error {
+	select {
+	case c.entrantes <- datos:
+		return nil
+	case <-c.fin:
+		return errConexionCerrada
+	case <-time.After(esperaEnvio):
+		return errors.New("la sesión no procesa los mensajes a tiempo")
+	}
+}
+
+// cierreJSON convierte el payload de un frame de cierre de WebSocket (código y motivo)
+// en el JSON que reciben los transportes HTTP
+func cierreJSON(payload []byte) []byte {
+	cierre := struct {
+		Code   int    `json:"code"`
+		Reason string `json:"reason,omitempty"`
+	}{Code: websocket.CloseNormalClosure}
+	if len(payload) >= 2 {
+		cierre.Code = int(binary.BigEndian.Uint16(payload))
+		cierre.Reason = string(payload[2:])
+	}
+	datos, _ := json.Marshal(cierre)
+	return datos
+}
+
+// conexionSSE envía los mensajes como eventos de un stream text/event-stream. Los
+// mensajes van en el evento por defecto, el cierre en "close" y los ping son comentarios
+type conexionSSE struct {
+	*conexionHTTP
+	w       http.ResponseWriter
+	control *http.ResponseController
+}
+
+func (c *conexionSSE) WriteMessage(tipo int, datos []byte) error {
+	select {
+	case <-c.fin:
+		return errConexionCerrada
+	default:
+	}
+	var evento []byte
+	switch tipo {
+	case websocket.TextMessage:
+		// El JSON no lleva saltos de línea, así que cabe en una sola línea data:
+		evento = []byte("data: " + string(datos) + "\n\n")
+	case websocket.CloseMessage:
+		evento = []byte("event: close\ndata: " + string(cierreJSON(datos)) + "\n\n")
+	case websocket.PingMessage:
+		// Mantiene abierta la conexión a través de proxies con timeout de inactividad
+		evento = []byte(": ping\n\n")
+	default:
+		return fmt.Errorf("SSE no admite frames de tipo %d", tipo)
+	}
+	c.control.SetWriteDeadline(c.plazoEscritura())
+	if _, err := c.w.Write(evento); err != nil {
+		return err
+	}
+	return c.control.Flush()
+}
+
+func (c *conexionSSE) NextWriter(tipo int) (io.WriteCloser, error) {
+	return &escritorDiferido{enviar: func(datos []byte) error { return c.WriteMessage(tipo, datos) }}, nil
+}
+
+// ServeSSE abre una sesión que recibe por Server-Sent Events. El primer evento,
+// "session", lleva el token con el que el navegador envía por /send
+func (t *TransportesHTTP) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	token, err := nuevoTokenSesion()
+	if err != nil {
+		http.Error(w, "No se pudo crear la sesión", http.StatusInternalServerError)
+		return
+	}
+	conn := &conexionSSE{w: w, control: http.NewResponseController(w)}
+	conn.conexionHTTP = newConexionHTTP(func() { t.olvidar(token) })
+	client := t.abrir(w, r, conn, token)
+	if client == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Que nginx y similares no acumulen el stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	sesion, _ := json.Marshal(map[string]string{"session": token})
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", sesion)
+	conn.control.Flush()
+
+	// Si el navegador se va, se cierra la sesión y goroutineLectura da de baja al cliente
+	go func() {
+		select {
+		case <-r.Context().Done():
+			conn.Close()
+		case <-conn.fin:
+		}
+	}()
+	// Se escribe desde la goroutine de la petición: el ResponseWriter no sobrevive a ella
+	client.goroutineEscritura()
+}
+
+// conexionSondeo entrega los mensajes a las peticiones de long-polling. Cada mensaje se
+// guarda en una bandeja de salida con un número de secuencia y solo sale de ella cuando
+// el navegador confirma que lo recibió (?ack=), así una respuesta que se pierde por el
+// camino se vuelve a entregar en el siguiente sondeo. Con la bandeja llena WriteMessage
+// espera, los mensajes se acumulan en send y se aplica la política de clientes lentos
+type conexionSondeo struct {
+	*conexionHTTP
+	ultimoSondeo atomic.Int64
+	// Protegidos por mu de conexionHTTP: los mensajes sin confirmar, el número del último
+	// guardado y un canal que se cierra (y se cambia por otro) cada vez que la bandeja cambia
+	bandeja   []saliente
+	secuencia uint64
+	cambio    chan struct{}
+}
+
+// saliente es un mensaje de la bandeja de long-polling con su número de secuencia
+type saliente struct {
+	secuencia uint64
+	datos     []byte
+}
+
+// Mensajes sin confirmar que guarda como máximo una sesión de long-polling
+const maxBandejaSondeo = 4 * maxLote
+
+// avisarLocked despierta a quien espera un cambio en la bandeja. Requiere mu tomado
+func (c *conexionSondeo) avisarLocked() {
+	close(c.cambio)
+	c.cambio = make(chan struct{})
+}
+
+func (c *conexionSondeo) WriteMessage(tipo int, datos []byte) error {
+	switch tipo {
+	case websocket.TextMessage:
+	case websocket.CloseMessage:
+		// Se entrega cuando el navegador haya recogido todo lo anterior
+		c.mu.Lock()
+		c.cierre = cierreJSON(datos)
+		c.mu.Unlock()
+		return nil
+	case websocket.PingMessage:
+		// Los sondeos periódicos ya muestran que el navegador sigue ahí
+		return nil
+	default:
+		return fmt.Errorf("long-polling no admite frames de tipo %d", tipo)
+	}
+	var limite <-chan time.Time
+	if plazo := c.plazoEscritura(); !plazo.IsZero() {
+		temporizador := time.NewTimer(time.Until(plazo))
+		defer temporizador.Stop()
+		limite = temporizador.C
+	}
+	for {
+		c.mu.Lock()
+		if len(c.bandeja) < maxBandejaSondeo {
+			c.secuencia++
+			c.bandeja = append(c.bandeja, saliente{secuencia: c.secuencia, datos: datos})
+			c.avisarLocked()
+			c.mu.Unlock()
+			return nil
+		}
+		cambio := c.cambio
+		c.mu.Unlock()
+		select {
+		case <-cambio:
+		case <-c.fin:
+			return errConexionCerrada
+		case <-limite:
+			return errors.New("el navegador no confirmó los mensajes a tiempo")
+		}
+	}
+}
+
+func (c *conexionSondeo) NextWriter(tipo int) (io.WriteCloser, error) {
+	return &escritorDiferido{enviar: func(datos []byte) error { return c.WriteMessage(tipo, datos) }}, nil
+}
+
+// confirmar quita de la bandeja lo que el navegador ya recibió (hasta ack incluido) y
+// devuelve lo siguiente, hasta maxLote mensajes, y el canal que avisa del próximo cambio
+func (c *conexionSondeo) confirmar(ack uint64) ([]saliente, chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	confirmados := 0
+	for confirmados < len(c.bandeja) && c.bandeja[confirmados].secuencia <= ack {
+		confirmados++
+	}
+	if confirmados > 0 {
+		c.bandeja = append([]saliente(nil), c.bandeja[confirmados:]...)
+		c.avisarLocked()
+	}
+	lote := c.bandeja
+	if len(lote) > maxLote {
+		lote = lote[:maxLote]
+	}
+	return append([]saliente(nil), lote...), c.cambio
+}
+
+// ReadMessage devuelve lo enviado por POST y cierra la sesión si el navegador deja de sondear
+func (c *conexionSondeo) ReadMessage() (int, []byte, error) {
+	for {
+		espera := caducidadSondeo - time.Since(time.Unix(0, c.ultimoSondeo.Load()))
+		if espera <= 0 {
+			c.Close()
+			return 0, nil, errors.New("sesión de long-polling abandonada")
+		}
+		select {
+		case datos := <-c.entrantes:
+			return websocket.TextMessage, datos, nil
+		case <-c.fin:
+			return 0, nil, errConexionCerrada
+		case <-time.After(espera):
+		}
+	}
+}
+
+// ServeSondeo atiende el long-polling. Sin ?session= abre una sesión y responde con su
+// token. Con él, ?ack= confirma los mensajes recibidos hasta ese número y la petición
+// espera hasta esperaSondeo a que haya mensajes sin confirmar. Responde
+// {"seq": <número del último>, "messages": [...]}; sin mensajes, seq repite el ack. Una
+// sesión cerrada responde 410 con el código y motivo cuando ya no queda nada por entregar
+func (t *TransportesHTTP) ServeSondeo(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("session")
+	if token == "" {
+		t.abrirSondeo(w, r)
+		return
+	}
+	sesion, ok := t.sesion(token)
+	conn, esSondeo := sesion.(*conexionSondeo)
+	if !ok || !esSondeo {
+		http.Error(w, "Sesión desconocida", http.StatusNotFound)
+		return
+	}
+	var ack uint64
+	if valor := r.URL.Query().Get("ack"); valor != "" {
+		var err error
+		if ack, err = strconv.ParseUint(valor, 10, 64); err != nil {
+			http.Error(w, "ack no válido", http.StatusBadRequest)
+			return
+		}
+	}
+	conn.ultimoSondeo.Store(time.Now().UnixNano())
+	defer func() { conn.ultimoSondeo.Store(time.Now().UnixNano()) }()
+
+	limite := time.NewTimer(esperaSondeo)
+	defer limite.Stop()
+	lote, cambio := conn.confirmar(ack)
+esperar:
+	for len(lote) == 0 {
+		select {
+		case <-cambio:
+			lote, cambio = conn.confirmar(ack)
+		case <-conn.fin:
+			// Lo que quedó en la bandeja al cerrar sale antes que el cierre
+			if lote, _ = conn.confirmar(ack); len(lote) > 0 {
+				break esperar
+			}
+			conn.mu.Lock()
+			cierre := conn.cierre
+			conn.mu.Unlock()
+			if cierre == nil {
+				cierre = cierreJSON(nil)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			w.Write(cierre)
+			return
+		case <-limite.C:
+			break esperar
+		case <-r.Context().Done():
+			return
+		}
+	}
+	ultimo := ack
+	partes := make([]string, len(lote))
+	for i, m := range lote {
+		partes[i] = string(m.datos)
+		ultimo = m.secuencia
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, `{"seq":%d,"messages":[%s]}`, ultimo, strings.Join(partes, ","))
+}
+
+// abrirSondeo crea una sesión de long-polling
+func (t *TransportesHTTP) abrirSondeo(w http.ResponseWriter, r *http.Request) {
+	token, err := nuevoTokenSesion()
+	if err != nil {
+		http.Error(w, "No se pudo crear la sesión", http.StatusInternalServerError)
+		return
+	}
+	conn := &conexionSondeo{cambio: make(chan struct{})}
+	conn.conexionHTTP = newConexionHTTP(func() { t.olvidar(token) })
+	conn.ultimoSondeo.Store(time.Now().UnixNano())
+	client := t.abrir(w, r, conn, token)
+	if client == nil {
+		return
+	}
+	go client.goroutineEscritura()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"session": token})
+}
+
+// ServeEnviar recibe por POST un mensaje de una sesión SSE o de long-polling, con el
+// mismo JSON que se enviaría por el WebSocket. DELETE cierra la sesión, para que el
+// long-polling no espere a caducar cuando el usuario se desconecta
+func (t *TransportesHTTP) ServeEnviar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	conn, ok := t.sesion(r.URL.Query().Get("session"))
+	if !ok {
+		http.Error(w, "Sesión desconocida", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		conn.Close()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	datos, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCuerpoEnvio))
+	if err != nil {
+		http.Error(w, "Mensaje demasiado grande", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := conn.recibir(datos); err != nil {
+		log.Printf("Mensaje por POST descartado: %v", err)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// servirTransportesPrueba arranca un servidor con los transportes HTTP y devuelve su
+// URL base. Los usuarios con WebSocket se conectan en memoria
+func servirTransportesPrueba(t *testing.T) (*Hub, string) {
+	t.Helper()
+	hub := NewHub()
+	go hub.Run()
+	transportes := NewTransportesHTTP(hub)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sse", transportes.ServeSSE)
+	mux.HandleFunc("/poll", transportes.ServeSondeo)
+	mux.HandleFunc("/send", transportes.ServeEnviar)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return hub, server.URL
+}
+
+// eventoSSE lee el siguiente evento del stream, saltando los comentarios
+func eventoSSE(t *testing.T, lector *bufio.Reader) (nombre, datos string) {
+	t.Helper()
+	for {
+		linea, err := lector.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream SSE cortado: %v", err)
+		}
+		linea = strings.TrimSuffix(linea, "\n")
+		switch {
+		case linea == "" && datos != "":
+			return nombre, datos
+		case strings.HasPrefix(linea, "event: "):
+			nombre = strings.TrimPrefix(linea, "event: ")
+		case strings.HasPrefix(linea, "data: "):
+			datos = strings.TrimPrefix(linea, "data: ")
+		}
+	}
+}
+
+// enviarPOST envía un mensaje por /send como lo hace el frontend sin WebSocket
+func enviarPOST(t *testing.T, base, sesion, texto string) {
+	t.Helper()
+	cuerpo, _ := json.Marshal(map[string]string{"message_content": texto})
+	respuesta, err := http.Post(base+"/send?session="+sesion, "application/json", strings.NewReader(string(cuerpo)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	respuesta.Body.Close()
+	if respuesta.StatusCode != http.StatusNoContent {
+		t.Fatalf("POST respondió %d", respuesta.StatusCode)
+	}
+}
+
+// TestSSEConPOST prueba que un navegador sin WebSocket conversa con uno que sí lo tiene
+func TestSSEConPOST(t *testing.T) {
+	hub, base := servirTransportesPrueba(t)
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	respuesta, err := http.Get(base + "/sse?username=ana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tipo := respuesta.Header.Get("Content-Type"); tipo != "text/event-stream" {
+		t.Fatalf("Content-Type %q", tipo)
+	}
+	lector := bufio.NewReader(respuesta.Body)
+	nombre, datos := eventoSSE(t, lector)
+	var sesion struct{ Session string }
+	if nombre != "session" || json.Unmarshal([]byte(datos), &sesion) != nil || sesion.Session == "" {
+		t.Fatalf("Primer evento inesperado: %s %s", nombre, datos)
+	}
+
+	enviarPOST(t, base, sesion.Session, "hola por POST")
+	esperarMensaje(t, luis, contiene("hola por POST"))
+	enviarTexto(t, luis, "hola por SSE")
+	for {
+		_, datos := eventoSSE(t, lector)
+		var message Message
+		if err := json.Unmarshal([]byte(datos), &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.MessageContent == "hola por SSE" {
+			break
+		}
+	}
+
+	// Al cortar el stream el cliente se da de baja
+	respuesta.Body.Close()
+	esperarMensaje(t, luis, esPresencia("ana", presenciaSale))
+	if hub.GetClientCount() != 1 {
+		t.Errorf("Se esperaba 1 cliente, obtuvimos %d", hub.GetClientCount())
+	}
+}
+
+// sondear hace una petición de long-polling y devuelve el código y el cuerpo
+func sondear(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	respuesta, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer respuesta.Body.Close()
+	cuerpo, _ := io.ReadAll(respuesta.Body)
+	return respuesta.StatusCode, cuerpo
+}
+
+// loteSondeo es la respuesta de un sondeo con mensajes
+type loteSondeo struct {
+	Seq      uint64
+	Messages []Message
+}
+
+// sondearLote hace un sondeo que confirma hasta ack y devuelve el lote recibido
+func sondearLote(t *testing.T, base, sesion string, ack uint64) loteSondeo {
+	t.Helper()
+	codigo, cuerpo := sondear(t, fmt.Sprintf("%s/poll?session=%s&ack=%d", base, sesion, ack))
+	var lote loteSondeo
+	if codigo != http.StatusOK || json.Unmarshal(cuerpo, &lote) != nil {
+		t.Fatalf("Sondeo inesperado: %d %s", codigo, cuerpo)
+	}
+	return lote
+}
+
+// abrirSondeoPrueba abre una sesión de long-polling y devuelve su token
+func abrirSondeoPrueba(t *testing.T, base, opciones string) string {
+	t.Helper()
+	codigo, cuerpo := sondear(t, base+"/poll?username="+opciones)
+	var sesion struct{ Session string }
+	if codigo != http.StatusOK || json.Unmarshal(cuerpo, &sesion) != nil || sesion.Session == "" {
+		t.Fatalf("Apertura inesperada: %d %s", codigo, cuerpo)
+	}
+	return sesion.Session
+}
+
+// TestSondeoConPOST prueba el long-polling: los mensajes salen agrupados y el cierre del
+// servidor llega al siguiente sondeo con su código
+func TestSondeoConPOST(t *testing.T) {
+	hub, base := servirTransportesPrueba(t)
+	hub.SetAdmins([]string{"admin"})
+	hub.SetClaveAdmin("secreta")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	sesion := abrirSondeoPrueba(t, base, "admin&token=secreta")
+	enviarPOST(t, base, sesion, "hola por POST")
+	esperarMensaje(t, luis, contiene("hola por POST"))
+
+	var ack uint64
+	recibido := false
+	limite := time.Now().Add(2 * time.Second)
+	for !recibido && time.Now().Before(limite) {
+		lote := sondearLote(t, base, sesion, ack)
+		ack = lote.Seq
+		for _, message := range lote.Messages {
+			recibido = recibido || message.MessageContent == "hola por POST"
+		}
+	}
+	if !recibido {
+		t.Fatal("El sondeo no devolvió el mensaje")
+	}
+
+	// Otra sesión con takeover cierra esta con el código de sesión reemplazada
+	conectarEnMemoria(t, hub, "admin&token=secreta&takeover=1")
+	var codigo int
+	var cuerpo []byte
+	for time.Now().Before(limite.Add(2 * time.Second)) {
+		codigo, cuerpo = sondear(t, fmt.Sprintf("%s/poll?session=%s&ack=%d", base, sesion, ack))
+		if codigo != http.StatusOK {
+			break
+		}
+		var lote loteSondeo
+		json.Unmarshal(cuerpo, &lote)
+		ack = lote.Seq
+	}
+	var cierre struct{ Code int }
+	if codigo != http.StatusGone || json.Unmarshal(cuerpo, &cierre) != nil || cierre.Code != cierreSesionReemplazada {
+		t.Errorf("Se esperaba 410 con el código %d, obtuvimos %d %s", cierreSesionReemplazada, codigo, cuerpo)
+	}
+}
+
+// TestSondeoReentregaSinConfirmar prueba que lo pendiente sale agrupado y que un lote
+// cuya respuesta se perdió vuelve a llegar mientras el navegador no lo confirma
+func TestSondeoReentregaSinConfirmar(t *testing.T) {
+	hub, base := servirTransportesPrueba(t)
+	sesion := abrirSondeoPrueba(t, base, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+	for i := 0; i < 3; i++ {
+		enviarTexto(t, luis, fmt.Sprintf("mensaje %d", i))
+	}
+	// Sin confirmar nada, cada sondeo devuelve todo lo pendiente en una respuesta
+	var primero loteSondeo
+	limite := time.Now().Add(2 * time.Second)
+	for !contieneTexto(primero.Messages, "mensaje 2") {
+		if time.Now().After(limite) {
+			t.Fatalf("Los mensajes no llegaron: %+v", primero.Messages)
+		}
+		primero = sondearLote(t, base, sesion, 0)
+	}
+	if !contieneTexto(primero.Messages, "mensaje 0") || !contieneTexto(primero.Messages, "mensaje 1") {
+		t.Errorf("Se esperaban los tres mensajes en el mismo lote: %+v", primero.Messages)
+	}
+	repetido := sondearLote(t, base, sesion, 0)
+	if repetido.Seq < primero.Seq || len(repetido.Messages) < len(primero.Messages) ||
+		!contieneTexto(repetido.Messages, "mensaje 0") {
+		t.Errorf("Sin confirmar debería volver a llegar el lote: %+v", repetido.Messages)
+	}
+
+	// Al confirmarlo, ya no vuelve
+	enviarTexto(t, luis, "después")
+	esperarMensaje(t, luis, contiene("después"))
+	siguiente := loteSondeo{Seq: repetido.Seq}
+	for !contieneTexto(siguiente.Messages, "después") {
+		siguiente = sondearLote(t, base, sesion, siguiente.Seq)
+		if contieneTexto(siguiente.Messages, "mensaje 0") {
+			t.Fatalf("Un mensaje confirmado volvió a llegar: %+v", siguiente.Messages)
+		}
+	}
+}
+
+// contieneTexto indica si algún mensaje tiene exactamente ese texto
+func contieneTexto(mensajes []Message, texto string) bool {
+	for _, message := range mensajes {
+		if message.MessageContent == texto {
+			return true
+		}
+	}
+	return false
+}
+
+// TestSesionHTTPDesconocida prueba que sin un token válido no se puede enviar ni sondear
+func TestSesionHTTPDesconocida(t *testing.T) {
+	_, base := servirTransportesPrueba(t)
+	respuesta, err := http.Post(base+"/send?session=inventada", "application/json", strings.NewReader(`{"message_content":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	respuesta.Body.Close()
+	if respuesta.StatusCode != http.StatusNotFound {
+		t.Errorf("POST con sesión inventada: %d", respuesta.StatusCode)
+	}
+	if codigo, _ := sondear(t, base+"/poll?session=inventada"); codigo != http.StatusNotFound {
+		t.Errorf("Sondeo con sesión inventada: %d", codigo)
+	}
+	if codigo, _ := sondear(t, base+"/send"); codigo != http.StatusMethodNotAllowed {
+		t.Errorf("GET a /send: %d", codigo)
+	}
+}
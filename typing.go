@@ -0,0 +1,90 @@
+package main
+
+import "time"
+
+// Valores por defecto de los indicadores de escritura
+const (
+	// Si el cliente no renueva typing_start en este tiempo (o desaparece), se da por terminado
+	caducidadEscribiendoPorDefecto = 6 * time.Second
+	intervaloEscribiendoPorDefecto = time.Second
+)
+
+// NewTypingMessage crea un evento efímero de escritura (typing_start o typing_stop)
+func NewTypingMessage(username, tipo string) *Message {
+	return &Message{
+		Username:  username,
+		Timestamp: time.Now(),
+		Type:      tipo,
+	}
+}
+
+// esEfimero indica si un mensaje solo se reenvía en el momento: no se guarda ni se registra en el log
+func esEfimero(message *Message) bool {
+	switch message.Type {
+	case tipoEscribiendo, tipoDejaEscribir, tipoRecibo:
+		return true
+	}
+	return false
+}
+
+// notificarEscritura pasa al hub un typing_start/typing_stop del cliente sin bloquear
+// la lectura: si el hub va atrasado, perder un indicador no tiene importancia
+func (h *Hub) notificarEscritura(client *Client, tipo string) {
+	select {
+	case h.escribiendo <- NewTypingMessage(client.nombre(), tipo):
+	default:
+	}
+}
+
+// procesarEscritura actualiza quién está escribiendo. Varios typing_start seguidos del
+// mismo usuario (por ejemplo desde dos sesiones) solo renuevan la caducidad, así que
+// los demás reciben un único inicio y un único final. Los otros nodos reciben los mismos
+// eventos por el broker. Solo se llama desde Run
+func (h *Hub) procesarEscritura(evento *Message) {
+	_, yaEscribia := h.tecleando[evento.Username]
+	switch evento.Type {
+	case tipoEscribiendo:
+		h.tecleando[evento.Username] = time.Now().Add(h.caducidadEscribiendo)
+		if !yaEscribia {
+			h.difundirEfimero(evento, true)
+			h.publicarEfimero(evento)
+		}
+	case tipoDejaEscribir:
+		h.terminarEscritura(evento.Username)
+	case tipoPresencia:
+		// Renombre (ver cambiarNombre): quien escribía sigue escribiendo con el nombre nuevo
+		if caduca, ok := h.tecleando[evento.PreviousUsername]; ok {
+			delete(h.tecleando, evento.PreviousUsername)
+			h.tecleando[evento.Username] = caduca
+		}
+	}
+}
+
+// terminarEscritura avisa a los demás de que un usuario dejó de escribir, si estaba escribiendo
+func (h *Hub) terminarEscritura(nombre string) {
+	if _, ok := h.tecleando[nombre]; !ok {
+		return
+	}
+	delete(h.tecleando, nombre)
+	final := NewTypingMessage(nombre, tipoDejaEscribir)
+	h.difundirEfimero(final, true)
+	h.publicarEfimero(final)
+}
+
+// caducarEscritura termina los indicadores que el cliente no renovó a tiempo
+func (h *Hub) caducarEscritura() {
+	ahora := time.Now()
+	for nombre, caduca := range h.tecleando {
+		if ahora.After(caduca) {
+			h.terminarEscritura(nombre)
+		}
+	}
+}
+
+// difundirEfimero reenvía un evento sin guardarlo, sin registrarlo en el log y sin
+// esperar a clientes lentos: si el canal de uno está lleno, ese cliente simplemente no
+// ve el evento. Con excluirAutor no llega a ninguna sesión del propio usuario.
+// Se puede llamar desde cualquier goroutine que no tenga clientsMutex tomado en escritura
+func (h *Hub) difundirEfimero(message *Message, excluirAutor bool) {
+	h.difundir(&difusion{message: message, excluirAutor: excluirAutor}, false)
+}
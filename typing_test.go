@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// enviarEvento envía una operación {"type": tipo} sin más campos
+func enviarEvento(t *testing.T, conn Conexion, tipo string) {
+	t.Helper()
+	evento, _ := json.Marshal(map[string]interface{}{"type": tipo})
+	if err := conn.WriteMessage(websocket.TextMessage, evento); err != nil {
+		t.Fatalf("Error al enviar %s: %v", tipo, err)
+	}
+}
+
+func esEscritura(usuario, tipo string) func(*Message) bool {
+	return func(m *Message) bool { return m.Type == tipo && m.Username == usuario }
+}
+
+// TestIndicadorEscritura prueba el reenvío a los demás y la agrupación de inicios repetidos
+func TestIndicadorEscritura(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarEvento(t, ana, tipoEscribiendo)
+	enviarEvento(t, ana, tipoEscribiendo)
+	enviarEvento(t, ana, tipoDejaEscribir)
+
+	// Los indicadores comparten cola en el hub: cuando llega el final ya se procesaron
+	// los inicios, y la marca de luis comprueba que no queda ninguno más por llegar
+	inicios, finales := 0, 1
+	esperarMensaje(t, luis, func(m *Message) bool {
+		if esEscritura("ana", tipoEscribiendo)(m) {
+			inicios++
+		}
+		return esEscritura("ana", tipoDejaEscribir)(m)
+	})
+	enviarTexto(t, luis, "marca")
+	for _, m := range mensajesHasta(t, luis, "marca") {
+		switch {
+		case esEscritura("ana", tipoEscribiendo)(m):
+			inicios++
+		case esEscritura("ana", tipoDejaEscribir)(m):
+			finales++
+		}
+	}
+	if inicios != 1 || finales != 1 {
+		t.Errorf("Se esperaba un inicio y un final, obtuvimos %d y %d", inicios, finales)
+	}
+
+	// El autor no recibe su propio indicador
+	for _, m := range mensajesHasta(t, ana, "marca") {
+		if m.Type == tipoEscribiendo || m.Type == tipoDejaEscribir {
+			t.Errorf("ana no debería recibir su propio indicador: %+v", m)
+		}
+	}
+}
+
+// TestIndicadorEscrituraCaduca prueba que el servidor termina el indicador si el cliente desaparece
+func TestIndicadorEscrituraCaduca(t *testing.T) {
+	hub := NewHub()
+	hub.caducidadEscribiendo = 100 * time.Millisecond
+	hub.intervaloEscribiendo = 20 * time.Millisecond
+	go hub.Run()
+
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarEvento(t, ana, tipoEscribiendo)
+	esperarMensaje(t, luis, esEscritura("ana", tipoEscribiendo))
+	esperarMensaje(t, luis, esEscritura("ana", tipoDejaEscribir))
+}
+
+// TestIndicadorEscrituraTerminaAlEnviar prueba que enviar un mensaje termina el indicador
+func TestIndicadorEscrituraTerminaAlEnviar(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarEvento(t, ana, tipoEscribiendo)
+	esperarMensaje(t, luis, esEscritura("ana", tipoEscribiendo))
+	enviarTexto(t, ana, "ya está")
+
+	anteriores := mensajesHasta(t, luis, "ya está")
+	if len(anteriores) == 0 || !esEscritura("ana", tipoDejaEscribir)(anteriores[len(anteriores)-1]) {
+		t.Errorf("Se esperaba typing_stop antes del mensaje, obtuvimos %+v", anteriores)
+	}
+}
+
+// TestIndicadorEscrituraSigueAlRenombre prueba que quien escribe y se cambia el nombre
+// termina de escribir con el nombre nuevo
+func TestIndicadorEscrituraSigueAlRenombre(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarEvento(t, ana, tipoEscribiendo)
+	esperarMensaje(t, luis, esEscritura("ana", tipoEscribiendo))
+	enviarTexto(t, ana, "/nick anabel")
+	esperarMensaje(t, ana, func(m *Message) bool { return m.Type == tipoNick })
+	enviarEvento(t, ana, tipoDejaEscribir)
+	esperarMensaje(t, luis, esEscritura("anabel", tipoDejaEscribir))
+}
+
+// registroSeguro es un destino de log que se puede leer mientras otras goroutines escriben
+type registroSeguro struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *registroSeguro) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *registroSeguro) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.String()
+}
+
+// TestIndicadorEscrituraNoSeRegistra prueba que los indicadores no pasan por el log de difusión
+func TestIndicadorEscrituraNoSeRegistra(t *testing.T) {
+	registro := &registroSeguro{}
+	log.SetOutput(registro)
+	defer log.SetOutput(os.Stderr)
+
+	hub := NewHub()
+	go hub.Run()
+	ana := conectarEnMemoria(t, hub, "ana")
+	luis := conectarEnMemoria(t, hub, "luis")
+
+	enviarEvento(t, ana, tipoEscribiendo)
+	esperarMensaje(t, luis, esEscritura("ana", tipoEscribiendo))
+
+	if strings.Contains(registro.String(), tipoEscribiendo) {
+		t.Errorf("El indicador de escritura apareció en el log:\n%s", registro.String())
+	}
+}